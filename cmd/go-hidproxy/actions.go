@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	"strings"
+)
+
+var keyCodes map[string]uint16
+
+// Codes with more than one name. evdev.KEY and evdev.BTN hold only one name
+// per code, and which one depends on map order, so both are listed here.
+var keyCodeAliases = map[string]uint16{
+	"KEY_MUTE":              113,
+	"KEY_MIN_INTERESTING":   113,
+	"KEY_HANGEUL":           122,
+	"KEY_HANGUEL":           122,
+	"KEY_COFFEE":            152,
+	"KEY_SCREENLOCK":        152,
+	"KEY_ROTATE_DISPLAY":    153,
+	"KEY_DIRECTION":         153,
+	"KEY_BRIGHTNESS_AUTO":   244,
+	"KEY_BRIGHTNESS_ZERO":   244,
+	"KEY_WWAN":              246,
+	"KEY_WIMAX":             246,
+	"BTN_MISC":              256,
+	"BTN_0":                 256,
+	"BTN_MOUSE":             272,
+	"BTN_LEFT":              272,
+	"BTN_JOYSTICK":          288,
+	"BTN_TRIGGER":           288,
+	"BTN_GAMEPAD":           304,
+	"BTN_SOUTH":             304,
+	"BTN_A":                 304,
+	"BTN_EAST":              305,
+	"BTN_B":                 305,
+	"BTN_NORTH":             307,
+	"BTN_X":                 307,
+	"BTN_WEST":              308,
+	"BTN_Y":                 308,
+	"BTN_DIGI":              320,
+	"BTN_TOOL_PEN":          320,
+	"BTN_WHEEL":             336,
+	"BTN_GEAR_DOWN":         336,
+	"KEY_DISPLAYTOGGLE":     431,
+	"KEY_BRIGHTNESS_TOGGLE": 431,
+	"KEY_FASTREVERSE":       629,
+	"KEY_DATA":              629,
+	"BTN_TRIGGER_HAPPY":     704,
+	"BTN_TRIGGER_HAPPY1":    704,
+}
+
+// Looks up an evdev key code by name, eg. KEY_PROG1 or BTN_LEFT
+func KeyCode(name string) (uint16, bool) {
+	if keyCodes == nil {
+		keyCodes = make(map[string]uint16, len(evdev.KEY)+len(evdev.BTN))
+		for code, name := range evdev.KEY {
+			keyCodes[name] = uint16(code)
+		}
+		for code, name := range evdev.BTN {
+			keyCodes[name] = uint16(code)
+		}
+		for name, code := range keyCodeAliases {
+			keyCodes[name] = code
+		}
+	}
+	code, ok := keyCodes[strings.TrimSpace(name)]
+	return code, ok
+}
+
+// Mouse button, wheel movement or movement while held (see MouseKeys)
+// produced by a key, or a keyboard key (as a HID usage) produced by a mouse
+// button
+type MouseAction struct {
+	Button uint8
+	Wheel  int32
+	MoveX  int32
+	MoveY  int32
+	Key    uint16
+}
+
+var mouseActions = map[string]MouseAction{
+	"button-left":   {Button: BUTTON_LEFT},
+	"button-right":  {Button: BUTTON_RIGHT},
+	"button-middle": {Button: BUTTON_MIDDLE},
+	"button-side":   {Button: BUTTON_SIDE},
+	"button-extra":  {Button: BUTTON_EXTRA},
+	"wheel-up":      {Wheel: 1},
+	"wheel-down":    {Wheel: -1},
+	"move-up":       {MoveY: -1},
+	"move-down":     {MoveY: 1},
+	"move-left":     {MoveX: -1},
+	"move-right":    {MoveX: 1},
+}
+
+// Returns true if the action moves the mouse while the key is held
+func (a MouseAction) Moves() bool {
+	return a.MoveX != 0 || a.MoveY != 0
+}
+
+// Parses a mapping of evdev key names to mouse actions, eg.
+// "KEY_PROG1": "button-middle", or of mouse buttons to keys, eg.
+// "BTN_SIDE": "KEY_BACK"
+func ParseMouseActions(actions map[string]string, keymap *Keymap) (map[uint16]MouseAction, error) {
+	parsed := make(map[uint16]MouseAction, len(actions))
+	for key, name := range actions {
+		code, ok := KeyCode(key)
+		if !ok {
+			return nil, fmt.Errorf("unknown key: %s", key)
+		}
+		action, ok := mouseActions[name]
+		if !ok {
+			target, isKey := KeyCode(name)
+			if !isKey {
+				return nil, fmt.Errorf("unknown mouse action for %s: %s", key, name)
+			}
+			usage, ok := keymap.Lookup(target)
+			if !ok {
+				return nil, fmt.Errorf("key for %s can't be sent to the host: %s", key, name)
+			}
+			action = MouseAction{Key: usage}
+		}
+		parsed[code] = action
+	}
+	return parsed, nil
+}
+
+// Applies a mouse action for a key event (value 0 release, 1 press, 2 repeat)
+// to the button state and the keys held on the device, and returns both.
+// Buttons and keys follow the key, the wheel moves on every press and
+// repeat. The caller sends the keys if the action has one (see SendsKey).
+// Movement is left to MouseKeys.
+func (a MouseAction) Apply(buttons uint8, keys []uint16, value int32, mouse *MouseState) (uint8, []uint16) {
+	if a.Key != 0 && value == 1 {
+		keys = withKey(keys, a.Key)
+	} else if a.Key != 0 && value == 0 {
+		keys = withoutKey(keys, a.Key)
+	}
+	if a.Button != 0 {
+		if value > 0 {
+			buttons |= a.Button
+		} else {
+			buttons &= ^a.Button
+		}
+	}
+	if a.Wheel != 0 && value > 0 {
+		mouse.Move(0, 0, a.Wheel)
+	}
+	return buttons, keys
+}
+
+// Returns true if the key event changes the keys held by the action
+func (a MouseAction) SendsKey(value int32) bool {
+	return a.Key != 0 && value < 2
+}
+
+const (
+	DIAL_WHEEL  = "wheel"
+	DIAL_VOLUME = "volume"
+)
+
+// What turning a dial (REL_DIAL, eg. on jog dials and presenters) does:
+// scroll like a wheel, or tap a key (as a HID usage) per step in each
+// direction
+type DialAction struct {
+	Wheel bool
+	Up    uint16
+	Down  uint16
+}
+
+// Parses a dial action: wheel, volume, or the evdev key names for turning up
+// (clockwise) and down separated by a comma, eg. "KEY_RIGHT,KEY_LEFT"
+func ParseDialAction(action string, keymap *Keymap) (DialAction, error) {
+	switch action {
+	case DIAL_WHEEL, "":
+		return DialAction{Wheel: true}, nil
+	case DIAL_VOLUME:
+		action = "KEY_VOLUMEUP,KEY_VOLUMEDOWN"
+	}
+	keys := strings.Split(action, ",")
+	if len(keys) != 2 {
+		return DialAction{}, fmt.Errorf("unknown dial action: %s (expected %s, %s or two keys, eg. KEY_RIGHT,KEY_LEFT)", action, DIAL_WHEEL, DIAL_VOLUME)
+	}
+	usages := make([]uint16, 2)
+	for i, key := range keys {
+		code, ok := KeyCode(key)
+		if !ok {
+			return DialAction{}, fmt.Errorf("unknown key for dial action: %s", key)
+		}
+		usage, ok := keymap.Lookup(code)
+		if !ok {
+			return DialAction{}, fmt.Errorf("key for dial action can't be sent to the host: %s", key)
+		}
+		usages[i] = usage
+	}
+	return DialAction{Up: usages[0], Down: usages[1]}, nil
+}
+
+// Taps the key for each step the dial turned. Each tap is sent with the keys
+// held on the device through send, which merges in the keys held on its
+// siblings, so held keys stay held on the host.
+func (d DialAction) Turn(steps int32, held []uint16, send func(keys []uint16)) {
+	usage := d.Up
+	if steps < 0 {
+		usage, steps = d.Down, -steps
+	}
+	for i := int32(0); i < steps; i++ {
+		send(withKey(held, usage))
+		send(held)
+	}
+}
+
+// Returns a copy of the keys with the key added, if it isn't there yet
+func withKey(keys []uint16, key uint16) []uint16 {
+	with := append([]uint16{}, keys...)
+	for _, k := range keys {
+		if k == key {
+			return with
+		}
+	}
+	return append(with, key)
+}
+
+// Returns a copy of the keys without the key
+func withoutKey(keys []uint16, key uint16) []uint16 {
+	without := make([]uint16, 0, len(keys))
+	for _, k := range keys {
+		if k != key {
+			without = append(without, k)
+		}
+	}
+	return without
+}
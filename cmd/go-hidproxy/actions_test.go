@@ -0,0 +1,77 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"reflect"
+	"testing"
+)
+
+func TestKeyCodeAliases(t *testing.T) {
+	for name, want := range keyCodeAliases {
+		if code, ok := KeyCode(name); !ok || code != want {
+			t.Errorf("%s: got %d (%v), want %d", name, code, ok, want)
+		}
+		// The alias table mustn't disagree with the names evdev has
+		if other, ok := evdev.KEY[int(want)]; ok && keyCodeAliases[other] != want {
+			t.Errorf("%s: evdev names code %d %s", name, want, other)
+		}
+	}
+}
+
+func TestDialTurnKeepsHeldKeys(t *testing.T) {
+	dial, err := ParseDialAction("KEY_RIGHT,KEY_LEFT", NewKeymap(Scancodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shift := Scancodes[42] // KEY_LEFTSHIFT
+	held := []uint16{shift}
+	sent := make([][]uint16, 0)
+	dial.Turn(-2, held, func(keys []uint16) {
+		sent = append(sent, keys)
+	})
+	want := [][]uint16{
+		{shift, dial.Down},
+		{shift},
+		{shift, dial.Down},
+		{shift},
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("got %v, want %v", sent, want)
+	}
+	if !reflect.DeepEqual(held, []uint16{shift}) {
+		t.Errorf("held keys changed to %v", held)
+	}
+}
+
+func TestMouseActionKeyMergesWithHeldKeys(t *testing.T) {
+	actions, err := ParseMouseActions(map[string]string{"BTN_SIDE": "KEY_BACK"}, NewKeymap(Scancodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	action := actions[evdev.BTN_SIDE]
+	shift := Scancodes[42] // KEY_LEFTSHIFT
+	mouse := NewMouseState()
+	group := &KeyboardGroup{held: make(map[string][]uint16, 0)}
+	group.Set("keyboard", []uint16{shift})
+
+	var keys []uint16
+	var buttons uint8
+	buttons, keys = action.Apply(buttons, keys, 1, mouse)
+	if !action.SendsKey(1) || !reflect.DeepEqual(keys, []uint16{action.Key}) || buttons != 0 {
+		t.Fatalf("press: got keys %v, buttons %#x", keys, buttons)
+	}
+	// The report for the mouse's key keeps shift held on the keyboard
+	if got := group.Set("mouse", keys); !reflect.DeepEqual(got, []uint16{action.Key, shift}) {
+		t.Errorf("press: group holds %v", got)
+	}
+	if action.SendsKey(2) {
+		t.Error("repeat sends the key again")
+	}
+	_, keys = action.Apply(buttons, keys, 0, mouse)
+	if len(keys) != 0 {
+		t.Errorf("release: got keys %v", keys)
+	}
+	if got := group.Set("mouse", keys); !reflect.DeepEqual(got, []uint16{shift}) {
+		t.Errorf("release: group holds %v", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+// Forwarding only some keys to the host, eg. for kiosks
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+// Keys allowed to reach the host: keyboard keys by HID usage, and power keys
+// (see SystemControlKeys) and media keys (see ConsumerKeys) by evdev key
+// code. Keys are also checked by evdev key code as they come in, before
+// rules, mouse actions and hotkeys see them. An empty allowlist allows all
+// keys.
+type KeyAllowlist struct {
+	codes    map[uint16]bool
+	usages   map[uint16]bool
+	system   map[uint16]bool
+	consumer map[uint16]bool
+}
+
+// Parses an allowlist of evdev key names, eg. KEY_UP or KEY_LEFTSHIFT.
+// Modifiers are keys like any other, so a modifier not on the list never
+// reaches the host either.
+func ParseKeyAllowlist(names []string, keymap *Keymap) (KeyAllowlist, error) {
+	allowlist := KeyAllowlist{
+		codes:    make(map[uint16]bool, len(names)),
+		usages:   make(map[uint16]bool, len(names)),
+		system:   make(map[uint16]bool, 0),
+		consumer: make(map[uint16]bool, 0),
+	}
+	for _, name := range names {
+		code, ok := KeyCode(name)
+		if !ok {
+			return allowlist, fmt.Errorf("unknown key: %s", name)
+		}
+		allowlist.codes[code] = true
+		_, system := SystemControlKeys[code]
+		if system {
+			allowlist.system[code] = true
+		}
+		_, consumer := ConsumerKeys[code]
+		if consumer {
+			allowlist.consumer[code] = true
+		}
+		// Power and media keys go through the keyboard report without
+		// -system-control and -consumer-control. Keys without a HID usage
+		// can still trigger rules and mouse actions.
+		if usage, ok := keymap.Lookup(code); ok {
+			allowlist.usages[usage] = true
+		}
+	}
+	return allowlist, nil
+}
+
+func (a KeyAllowlist) empty() bool {
+	return len(a.codes) == 0
+}
+
+// Returns true if the key with the evdev key code may be handled at all.
+// KEY_UNKNOWN is let through to be checked by its HID usage once its raw
+// scancode is looked up (see ParseRawScancodes).
+func (a KeyAllowlist) AllowsCode(code uint16) bool {
+	return a.empty() || a.codes[code] || code == evdev.KEY_UNKNOWN
+}
+
+// Returns true if the key with the HID usage may be sent to the host
+func (a KeyAllowlist) Allows(usage uint16) bool {
+	return a.empty() || a.usages[usage]
+}
+
+// Returns true if the power key with the evdev key code may be sent to the
+// host
+func (a KeyAllowlist) AllowsSystem(code uint16) bool {
+	return a.empty() || a.system[code]
+}
+
+// Returns true if the media key with the evdev key code may be sent to the
+// host
+func (a KeyAllowlist) AllowsConsumer(code uint16) bool {
+	return a.empty() || a.consumer[code]
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"testing"
+)
+
+func TestKeyAllowlistChecksCodesFirst(t *testing.T) {
+	allowlist, err := ParseKeyAllowlist([]string{"KEY_UP", "KEY_PROG1", "KEY_POWER"}, NewKeymap(Scancodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := []uint16{evdev.KEY_UP, evdev.KEY_PROG1, evdev.KEY_POWER, evdev.KEY_UNKNOWN}
+	for _, code := range allowed {
+		if !allowlist.AllowsCode(code) {
+			t.Errorf("%s not allowed", evdev.KEY[int(code)])
+		}
+	}
+	// Keys not on the list mustn't reach rules, mouse actions or hotkeys
+	for _, code := range []uint16{evdev.KEY_DOWN, evdev.KEY_LEFTCTRL, evdev.KEY_SLEEP} {
+		if allowlist.AllowsCode(code) {
+			t.Errorf("%s allowed", evdev.KEY[int(code)])
+		}
+	}
+	up := Scancodes[evdev.KEY_UP]
+	down := Scancodes[evdev.KEY_DOWN]
+	if !allowlist.Allows(up) || allowlist.Allows(down) {
+		t.Errorf("usages: KEY_UP allowed %v, KEY_DOWN allowed %v", allowlist.Allows(up), allowlist.Allows(down))
+	}
+	if !allowlist.AllowsSystem(evdev.KEY_POWER) || allowlist.AllowsSystem(evdev.KEY_SLEEP) {
+		t.Error("power keys not checked by code")
+	}
+}
+
+func TestEmptyKeyAllowlistAllowsAll(t *testing.T) {
+	allowlist, err := ParseKeyAllowlist(nil, NewKeymap(Scancodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowlist.AllowsCode(evdev.KEY_A) || !allowlist.Allows(4) || !allowlist.AllowsSystem(evdev.KEY_POWER) || !allowlist.AllowsConsumer(evdev.KEY_MUTE) {
+		t.Error("empty allowlist drops keys")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/loov/hrtime"
+	"io"
+	"testing"
+)
+
+func BenchmarkBuildKeyboardReport(b *testing.B) {
+	keysDown := []uint16{USAGE_LEFT_CONTROL, USAGE_LEFT_CONTROL + 1, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		BuildKeyboardReport(keysDown)
+	}
+}
+
+// More keys held than there are slots, with some of them in the bitmap
+func BenchmarkBuildKeyboardReportManyKeys(b *testing.B) {
+	layout, err := ParseKeyboardLayout(BOOT_KEY_SLOTS, []string{"KEY_F1", "KEY_F2", "KEY_F3", "KEY_F4"}, NewKeymap(Scancodes))
+	if err != nil {
+		b.Fatal(err)
+	}
+	keysDown := make([]uint16, 0)
+	for usage := uint16(0x04); usage < 0x04+16; usage++ {
+		keysDown = append(keysDown, usage)
+	}
+	keysDown = append(keysDown, layout.Bitmap...)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		layout.Build(keysDown)
+	}
+}
+
+func BenchmarkBuildMouseReport(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		BuildMouseReport(1, 100, -100, 1, -1)
+	}
+}
+
+// Many small movements from a fast mouse coalesced into reports by the shared
+// mouse state
+func BenchmarkMouseCoalescing(b *testing.B) {
+	mouse := NewMouseState()
+	output := make(chan InputMessage, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		mouse.Move(3, -2, 0)
+		if i%8 == 7 {
+			mouse.Lock()
+			for mouse.pending {
+				mouse.emit(output, DROP_OLDEST)
+			}
+			mouse.Unlock()
+			for len(output) > 0 {
+				<-output
+			}
+		}
+	}
+}
+
+// Counts the writes (each a syscall on a HID gadget device)
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes += 1
+	return len(p), nil
+}
+
+// Pushes b.N reports through the writer loop into the writer
+func benchmarkWriteReportsTo(b *testing.B, file io.Writer, report []byte, opts WriterOptions) {
+	input := make(chan InputMessage, 64)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			input <- InputMessage{Message: report, Timestamp: hrtime.Now()}
+		}
+		close(input)
+	}()
+	opts.LatencyEvery = int64(b.N) + 1
+	b.ReportAllocs()
+	err := WriteReports(file, "bench", input, NewLatencyStats(LATENCY_WINDOW), NewThroughputStats(LATENCY_WINDOW), opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// Pushes b.N reports through the writer loop into io.Discard
+func benchmarkWriteReports(b *testing.B, report []byte, opts WriterOptions) {
+	benchmarkWriteReportsTo(b, io.Discard, report, opts)
+}
+
+func BenchmarkWriteKeyboardReports(b *testing.B) {
+	benchmarkWriteReports(b, BuildKeyboardReport([]uint16{0x04}), WriterOptions{Type: "keyboard"})
+}
+
+func BenchmarkWriteMouseReports(b *testing.B) {
+	benchmarkWriteReports(b, BuildMouseReport(0, 1, 1, 0, 0), WriterOptions{Type: "mouse"})
+}
+
+// Writes per report with and without merging queued mouse reports, reported
+// as writes/op
+func benchmarkWriteMouseReportsMerge(b *testing.B, merge MergeFunc) {
+	file := &countingWriter{}
+	benchmarkWriteReportsTo(b, file, BuildMouseReport(0, 1, 1, 0, 0), WriterOptions{Type: "mouse", Merge: merge})
+	b.ReportMetric(float64(file.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriteMouseReportsUnmerged(b *testing.B) {
+	benchmarkWriteMouseReportsMerge(b, nil)
+}
+
+func BenchmarkWriteMouseReportsMerged(b *testing.B) {
+	benchmarkWriteMouseReportsMerge(b, MergeMouseReports)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	udev "github.com/jochenvg/go-udev"
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Control socket of the udev daemon. Without the daemon, nothing is sent to
+// the udev netlink monitor.
+const UDEV_CONTROL_SOCKET = "/run/udev/control"
+
+// Returns true if the udev daemon is running (eg. not in a minimal container)
+func UdevRunning() bool {
+	_, err := os.Stat(UDEV_CONTROL_SOCKET)
+	return err == nil
+}
+
+// A BlueZ device as last seen
+type BluetoothDevice struct {
+	Name      string
+	Address   string
+	Class     uint32
+	Icon      string
+	Connected bool
+}
+
+// Keeps track of the BlueZ devices to log connects and disconnects with the
+// device details and the input devices they created, since BlueZ and the
+// kernel otherwise only identify them by address and event node.
+type BluetoothTracker struct {
+	sync.Mutex
+	devices map[string]BluetoothDevice
+}
+
+func NewBluetoothTracker() *BluetoothTracker {
+	return &BluetoothTracker{
+		devices: make(map[string]BluetoothDevice, 0),
+	}
+}
+
+// Describes the major and minor device class, eg. "peripheral (keyboard)"
+func describeClass(class uint32) string {
+	major := (class >> 8) & 0x1f
+	minor := (class >> 2) & 0x3f
+	switch major {
+	case 0x05:
+		switch minor >> 4 {
+		case 0x01:
+			return "peripheral (keyboard)"
+		case 0x02:
+			return "peripheral (pointing device)"
+		case 0x03:
+			return "peripheral (keyboard and pointing device)"
+		}
+		return "peripheral"
+	case 0x01:
+		return "computer"
+	case 0x02:
+		return "phone"
+	case 0x04:
+		return "audio/video"
+	}
+	return fmt.Sprintf("major class 0x%02x", major)
+}
+
+// Event nodes of the input devices created for the Bluetooth address,
+// matched by the device's uniq (which the kernel sets to the address)
+func inputDevicesFor(address string) []string {
+	nodes := make([]string, 0)
+	events, _ := filepath.Glob("/sys/class/input/event*")
+	for _, event := range events {
+		devnode := "/dev/input/" + filepath.Base(event)
+		if strings.EqualFold(DeviceUniq(devnode), address) {
+			nodes = append(nodes, devnode)
+		}
+	}
+	return nodes
+}
+
+// Reads the devices from the adapter and logs the ones that have connected
+// or disconnected since the last update
+func (t *BluetoothTracker) Update(adapterId string) error {
+	a, err := adapter.GetAdapter(adapterId)
+	if err != nil {
+		return err
+	}
+	devices, err := a.GetDevices()
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, dev := range devices {
+		address, err := dev.GetAddress()
+		if err != nil {
+			continue
+		}
+		current := BluetoothDevice{Address: address, Name: "?"}
+		if name, err := dev.GetName(); err == nil {
+			current.Name = name
+		}
+		current.Class, _ = dev.GetClass()
+		current.Icon, _ = dev.GetIcon()
+		current.Connected, _ = dev.GetConnected()
+
+		previous, known := t.devices[address]
+		t.devices[address] = current
+		if known && previous.Connected == current.Connected {
+			continue
+		}
+		if current.Connected {
+			log.Infof("Bluetooth device connected: %s (%s), class 0x%06x %s, icon %s, input devices: %v", current.Name, address, current.Class, describeClass(current.Class), current.Icon, inputDevicesFor(address))
+		} else if known {
+			log.Infof("Bluetooth device disconnected: %s (%s)", current.Name, address)
+		}
+	}
+	return nil
+}
+
+// Name of the Bluetooth device with the given address, if known
+func (t *BluetoothTracker) Describe(address string) (string, bool) {
+	t.Lock()
+	defer t.Unlock()
+	for _, dev := range t.devices {
+		if strings.EqualFold(dev.Address, address) {
+			return fmt.Sprintf("%s (%s, %s)", dev.Name, dev.Address, describeClass(dev.Class)), true
+		}
+	}
+	return "", false
+}
+
+// Returns the Bluetooth address of the device behind an event node from a
+// udev input event. Classic HID devices sit under the adapter in sysfs but
+// Bluetooth LE ones are created through uhid, so the bus type of the parent
+// input device is checked rather than the path, and the address is its uniq.
+func BluetoothInputAddress(d *udev.Device) (string, bool) {
+	if !strings.HasPrefix(d.Devnode(), "/dev/input/event") {
+		return "", false
+	}
+	parent := d.Parent()
+	if parent == nil {
+		return "", false
+	}
+	// PRODUCT is bus/vendor/product/version in hex
+	bus, err := strconv.ParseUint(strings.Split(parent.PropertyValue("PRODUCT"), "/")[0], 16, 16)
+	if err != nil || bus != BUS_BLUETOOTH {
+		return "", false
+	}
+	address := strings.TrimSpace(parent.SysattrValue("uniq"))
+	return address, address != ""
+}
+
+// Logs a single line tying the Bluetooth device to the event node it just
+// created, refreshing the devices from the adapter first so that the name of
+// a newly paired device is known
+func (t *BluetoothTracker) LogInputConnected(adapterId string, address string, devnode string) {
+	if err := t.Update(adapterId); err != nil {
+		log.Debugf("Failed to read Bluetooth devices: %s", err.Error())
+	}
+	name := "?"
+	t.Lock()
+	for _, dev := range t.devices {
+		if strings.EqualFold(dev.Address, address) {
+			name = dev.Name
+		}
+	}
+	t.Unlock()
+	log.Infof("Bluetooth input connected: %s name=%q node=%s", strings.ToUpper(address), name, devnode)
+}
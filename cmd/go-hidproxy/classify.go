@@ -0,0 +1,67 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+)
+
+type DeviceType string
+
+const (
+	DEVICE_KEYBOARD DeviceType = "keyboard"
+	DEVICE_MOUSE    DeviceType = "mouse"
+	DEVICE_TOUCHPAD DeviceType = "touchpad"
+	DEVICE_TABLET   DeviceType = "tablet" // or another absolute pointing device
+	DEVICE_GAMEPAD  DeviceType = "gamepad"
+	DEVICE_IGNORED  DeviceType = "ignored"
+)
+
+// Supported event codes of a device by event type
+type deviceCapabilities map[int]map[int]bool
+
+func capabilitiesOf(dev *evdev.InputDevice) deviceCapabilities {
+	caps := make(deviceCapabilities, len(dev.Capabilities))
+	for evType, codes := range dev.Capabilities {
+		caps[evType.Type] = make(map[int]bool, len(codes))
+		for _, code := range codes {
+			caps[evType.Type][code.Code] = true
+		}
+	}
+	return caps
+}
+
+func (c deviceCapabilities) has(evType int, codes ...int) bool {
+	for _, code := range codes {
+		if c[evType][code] {
+			return true
+		}
+	}
+	return false
+}
+
+// Classifies a device by its capabilities. Checks go from the most specific
+// to the least specific, since eg. gamepads and tablets also report keys and
+// some touchpads also report relative movement.
+func ClassifyDevice(dev *evdev.InputDevice) DeviceType {
+	if dev.Name == UINPUT_DEVICE_NAME {
+		return DEVICE_IGNORED // our own loopback output
+	}
+	caps := capabilitiesOf(dev)
+	hasAbs := caps.has(evdev.EV_ABS, evdev.ABS_X)
+	switch {
+	case caps.has(evdev.EV_KEY, evdev.BTN_GAMEPAD, evdev.BTN_JOYSTICK):
+		return DEVICE_GAMEPAD
+	case hasAbs && caps.has(evdev.EV_KEY, evdev.BTN_TOOL_PEN, evdev.BTN_STYLUS):
+		return DEVICE_TABLET
+	case hasAbs && caps.has(evdev.EV_KEY, evdev.BTN_TOOL_FINGER) || caps.has(evdev.EV_ABS, evdev.ABS_MT_SLOT, evdev.ABS_MT_POSITION_X):
+		return DEVICE_TOUCHPAD
+	case caps.has(evdev.EV_REL, evdev.REL_X, evdev.REL_Y, evdev.REL_WHEEL, evdev.REL_DIAL):
+		return DEVICE_MOUSE
+	case !hasAbs && caps.has(evdev.EV_ABS, evdev.ABS_WHEEL):
+		return DEVICE_MOUSE // scrolls on an absolute axis
+	case hasAbs:
+		return DEVICE_TABLET
+	case len(caps[evdev.EV_KEY]) > 0:
+		return DEVICE_KEYBOARD
+	}
+	return DEVICE_IGNORED
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"testing"
+)
+
+// Makes a device with the given event types and codes
+func deviceWithCapabilities(name string, caps map[int][]int) *evdev.InputDevice {
+	dev := &evdev.InputDevice{
+		Name:         name,
+		Capabilities: make(map[evdev.CapabilityType][]evdev.CapabilityCode, len(caps)),
+	}
+	for evType, codes := range caps {
+		capType := evdev.CapabilityType{Type: evType}
+		for _, code := range codes {
+			dev.Capabilities[capType] = append(dev.Capabilities[capType], evdev.CapabilityCode{Code: code})
+		}
+	}
+	return dev
+}
+
+func TestClassifyDevice(t *testing.T) {
+	tests := []struct {
+		name string
+		caps map[int][]int
+		want DeviceType
+	}{
+		{"gamepad", map[int][]int{
+			evdev.EV_KEY: {evdev.BTN_GAMEPAD, evdev.BTN_EAST},
+			evdev.EV_ABS: {evdev.ABS_X, evdev.ABS_Y},
+		}, DEVICE_GAMEPAD},
+		{"tablet", map[int][]int{
+			evdev.EV_KEY: {evdev.BTN_TOOL_PEN, evdev.BTN_TOUCH},
+			evdev.EV_ABS: {evdev.ABS_X, evdev.ABS_Y, evdev.ABS_PRESSURE},
+		}, DEVICE_TABLET},
+		{"touchpad", map[int][]int{
+			evdev.EV_KEY: {evdev.BTN_LEFT, evdev.BTN_TOOL_FINGER, evdev.BTN_TOUCH},
+			evdev.EV_ABS: {evdev.ABS_X, evdev.ABS_Y, evdev.ABS_MT_SLOT, evdev.ABS_MT_POSITION_X},
+		}, DEVICE_TOUCHPAD},
+		{"mouse", map[int][]int{
+			evdev.EV_KEY: {evdev.BTN_LEFT, evdev.BTN_RIGHT},
+			evdev.EV_REL: {evdev.REL_X, evdev.REL_Y, evdev.REL_WHEEL},
+		}, DEVICE_MOUSE},
+		{"ABS_WHEEL only", map[int][]int{
+			evdev.EV_KEY: {evdev.BTN_LEFT},
+			evdev.EV_ABS: {evdev.ABS_WHEEL},
+		}, DEVICE_MOUSE},
+		{"absolute pointer", map[int][]int{
+			evdev.EV_KEY: {evdev.BTN_LEFT},
+			evdev.EV_ABS: {evdev.ABS_X, evdev.ABS_Y},
+		}, DEVICE_TABLET},
+		{"keyboard", map[int][]int{
+			evdev.EV_KEY: {evdev.KEY_A, evdev.KEY_B, evdev.KEY_LEFTCTRL},
+			evdev.EV_LED: {evdev.LED_CAPSL},
+		}, DEVICE_KEYBOARD},
+		{"lid switch", map[int][]int{
+			evdev.EV_SW: {evdev.SW_LID},
+		}, DEVICE_IGNORED},
+	}
+	for _, test := range tests {
+		if got := ClassifyDevice(deviceWithCapabilities(test.name, test.caps)); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClassifyDeviceIgnoresLoopback(t *testing.T) {
+	dev := deviceWithCapabilities(UINPUT_DEVICE_NAME, map[int][]int{
+		evdev.EV_KEY: {evdev.KEY_A, evdev.BTN_LEFT},
+		evdev.EV_REL: {evdev.REL_X, evdev.REL_Y},
+	})
+	if got := ClassifyDevice(dev); got != DEVICE_IGNORED {
+		t.Errorf("got %s for our own uinput device, want %s", got, DEVICE_IGNORED)
+	}
+}
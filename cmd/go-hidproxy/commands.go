@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A subcommand with its own flags. Commands are given as the first argument,
+// without one the proxy is run as before.
+type Command struct {
+	Name  string
+	Usage string
+	Flags func(c *Config, flags *flag.FlagSet) (*string, *string)
+	Run   func(config Config, dumpConfig string, args []string) error
+}
+
+var Commands = []Command{
+	{
+		Name:  "run",
+		Usage: "proxy input devices to the USB host (default)",
+		Flags: (*Config).RegisterFlags,
+		Run: func(config Config, dumpConfig string, args []string) error {
+			RunProxy(config, dumpConfig)
+			return nil
+		},
+	},
+	{
+		Name:  "setup-gadget",
+		Usage: "create the USB HID gadget and bind it to the USB device controller",
+		Flags: (*Config).RegisterGadgetCommandFlags,
+		Run:   setupGadget,
+	},
+	{
+		Name:  "teardown-gadget",
+		Usage: "unbind and remove the USB HID gadget",
+		Flags: (*Config).RegisterGadgetCommandFlags,
+		Run: func(config Config, dumpConfig string, args []string) error {
+			return TeardownUSBGadget(CONFIGFS_GADGET_PATH, config.Gadget)
+		},
+	},
+	{
+		Name:  "list-devices",
+		Usage: "list input devices and how the proxy would handle them",
+		Flags: (*Config).RegisterFlags,
+		Run:   listDevices,
+	},
+	{
+		Name:  "selftest",
+		Usage: "check that everything the proxy needs is in place",
+		Flags: (*Config).RegisterFlags,
+		Run:   selftest,
+	},
+	{
+		Name:  "show-report",
+		Usage: "print the keyboard report sent for keys, eg. show-report shift+KEY_A",
+		Flags: (*Config).RegisterFlags,
+		Run:   showReport,
+	},
+}
+
+func findCommand(name string) (Command, bool) {
+	for _, command := range Commands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+	return Command{}, false
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, command := range Commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", command.Name, command.Usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -help for the flags of a command.\n", os.Args[0])
+}
+
+func main() {
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	command, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	config, dumpConfig, args := LoadConfig(os.Args[0]+" "+name, args, command.Flags)
+
+	logLevel, err := log.ParseLevel(config.LogLevel)
+	if err != nil {
+		panic(err)
+	}
+	if name == "run" {
+		fmt.Printf("Set log level: %v\n", logLevel)
+	}
+	log.SetLevel(logLevel)
+	if err := SetupLogging(config.LogFile, config.LogSyslog); err != nil {
+		log.Fatalf("Failed to set up logging: %s", err.Error())
+	}
+	if dumpConfig != "" && name != "run" {
+		keymap, err := BuildKeymap(config)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %s", err.Error())
+		}
+		if err := config.Dump(dumpConfig, keymap); err != nil {
+			log.Fatalf("Failed to dump configuration to %s: %s", dumpConfig, err.Error())
+		}
+	}
+	if err := command.Run(config, dumpConfig, args); err != nil {
+		log.Fatalf("%s failed: %s", name, err.Error())
+	}
+}
+
+// Builds the keymap and sets up the keyboard and mouse report layouts with
+// it; the keyboard needs the keymap for the bitmap key names
+func setupReportLayouts(config Config) (*Keymap, error) {
+	keymap, err := BuildKeymap(config)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := ParseKeyboardLayout(config.Gadget.KeySlots, config.Gadget.KeyBitmap, keymap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyboard report configuration: %s", err.Error())
+	}
+	Keyboard = layout
+	mouse, err := ParseMouseLayout(config.Gadget.MouseFormat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mouse report configuration: %s", err.Error())
+	}
+	Mouse = mouse
+	return keymap, nil
+}
+
+func setupGadget(config Config, dumpConfig string, args []string) error {
+	if _, err := setupReportLayouts(config); err != nil {
+		return err
+	}
+	if err := config.Gadget.ValidateIds(); err != nil {
+		return fmt.Errorf("invalid gadget configuration: %s", err.Error())
+	}
+	if err := CheckModules(config.Modprobe); err != nil {
+		log.Errorf("Gadget setup is likely to fail: %s", err.Error())
+	}
+	SetupUSBGadget(CONFIGFS_GADGET_PATH, config.Gadget, time.Duration(config.WaitForUdc)*time.Second, true)
+	return nil
+}
+
+func listDevices(config Config, dumpConfig string, args []string) error {
+	devices, err := evdev.ListInputDevices()
+	if err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		deviceType := ClassifyDevice(dev)
+		notes := make([]string, 0)
+		if !config.SelectsDevice(dev.Fn) {
+			notes = append(notes, "not given with -device")
+		}
+		if config.IgnoresDevice(dev.Fn) {
+			notes = append(notes, "ignored")
+		}
+		if console, ok := ConsoleKeyboard(dev); ok && deviceType == DEVICE_KEYBOARD {
+			if config.ProtectConsole {
+				notes = append(notes, "keyboard of the local console "+console+", not grabbed with -protect-console")
+			}
+		}
+		if holders := DeviceHolders(dev.Fn); len(holders) > 0 {
+			notes = append(notes, "held by "+describeHolders(dev.Fn))
+		}
+		fmt.Printf("%-20s %-9s %s %s\n", dev.Fn, deviceType, DeviceIdentity(dev), dev.Name)
+		if byId := DeviceById(dev.Fn); byId != "" {
+			fmt.Printf("%-20s by-id: %s\n", "", byId)
+		}
+		if uniq := DeviceUniq(dev.Fn); uniq != "" {
+			fmt.Printf("%-20s uniq: %s\n", "", uniq)
+		}
+		if group := DeviceGroupKey(dev); group != "" {
+			if deviceType == DEVICE_KEYBOARD {
+				fmt.Printf("%-20s group: %s (%s)\n", "", group, ClassifyKeyboardRole(dev))
+			} else {
+				fmt.Printf("%-20s group: %s\n", "", group)
+			}
+		}
+		if len(notes) > 0 {
+			fmt.Printf("%-20s %s\n", "", strings.Join(notes, ", "))
+		}
+		dev.File.Close()
+	}
+	return nil
+}
+
+type hidFunction struct {
+	function     string
+	reportLength int
+	fallback     string
+}
+
+// Checks the environment the proxy runs in, printing the result of each
+// check. Returns an error if any of them failed.
+func selftest(config Config, dumpConfig string, args []string) error {
+	failed := 0
+	check := func(what string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL  %s: %s\n", what, err.Error())
+			failed += 1
+		} else {
+			fmt.Printf("ok    %s\n", what)
+		}
+	}
+
+	check("configuration", func() error {
+		keymap, err := setupReportLayouts(config)
+		if err != nil {
+			return err
+		}
+		if _, err := ParseHotkeys(config.Hotkeys, keymap); err != nil {
+			return err
+		}
+		if _, err := ParseMouseActions(config.MouseActions, keymap); err != nil {
+			return err
+		}
+		if _, err := ParseDialAction(config.DialAction, keymap); err != nil {
+			return err
+		}
+		if _, err := ParseRules(config.Rules); err != nil {
+			return err
+		}
+		if _, err := ParseKeyAllowlist(config.AllowKeys, keymap); err != nil {
+			return err
+		}
+		if _, err := ParseRawScancodes(config.RawScancodes, keymap); err != nil {
+			return err
+		}
+		if _, _, err := ParseModifiers(config.ModifierPreset, config.ModifierRemap, config.ModifierBits, keymap); err != nil {
+			return err
+		}
+		if err := config.ValidateRepeat(); err != nil {
+			return err
+		}
+		if err := config.Gadget.ValidateIds(); err != nil {
+			return err
+		}
+		if !(config.MouseScale > 0) || math.IsInf(config.MouseScale, 0) || config.MouseScale > MOUSE_SCALE_MAX {
+			return fmt.Errorf("invalid mouse scale: %g", config.MouseScale)
+		}
+		if config.MouseKeysSpeed < 1 || config.MouseKeysMaxSpeed < config.MouseKeysSpeed || config.MouseKeysAccel < 0 {
+			return fmt.Errorf("invalid mouse keys speed: %d to %d, acceleration %g", config.MouseKeysSpeed, config.MouseKeysMaxSpeed, config.MouseKeysAccel)
+		}
+		if config.LatencyExport != "" && config.LatencyExportInterval <= 0 {
+			return fmt.Errorf("invalid latency export interval: %d", config.LatencyExportInterval)
+		}
+		return nil
+	}())
+
+	if config.Output == OUTPUT_UINPUT {
+		check("/dev/uinput is writable", func() error {
+			file, err := os.OpenFile("/dev/uinput", os.O_WRONLY, 0)
+			if err == nil {
+				file.Close()
+			}
+			return err
+		}())
+	} else {
+		check("kernel modules loaded", CheckModules(false))
+		check("configfs is mounted", func() error {
+			if !pathsExist(CONFIGFS_GADGET_PATH)() {
+				return fmt.Errorf("%s not found, is libcomposite loaded?", CONFIGFS_GADGET_PATH)
+			}
+			return nil
+		}())
+		check("HID function module loaded", CheckHidFunctionModule(CONFIGFS_GADGET_PATH+"/"+config.Gadget.Name))
+		check("USB device controller available", func() error {
+			if len(UDCs()) == 0 {
+				return fmt.Errorf("nothing in /sys/class/udc, is dwc2 loaded?")
+			}
+			_, err := SelectUDC(config.Gadget.UDC)
+			return err
+		}())
+		functions := []hidFunction{
+			{"hid.usb0", KeyboardReportLength(config.Gadget.KeyboardReportId), "/dev/hidg0"},
+			{"hid.usb1", MouseReportLength(), "/dev/hidg1"},
+		}
+		if config.Gadget.SystemControl {
+			functions = append(functions, hidFunction{"hid.usb2", SystemControlReportLength(), "/dev/hidg2"})
+		}
+		if config.Gadget.ConsumerControl {
+			functions = append(functions, hidFunction{"hid.usb3", ConsumerControlReportLength(), config.Gadget.ConsumerControlNode()})
+		}
+		check("host has enumerated the gadget", func() error {
+			udc := BoundUDC(CONFIGFS_GADGET_PATH, config.Gadget.Name)
+			if udc == "" && config.BindOnDemand {
+				return nil // only bound while devices are grabbed
+			}
+			if udc == "" {
+				return fmt.Errorf("gadget %s is not bound to a USB device controller", config.Gadget.Name)
+			}
+			state, err := UDCState(udc)
+			if err != nil {
+				return err
+			}
+			if state != UDC_STATE_CONFIGURED {
+				if description := DescribeUDCState(state); description != "" {
+					return fmt.Errorf("%s is %s: %s", udc, state, description)
+				}
+				return fmt.Errorf("%s is %s", udc, state)
+			}
+			return nil
+		}())
+		for _, f := range functions {
+			what := fmt.Sprintf("HID function %s is usable", f.function)
+			path, err := HidDeviceFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, f.function, f.reportLength, f.fallback)
+			if err != nil {
+				check(what, err)
+				continue
+			}
+			file, err := OpenHidOutput(path)
+			if err == nil {
+				err = file.Close()
+			}
+			// The running proxy holds the lock, which is fine
+			var inUse *HidInUseError
+			if errors.As(err, &inUse) {
+				if pid := inUse.ProxyPid(); pid != 0 {
+					fmt.Printf("ok    %s: %s in use by the running proxy (pid %d)\n", what, path, pid)
+					continue
+				}
+			}
+			check(what, err)
+		}
+	}
+
+	check("input devices found", func() error {
+		devices, err := evdev.ListInputDevices()
+		if err != nil {
+			return err
+		}
+		usable := 0
+		for _, dev := range devices {
+			switch ClassifyDevice(dev) {
+			case DEVICE_KEYBOARD, DEVICE_MOUSE:
+				usable += 1
+			}
+			dev.File.Close()
+		}
+		if usable == 0 {
+			return fmt.Errorf("no keyboards or mice in /dev/input (is evdev loaded and the device connected?)")
+		}
+		return nil
+	}())
+
+	if config.MonitorUdev {
+		check(fmt.Sprintf("BlueZ adapter %s", config.BluezAdapter), func() error {
+			_, err := adapter.GetAdapter(config.BluezAdapter)
+			return err
+		}())
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// Parses keys joined with +, eg. shift+KEY_A, into HID usages. Keys are given
+// by evdev name or key code (eg. 30 for KEY_A), modifiers also by name (ctrl,
+// shift, alt, meta, optionally prefixed with left- or right-).
+func ParseKeyCombination(combo string, keymap *Keymap) ([]uint16, error) {
+	usages := make([]uint16, 0)
+	for _, name := range strings.Split(combo, "+") {
+		name = strings.TrimSpace(name)
+		if usage, ok := ModifierUsage(name); ok {
+			usages = append(usages, usage)
+			continue
+		}
+		code, ok := KeyCode(name)
+		if !ok {
+			n, err := strconv.ParseUint(name, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("unknown key in %s: %s", combo, name)
+			}
+			code = uint16(n)
+		}
+		usage, ok := keymap.Lookup(code)
+		if !ok {
+			return nil, fmt.Errorf("key %s in %s has no HID usage", name, combo)
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// Prints the keyboard report, as hex bytes, that pressing each of the given
+// key combinations sends to the host with the configured report layout,
+// keymap and modifiers
+func showReport(config Config, dumpConfig string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no keys given, eg. %s show-report shift+KEY_A", os.Args[0])
+	}
+	return printReports(os.Stdout, config, args)
+}
+
+func printReports(out io.Writer, config Config, combos []string) error {
+	keymap, err := setupReportLayouts(config)
+	if err != nil {
+		return err
+	}
+	remap, modifiers, err := ParseModifiers(config.ModifierPreset, config.ModifierRemap, config.ModifierBits, keymap)
+	if err != nil {
+		return fmt.Errorf("invalid modifier configuration: %s", err.Error())
+	}
+	ModifierRemap, Modifiers = remap, modifiers
+	for _, combo := range combos {
+		keys, err := ParseKeyCombination(combo, keymap)
+		if err != nil {
+			return err
+		}
+		// Keys are remapped like pressed on a device, modifier names aren't
+		for i, name := range strings.Split(combo, "+") {
+			if _, named := ModifierUsage(strings.TrimSpace(name)); !named {
+				keys[i] = RemapModifiers(keys[i : i+1])[0]
+			}
+		}
+		report := BuildKeyboardReport(keys)
+		if config.Gadget.KeyboardReportId > 0 {
+			report = append([]byte{config.Gadget.KeyboardReportId}, report...)
+		}
+		fmt.Fprintf(out, "% x\n", report)
+	}
+	return nil
+}
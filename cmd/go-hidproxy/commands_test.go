@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseKeyCombination(t *testing.T) {
+	tests := []struct {
+		combo string
+		want  []uint16
+	}{
+		{"KEY_A", []uint16{0x04}},
+		{"shift+KEY_A", []uint16{225, 0x04}},
+		{"ctrl + alt + KEY_DELETE", []uint16{224, 226, 0x4c}},
+		{"Right-Alt+30", []uint16{230, 0x04}},
+		{"left-meta+right-shift+KEY_1", []uint16{227, 229, 0x1e}},
+		{"KEY_LEFTCTRL+0x1e", []uint16{224, 0x04}},
+	}
+	for _, test := range tests {
+		got, err := ParseKeyCombination(test.combo, NewKeymap(Scancodes))
+		if err != nil {
+			t.Errorf("%s: %s", test.combo, err.Error())
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.combo, got, test.want)
+		}
+	}
+	for _, combo := range []string{"hyper+KEY_A", "KEY_NOPE", "shift+", "BTN_LEFT", "middle-ctrl+KEY_A"} {
+		if _, err := ParseKeyCombination(combo, NewKeymap(Scancodes)); err == nil {
+			t.Errorf("%s: no error", combo)
+		}
+	}
+}
+
+func TestModifierUsageCoversModifierNames(t *testing.T) {
+	for name, bit := range modifierNames {
+		usage, ok := ModifierUsage(name)
+		if !ok || Modifiers[usage] != bit {
+			t.Errorf("%s: got usage %d (%v) with bit %#x, want bit %#x", name, usage, ok, Modifiers[usage], bit)
+		}
+	}
+}
+
+func TestShowReport(t *testing.T) {
+	config := DefaultConfig()
+	var out bytes.Buffer
+	if err := printReports(&out, config, []string{"shift+KEY_A", "ctrl+alt+KEY_DELETE"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "02 00 04 00 00 00 00 00\n05 00 4c 00 00 00 00 00\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	config.Gadget.KeyboardReportId = 1
+	out.Reset()
+	if err := printReports(&out, config, []string{"KEY_B"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "01 00 00 05 00 00 00 00 00\n"; out.String() != want {
+		t.Errorf("with report ID: got %q, want %q", out.String(), want)
+	}
+
+	if err := printReports(&out, config, []string{"shift+KEY_NOPE"}); err == nil {
+		t.Error("unknown key accepted")
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USB strings for one language
+type GadgetStrings struct {
+	Lang          string `json:"lang"`
+	SerialNumber  string `json:"serialNumber,omitempty"`
+	Manufacturer  string `json:"manufacturer,omitempty"`
+	Product       string `json:"product,omitempty"`
+	Configuration string `json:"configuration,omitempty"`
+}
+
+type GadgetConfig struct {
+	Name           string `json:"name"`
+	ConfigName     string `json:"configName"`
+	IdVendor       string `json:"idVendor"`
+	IdProduct      string `json:"idProduct"`
+	BcdDevice      string `json:"bcdDevice"`
+	BcdUSB         string `json:"bcdUSB"`
+	DeviceClass    string `json:"bDeviceClass"`
+	DeviceSubClass string `json:"bDeviceSubClass"`
+	DeviceProtocol string `json:"bDeviceProtocol"`
+	SerialNumber   string `json:"serialNumber"`
+	Manufacturer   string `json:"manufacturer"`
+	Product        string `json:"product"`
+	Configuration  string `json:"configuration"`
+	MaxPower       string `json:"maxPower"`
+	// USB device controller to bind to, needed if there are several
+	UDC              string `json:"udc"`
+	KeyboardReportId uint8  `json:"keyboardReportId"`
+	// Key slots in the keyboard report (6 for boot protocol compatibility)
+	KeySlots int `json:"keySlots"`
+	// Keys reported in a bitmap after the key slots, as evdev key names
+	KeyBitmap []string `json:"keyBitmap,omitempty"`
+	// Mouse report format, boot or 12bit
+	MouseFormat   string `json:"mouseFormat"`
+	SystemControl bool   `json:"systemControl"`
+	// Consumer Control device for the media keys of consumer control nodes
+	ConsumerControl bool `json:"consumerControl"`
+	// Strings in languages other than English (0x409)
+	Strings []GadgetStrings `json:"strings,omitempty"`
+}
+
+// Strings for all configured languages, English first. Strings missing from
+// a language fall back to the English ones.
+func (g GadgetConfig) Languages() []GadgetStrings {
+	english := GadgetStrings{
+		Lang:          "0x409",
+		SerialNumber:  g.SerialNumber,
+		Manufacturer:  g.Manufacturer,
+		Product:       g.Product,
+		Configuration: g.Configuration,
+	}
+	languages := []GadgetStrings{english}
+	for _, strs := range g.Strings {
+		if strs.SerialNumber == "" {
+			strs.SerialNumber = english.SerialNumber
+		}
+		if strs.Manufacturer == "" {
+			strs.Manufacturer = english.Manufacturer
+		}
+		if strs.Product == "" {
+			strs.Product = english.Product
+		}
+		if strs.Configuration == "" {
+			strs.Configuration = english.Configuration
+		}
+		languages = append(languages, strs)
+	}
+	return languages
+}
+
+// Parses a USB vendor or product ID, eg. 0x046d
+func ParseUSBId(s string) (uint16, error) {
+	id, err := strconv.ParseUint(s, 0, 64)
+	if err != nil || id > 0xffff {
+		return 0, fmt.Errorf("invalid USB ID: %s (expected 0x0000-0xffff)", s)
+	}
+	return uint16(id), nil
+}
+
+// Checks the vendor and product IDs, which may come from the configuration
+// file rather than the flags
+func (g GadgetConfig) ValidateIds() error {
+	if _, err := ParseUSBId(g.IdVendor); err != nil {
+		return fmt.Errorf("vendor ID: %s", err.Error())
+	}
+	if _, err := ParseUSBId(g.IdProduct); err != nil {
+		return fmt.Errorf("product ID: %s", err.Error())
+	}
+	return nil
+}
+
+// Flag for a USB vendor or product ID, stored as 4 hex digits like configfs
+// reports them
+type usbIdValue struct {
+	p *string
+}
+
+func (v usbIdValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v usbIdValue) Set(s string) error {
+	id, err := ParseUSBId(s)
+	if err != nil {
+		return err
+	}
+	*v.p = fmt.Sprintf("0x%04x", id)
+	return nil
+}
+
+// Repeatable flag adding strings for a language, eg.
+// -usb-string lang=0x407,manufacturer=Beispiel,product=Tastatur
+type gadgetStringsValue struct {
+	strings *[]GadgetStrings
+}
+
+func (v gadgetStringsValue) String() string {
+	return ""
+}
+
+func (v gadgetStringsValue) Set(s string) error {
+	strs := GadgetStrings{}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid USB string: %s (expected key=value)", field)
+		}
+		switch kv[0] {
+		case "lang":
+			if _, err := strconv.ParseUint(kv[1], 0, 16); err != nil {
+				return fmt.Errorf("invalid language ID: %s", kv[1])
+			}
+			strs.Lang = kv[1]
+		case "serialnumber":
+			strs.SerialNumber = kv[1]
+		case "manufacturer":
+			strs.Manufacturer = kv[1]
+		case "product":
+			strs.Product = kv[1]
+		case "configuration":
+			strs.Configuration = kv[1]
+		default:
+			return fmt.Errorf("unknown USB string: %s", kv[0])
+		}
+	}
+	if strs.Lang == "" {
+		return fmt.Errorf("missing lang in USB strings: %s", s)
+	}
+	*v.strings = append(*v.strings, strs)
+	return nil
+}
+
+// Keyboard repeat settings for a specific device
+type DeviceRepeat struct {
+	KbdRepeat int `json:"kbdrepeat"`
+	KbdDelay  int `json:"kbddelay"`
+}
+
+type Config struct {
+	LogLevel               string                  `json:"loglevel"`
+	LogFile                string                  `json:"logFile"`
+	LogSyslog              bool                    `json:"logSyslog"`
+	LogState               bool                    `json:"logState"`
+	LogUnhandled           int                     `json:"logUnhandled"`
+	LogRateLimit           int                     `json:"logRateLimit"`
+	SetupHid               bool                    `json:"setuphid"`
+	Output                 string                  `json:"output"`
+	Tee                    []string                `json:"tee"`
+	WaitForUdc             int                     `json:"waitForUdc"`
+	Modprobe               bool                    `json:"modprobe"`
+	Gadget                 GadgetConfig            `json:"gadget"`
+	Mouse                  bool                    `json:"mouse"`
+	Keyboard               bool                    `json:"keyboard"`
+	MonitorUdev            bool                    `json:"monitorUdev"`
+	DisconnectPollInterval int                     `json:"disconnectPollInterval"`
+	BluezAdapter           string                  `json:"bluezAdapter"`
+	KbdRepeat              int                     `json:"kbdrepeat"`
+	KbdDelay               int                     `json:"kbddelay"`
+	DeviceRepeat           map[string]DeviceRepeat `json:"deviceRepeat"`
+	DebounceMs             int                     `json:"debounceMs"`
+	ChordWindowMs          int                     `json:"chordWindowMs"`
+	KbdDropPolicy          DropPolicy              `json:"kbdDropPolicy"`
+	MouseDropPolicy        DropPolicy              `json:"mouseDropPolicy"`
+	SystemdNotify          bool                    `json:"systemdNotify"`
+	ReportRateHz           int                     `json:"reportRateHz"`
+	BatchWrites            bool                    `json:"batchWrites"`
+	KeepaliveInterval      int                     `json:"keepaliveInterval"`
+	JiggleInterval         int                     `json:"jiggleInterval"`
+	MouseQuantize          int                     `json:"mouseQuantize"`
+	MouseScale             float64                 `json:"mouseScale"`
+	ExitWhenIdle           int                     `json:"exitWhenIdle"`
+	BindOnDemand           bool                    `json:"bindOnDemand"`
+	IdleRate               int                     `json:"idleRate"`
+	MinReportGapMs         int                     `json:"minReportGapMs"`
+	GrabWait               bool                    `json:"grabWait"`
+	GrabRetries            int                     `json:"grabRetries"`
+	GrabBackoffMs          int                     `json:"grabBackoffMs"`
+	GrabTimeoutMs          int                     `json:"grabTimeoutMs"`
+	ProtectConsole         bool                    `json:"protectConsole"`
+	SilenceTimeout         int                     `json:"silenceTimeout"`
+	NaturalScroll          bool                    `json:"naturalScroll"`
+	InvertX                bool                    `json:"invertX"`
+	InvertY                bool                    `json:"invertY"`
+	SwapXY                 bool                    `json:"swapXY"`
+	ScrollAccel            float64                 `json:"scrollAccel"`
+	AbsRelative            bool                    `json:"absRelative"`
+	SmoothSteps            int                     `json:"mouseSmoothSteps"`
+	SmoothMs               int                     `json:"mouseSmoothMs"`
+	EmulateMiddle          bool                    `json:"emulateMiddleClick"`
+	ControlAddr            string                  `json:"controlAddr"`
+	ControlToken           string                  `json:"controlToken"`
+	MetricsAddr            string                  `json:"metricsAddr"`
+	ControlFifo            string                  `json:"controlFifo"`
+	LatencyExport          string                  `json:"latencyExport"`
+	LatencyExportInterval  int                     `json:"latencyExportInterval"`
+	TypeFile               string                  `json:"typeFile"`
+	TypeDelayMs            int                     `json:"typeDelayMs"`
+	TypeFileExit           bool                    `json:"typeFileExit"`
+	Hotkeys                map[string]string       `json:"hotkeys"`
+	MouseActions           map[string]string       `json:"mouseActions"`
+	MouseKeysSpeed         int                     `json:"mouseKeysSpeed"`
+	MouseKeysAccel         float64                 `json:"mouseKeysAccel"`
+	MouseKeysMaxSpeed      int                     `json:"mouseKeysMaxSpeed"`
+	DialAction             string                  `json:"dialAction"`
+	AllowKeys              []string                `json:"allowKeys,omitempty"`
+	LogDroppedKeys         bool                    `json:"logDroppedKeys"`
+	Rules                  []RuleConfig            `json:"rules"`
+	ModifierPreset         string                  `json:"modifierPreset"`
+	ModifierRemap          map[string]string       `json:"modifierRemap"`
+	ModifierBits           map[string]int          `json:"modifierBits"`
+	RawScancodes           map[string]string       `json:"rawScancodes"`
+	Hwdb                   string                  `json:"hwdb"`
+	Keymap                 string                  `json:"keymap"`
+	PhysicalLayout         string                  `json:"physicalLayout"`
+	Devices                []string                `json:"devices"`
+	IgnoreDevices          []string                `json:"ignoreDevices"`
+	MaxDevices             int                     `json:"maxDevices"`
+	DeviceLimitPolicy      string                  `json:"deviceLimitPolicy"`
+}
+
+// Settings derived from the configuration, included in the configuration dump
+// so that bug reports are self-describing
+type EffectiveConfig struct {
+	*Config
+	Scancodes                int `json:"scancodes"`
+	KeyboardReportLength     int `json:"keyboardReportLength"`
+	MouseReportLength        int `json:"mouseReportLength"`
+	KeyboardDescriptorLength int `json:"keyboardDescriptorLength"`
+	MouseDescriptorLength    int `json:"mouseDescriptorLength"`
+}
+
+// Repeatable flag collecting its values
+type stringsValue struct {
+	values *[]string
+}
+
+func (v stringsValue) String() string {
+	if v.values == nil {
+		return ""
+	}
+	return strings.Join(*v.values, ",")
+}
+
+func (v stringsValue) Set(s string) error {
+	*v.values = append(*v.values, s)
+	return nil
+}
+
+type uint8Value struct {
+	p *uint8
+}
+
+func (v uint8Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*v.p))
+}
+
+func (v uint8Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return err
+	}
+	*v.p = uint8(n)
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		LogLevel:               "warn",
+		SetupHid:               true,
+		Output:                 OUTPUT_GADGET,
+		WaitForUdc:             1,
+		PhysicalLayout:         "us",
+		DisconnectPollInterval: 5,
+		TypeDelayMs:            10,
+		DialAction:             DIAL_WHEEL,
+		GrabRetries:            5,
+		GrabBackoffMs:          200,
+		Gadget: GadgetConfig{
+			Name:           "g1",
+			ConfigName:     "c.1",
+			IdVendor:       "0x1d6b", // Linux Foundation
+			IdProduct:      "0x0104", // Multifunction Composite Gadget
+			BcdDevice:      "0x0100",
+			BcdUSB:         "0x0200",
+			DeviceClass:    "0xEF",
+			DeviceSubClass: "0x02",
+			DeviceProtocol: "0x01",
+			SerialNumber:   "00100",
+			Manufacturer:   "Linux Foundation",
+			Product:        "Multifunction Composite Gadget",
+			Configuration:  "Config 1: USB Gadget",
+			MaxPower:       "250",
+			KeySlots:       BOOT_KEY_SLOTS,
+			MouseFormat:    MOUSE_FORMAT_BOOT,
+		},
+		Mouse:                 true,
+		Keyboard:              true,
+		MonitorUdev:           true,
+		BluezAdapter:          "hci0",
+		KbdRepeat:             62,
+		KbdDelay:              300,
+		KbdDropPolicy:         DROP_OLDEST,
+		MouseDropPolicy:       DROP_OLDEST,
+		SmoothMs:              20,
+		MouseScale:            1,
+		GrabTimeoutMs:         5000,
+		MouseKeysSpeed:        2,
+		MouseKeysAccel:        0.5,
+		MouseKeysMaxSpeed:     20,
+		LatencyExportInterval: 60,
+		DeviceLimitPolicy:     DEVICE_LIMIT_REJECT,
+	}
+}
+
+// Registers -config and -dump-config, whose values are returned, and the
+// logging flags, which all commands have
+func (c *Config) RegisterCommonFlags(flags *flag.FlagSet) (*string, *string) {
+	configFile := flags.String("config", "", "JSON configuration file (flags given on the command line take precedence)")
+	dumpConfig := flags.String("dump-config", "", "write the effective configuration as JSON to this file (- for stdout)")
+	flags.StringVar(&c.LogLevel, "loglevel", c.LogLevel, "log level (panic, fatal, error, warn, info, debug, trace)")
+	flags.StringVar(&c.LogFile, "log-file", c.LogFile, "write logs to this file instead of stderr (reopened on SIGHUP)")
+	flags.BoolVar(&c.LogSyslog, "log-syslog", c.LogSyslog, "send logs to the local syslog")
+	return configFile, dumpConfig
+}
+
+// Registers the flags for setting up the USB gadget
+func (c *Config) RegisterGadgetFlags(flags *flag.FlagSet) {
+	flags.IntVar(&c.WaitForUdc, "wait-for-udc", c.WaitForUdc, "wait up to this many seconds for configfs, a USB device controller and the HID gadget devices during setup")
+	flags.BoolVar(&c.Modprobe, "modprobe", c.Modprobe, "load the kernel modules the gadget needs (libcomposite, dwc2) with modprobe if they aren't loaded")
+	flags.StringVar(&c.Gadget.Name, "gadget-name", c.Gadget.Name, "name of the USB gadget directory in configfs")
+	flags.StringVar(&c.Gadget.UDC, "udc", c.Gadget.UDC, "USB device controller to bind the gadget to, from /sys/class/udc (only needed if there are several)")
+	flags.StringVar(&c.Gadget.ConfigName, "gadget-config", c.Gadget.ConfigName, "name of the USB gadget configuration in configfs")
+	flags.Var(usbIdValue{&c.Gadget.IdVendor}, "usb-vendor", "USB vendor ID the gadget presents to the host, eg. 0x046d")
+	flags.Var(usbIdValue{&c.Gadget.IdProduct}, "usb-product", "USB product ID the gadget presents to the host, eg. 0xc52b")
+	flags.StringVar(&c.Gadget.Manufacturer, "usb-manufacturer", c.Gadget.Manufacturer, "USB manufacturer string")
+	flags.StringVar(&c.Gadget.Product, "usb-product-name", c.Gadget.Product, "USB product string")
+	flags.StringVar(&c.Gadget.SerialNumber, "usb-serial", c.Gadget.SerialNumber, "USB serial number string")
+	flags.Var(gadgetStringsValue{&c.Gadget.Strings}, "usb-string", "USB strings for another language, eg. lang=0x407,manufacturer=...,product=... (repeatable)")
+	flags.BoolVar(&c.Gadget.SystemControl, "system-control", c.Gadget.SystemControl, "add a System Control device (/dev/hidg2) for the power, sleep and wake up keys")
+	flags.BoolVar(&c.Gadget.ConsumerControl, "consumer-control", c.Gadget.ConsumerControl, "add a Consumer Control device for the media keys of keyboards with a separate consumer control node")
+	flags.Var(uint8Value{&c.Gadget.KeyboardReportId}, "kbd-report-id", "prefix keyboard reports with this report ID (1-255, 0 to disable)")
+	flags.IntVar(&c.Gadget.KeySlots, "key-slots", c.Gadget.KeySlots, "number of keys in the keyboard report (6 is boot protocol compatible)")
+	flags.StringVar(&c.Gadget.MouseFormat, "mouse-format", c.Gadget.MouseFormat, "mouse report format: boot (8-bit X and Y, boot protocol compatible) or 12bit (12-bit X and Y, for faster movement in one report)")
+}
+
+// Registers flags for all settings, plus -config and -dump-config whose
+// values are returned
+func (c *Config) RegisterFlags(flags *flag.FlagSet) (*string, *string) {
+	configFile, dumpConfig := c.RegisterCommonFlags(flags)
+	c.RegisterGadgetFlags(flags)
+	flags.Var(stringsValue{&c.Devices}, "device", "only handle this device, given as a device node or a /dev/input/by-id link, instead of scanning /dev/input for devices (repeatable)")
+	flags.Var(stringsValue{&c.IgnoreDevices}, "ignore-device", "don't grab this device, given as a device node or a /dev/input/by-id link (repeatable)")
+	flags.IntVar(&c.MaxDevices, "max-devices", c.MaxDevices, "grab at most this many input devices (0 for no limit)")
+	flags.StringVar(&c.DeviceLimitPolicy, "device-limit-policy", c.DeviceLimitPolicy, "what to do with new devices over -max-devices: reject-new (leave them alone) or evict-oldest-idle (release the device idle the longest)")
+	flags.BoolVar(&c.LogState, "log-state", c.LogState, "log the keys and buttons held on each device whenever they change")
+	flags.IntVar(&c.LogRateLimit, "log-rate-limit", c.LogRateLimit, "log each per-event or per-report message at most this many times per second, summarizing the rest (0 for no limit)")
+	flags.IntVar(&c.LogUnhandled, "log-unhandled", c.LogUnhandled, "log counts of events ignored by the handlers (eg. EV_MSC, EV_SW) every this many seconds (0 disables)")
+	flags.StringVar(&c.Output, "output", c.Output, "where reports go: gadget (USB HID gadget) or uinput (replayed on a local virtual input device, for testing)")
+	flags.Var(stringsValue{&c.Tee}, "tee", "also copy every report written to the host to this file, or tcp://host:port or udp://host:port, as JSON lines (repeatable)")
+	flags.BoolVar(&c.SetupHid, "setuphid", c.SetupHid, "setup HID files on startup (if disabled and there are no HID gadget devices, input is captured but not forwarded)")
+	flags.BoolVar(&c.Mouse, "mouse", c.Mouse, "setup mouse(s)")
+	flags.BoolVar(&c.Keyboard, "keyboard", c.Keyboard, "setup keyboard(s)")
+	flags.BoolVar(&c.MonitorUdev, "monitor-udev", c.MonitorUdev, "monitor udev & BlueZ events for disconnects")
+	flags.IntVar(&c.DisconnectPollInterval, "disconnect-poll-interval", c.DisconnectPollInterval, "if udev isn't running, check for disconnected Bluetooth devices every this many seconds instead (0 disables)")
+	flags.StringVar(&c.BluezAdapter, "bluez-adapter", c.BluezAdapter, "BlueZ adapter")
+	flags.IntVar(&c.KbdRepeat, "kbdrepeat", c.KbdRepeat, "set keyboard repeat rate")
+	flags.IntVar(&c.KbdDelay, "kbddelay", c.KbdDelay, "set keyboard repeat delay in ms")
+	flags.IntVar(&c.ChordWindowMs, "chord-window-ms", c.ChordWindowMs, "collect key changes within this many ms of the first one into a single keyboard report, so hosts don't see partial chords (0 to disable, at most 50)")
+	flags.IntVar(&c.DebounceMs, "debounce-ms", c.DebounceMs, "ignore key/button presses within this many ms of their previous release (0 to disable)")
+	flags.Var(&c.KbdDropPolicy, "kbd-drop-policy", "report to drop when the keyboard queue is full (oldest, newest)")
+	flags.Var(&c.MouseDropPolicy, "mouse-drop-policy", "report to drop when the mouse queue is full (oldest, newest)")
+	flags.StringVar(&c.ModifierPreset, "modifier-preset", c.ModifierPreset, "remap modifiers with presets, comma separated (swap-ctrl-meta, caps-ctrl)")
+	flags.BoolVar(&c.SystemdNotify, "systemd-notify", c.SystemdNotify, "notify systemd when ready and ping the watchdog (for Type=notify units)")
+	flags.BoolVar(&c.GrabWait, "grab-wait", c.GrabWait, "wait for devices grabbed by another process to become available instead of skipping them")
+	flags.IntVar(&c.GrabRetries, "grab-retries", c.GrabRetries, "retry grabbing a device this many times if it fails because the device isn't ready yet (eg. at boot)")
+	flags.IntVar(&c.GrabBackoffMs, "grab-backoff-ms", c.GrabBackoffMs, "wait this many ms before the first grab retry, doubling the wait for each further retry")
+	flags.IntVar(&c.GrabTimeoutMs, "grab-timeout-ms", c.GrabTimeoutMs, "give up on grabbing a device if the grab hasn't returned after this many ms, and try again once it has returned and a backoff has passed (0 to wait forever)")
+	flags.BoolVar(&c.ProtectConsole, "protect-console", c.ProtectConsole, "don't grab keyboards attached to this machine (eg. over USB) while a local console is active, so you can't lock yourself out of it")
+	flags.IntVar(&c.SilenceTimeout, "silence-timeout", c.SilenceTimeout, "check devices silent for this many seconds and re-grab them if they stopped working (0 to disable)")
+	flags.BoolVar(&c.InvertX, "invert-x", c.InvertX, "invert the mouse X axis (applied after -swap-xy)")
+	flags.BoolVar(&c.InvertY, "invert-y", c.InvertY, "invert the mouse Y axis (applied after -swap-xy)")
+	flags.BoolVar(&c.SwapXY, "swap-xy", c.SwapXY, "swap the mouse X and Y axes")
+	flags.BoolVar(&c.NaturalScroll, "natural-scroll", c.NaturalScroll, "invert the scroll wheel direction")
+	flags.Float64Var(&c.ScrollAccel, "scroll-accel", c.ScrollAccel, "increase wheel movement by this much per event when scrolling fast (0 for linear scrolling)")
+	flags.BoolVar(&c.EmulateMiddle, "emulate-middle-click", c.EmulateMiddle, "press left and right mouse buttons together for a middle click")
+	flags.IntVar(&c.SmoothSteps, "mouse-smooth-steps", c.SmoothSteps, "spread mouse movement over this many reports for smoother motion (0 to disable)")
+	flags.IntVar(&c.SmoothMs, "mouse-smooth-ms", c.SmoothMs, "time in ms to spread smoothed mouse movement over")
+	flags.BoolVar(&c.AbsRelative, "abs-relative", c.AbsRelative, "proxy absolute pointing devices (touchpads, tablets, air mice) as relative mice")
+	flags.StringVar(&c.ControlAddr, "control-addr", c.ControlAddr, "listen address for the HTTP control API, eg. localhost:8080 (disabled if empty)")
+	flags.StringVar(&c.ControlToken, "control-token", c.ControlToken, "bearer token the control API requires on POST requests, instead of a JSON content type (better set in the configuration file, where other users can't see it)")
+	flags.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "listen address for Prometheus metrics on /metrics, eg. :9110 (disabled if empty)")
+	flags.StringVar(&c.ControlFifo, "control-fifo", c.ControlFifo, "FIFO to read pause, resume and release-all commands from (created if missing, disabled if empty)")
+	flags.StringVar(&c.LatencyExport, "latency-export", c.LatencyExport, "periodically write the report latency histograms to this file, as JSON or CSV if the name ends with .csv (disabled if empty)")
+	flags.IntVar(&c.LatencyExportInterval, "latency-export-interval", c.LatencyExportInterval, "write the -latency-export file every this many seconds, and on exit")
+	flags.StringVar(&c.TypeFile, "type-file", c.TypeFile, "type this text file into the host once the gadget is ready (US layout)")
+	flags.IntVar(&c.TypeDelayMs, "type-delay-ms", c.TypeDelayMs, "pause this many ms after each character typed with -type-file")
+	flags.BoolVar(&c.TypeFileExit, "type-file-exit", c.TypeFileExit, "exit after typing the -type-file instead of continuing as a proxy")
+	flags.StringVar(&c.PhysicalLayout, "physical-layout", c.PhysicalLayout, "physical layout of the keyboards, for the keys whose position differs (us, or iso for eg. UK, German or French keyboards)")
+	flags.StringVar(&c.Keymap, "keymap", c.Keymap, "override or extend the built-in evdev key code to HID usage table with this file (lines of evdev_code,hid_usage, or a JSON object if it ends with .json)")
+	flags.StringVar(&c.Hwdb, "hwdb", c.Hwdb, "apply the keyboard remappings (KEYBOARD_KEY_...) from this udev hwdb file, reloaded when it changes")
+	flags.BoolVar(&c.BatchWrites, "batch-writes", c.BatchWrites, "merge queued up mouse reports into one write when the writer falls behind")
+	flags.IntVar(&c.MouseKeysSpeed, "mouse-keys-speed", c.MouseKeysSpeed, "counts the mouse moves every 20 ms when a move-up/down/left/right key is first held (see mouseActions)")
+	flags.Float64Var(&c.MouseKeysAccel, "mouse-keys-accel", c.MouseKeysAccel, "speed up held mouse movement keys by this many counts every 20 ms")
+	flags.IntVar(&c.MouseKeysMaxSpeed, "mouse-keys-max-speed", c.MouseKeysMaxSpeed, "fastest speed of held mouse movement keys, in counts every 20 ms")
+	flags.StringVar(&c.DialAction, "dial-action", c.DialAction, "what turning a dial (REL_DIAL) does: wheel, volume or two keys for turning up and down, eg. KEY_RIGHT,KEY_LEFT")
+	flags.Var(stringsValue{&c.AllowKeys}, "allow-key", "only send this key to the host, given as an evdev key name, eg. KEY_ENTER (repeatable; all keys are sent if none are given)")
+	flags.BoolVar(&c.LogDroppedKeys, "log-dropped-keys", c.LogDroppedKeys, "log presses of keys dropped because they aren't allowed with -allow-key")
+	flags.BoolVar(&c.BindOnDemand, "bind-on-demand", c.BindOnDemand, "leave the gadget unbound (invisible to the host) until a device is grabbed, and unbind it again when none are left (needs -setuphid)")
+	flags.IntVar(&c.ExitWhenIdle, "exit-when-idle", c.ExitWhenIdle, "exit (tearing down the gadget if it was set up with -setuphid) once no devices have been grabbed for this many seconds (0 to keep running)")
+	flags.Float64Var(&c.MouseScale, "mouse-scale", c.MouseScale, "multiply mouse movement by this, eg. 0.5 to slow down a high resolution mouse (fractions are carried over to later movement)")
+	flags.IntVar(&c.MouseQuantize, "mouse-quantize", c.MouseQuantize, "send mouse movement in multiples of this many counts, carrying the rest over to later reports, for fewer reports on small movements (0 to disable)")
+	flags.IntVar(&c.JiggleInterval, "jiggle-interval", c.JiggleInterval, "move the mouse by a pixel and back after this many seconds without mouse input, to keep the host from going to sleep (0 to disable)")
+	flags.IntVar(&c.KeepaliveInterval, "keepalive-interval", c.KeepaliveInterval, "resend the current keyboard report after this many seconds without input, to keep hosts or KVMs from dropping the device (0 to disable)")
+	flags.IntVar(&c.IdleRate, "idle-rate", c.IdleRate, "HID idle rate in 4 ms units (1-255): resend the current keyboard report this often without input, regardless of the idle rate the host sets with SET_IDLE, which the gadget doesn't pass on (0 to disable)")
+	flags.IntVar(&c.MinReportGapMs, "min-report-gap", c.MinReportGapMs, "leave at least this many milliseconds between keyboard reports, for hosts that drop keys when reports come too fast (0 to disable)")
+	flags.IntVar(&c.ReportRateHz, "report-rate-hz", c.ReportRateHz, "emit reports at most at this rate, like a device polled at that rate (0 to write on every input event)")
+	return configFile, dumpConfig
+}
+
+// Registers the common and USB gadget flags, for the commands that only deal
+// with the gadget
+func (c *Config) RegisterGadgetCommandFlags(flags *flag.FlagSet) (*string, *string) {
+	configFile, dumpConfig := c.RegisterCommonFlags(flags)
+	c.RegisterGadgetFlags(flags)
+	return configFile, dumpConfig
+}
+
+// Parses the command line arguments. If a configuration file is given, it is
+// loaded first and the arguments parsed again on top of it, so that flags
+// take precedence. Returns the configuration, the -dump-config value and the
+// arguments left after the flags.
+func LoadConfig(name string, args []string, register func(*Config, *flag.FlagSet) (*string, *string)) (Config, string, []string) {
+	config := DefaultConfig()
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configFile, dumpConfig := register(&config, flags)
+	flags.Parse(args)
+	if *configFile != "" {
+		config = DefaultConfig()
+		if err := config.Load(*configFile); err != nil {
+			log.Fatalf("Failed to load configuration from %s: %s", *configFile, err.Error())
+		}
+		flags = flag.NewFlagSet(name, flag.ExitOnError)
+		configFile, dumpConfig = register(&config, flags)
+		flags.Parse(args)
+	}
+	return config, *dumpConfig, flags.Args()
+}
+
+// Interval between reports for the configured report rate, zero if unlimited
+func (c *Config) ReportInterval() time.Duration {
+	if c.ReportRateHz <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(c.ReportRateHz)
+}
+
+// Unit of the HID idle rate
+const IDLE_RATE_UNIT = 4 * time.Millisecond
+
+// How long the keyboard writer waits without input before resending the
+// current report: the keepalive interval or the HID idle rate, whichever is
+// shorter, zero if neither is set. The f_hid gadget function handles the
+// host's SET_IDLE in the kernel without exposing the rate, so the configured
+// rate overrides whatever the host asked for; both are off by default, as
+// with the idle rate of 0 hosts set for boot protocol keyboards.
+func (c *Config) KeyboardKeepalive() time.Duration {
+	keepalive := time.Duration(c.KeepaliveInterval) * time.Second
+	if idle := time.Duration(c.IdleRate) * IDLE_RATE_UNIT; idle > 0 && (keepalive <= 0 || idle < keepalive) {
+		keepalive = idle
+	}
+	return keepalive
+}
+
+// Repeat rate and delay for a keyboard. Per-device settings are keyed by the
+// device identity (bus:vendor:product, eg. 0005:04e8:7021) or name, and
+// settings left at zero fall back to the global ones.
+func (c *Config) RepeatFor(dev *evdev.InputDevice) (int, int) {
+	repeat, delay := c.KbdRepeat, c.KbdDelay
+	settings, ok := c.DeviceRepeat[DeviceIdentity(dev)]
+	if !ok {
+		settings, ok = c.DeviceRepeat[dev.Name]
+	}
+	if ok {
+		if settings.KbdRepeat > 0 {
+			repeat = settings.KbdRepeat
+		}
+		if settings.KbdDelay > 0 {
+			delay = settings.KbdDelay
+		}
+	}
+	return repeat, delay
+}
+
+// Longest chord window, to keep the added latency bounded
+const CHORD_WINDOW_MAX_MS = 50
+
+// Largest mouse scale; more would turn a single count into a jump across the
+// screen
+const MOUSE_SCALE_MAX = 100
+
+const (
+	KBD_REPEAT_MIN = 1 // keys per second
+	KBD_REPEAT_MAX = 100
+	KBD_DELAY_MIN  = 100 // ms
+	KBD_DELAY_MAX  = 5000
+)
+
+func validateRepeat(name string, rate int, delay int) error {
+	if rate < KBD_REPEAT_MIN || rate > KBD_REPEAT_MAX {
+		return fmt.Errorf("%s: repeat rate %d out of range (%d-%d keys per second)", name, rate, KBD_REPEAT_MIN, KBD_REPEAT_MAX)
+	}
+	if delay < KBD_DELAY_MIN || delay > KBD_DELAY_MAX {
+		return fmt.Errorf("%s: repeat delay %d out of range (%d-%d ms)", name, delay, KBD_DELAY_MIN, KBD_DELAY_MAX)
+	}
+	return nil
+}
+
+// Checks the global and per-device keyboard repeat settings
+func (c *Config) ValidateRepeat() error {
+	if err := validateRepeat("kbdrepeat/kbddelay", c.KbdRepeat, c.KbdDelay); err != nil {
+		return err
+	}
+	for device, settings := range c.DeviceRepeat {
+		rate, delay := settings.KbdRepeat, settings.KbdDelay
+		if rate == 0 {
+			rate = c.KbdRepeat
+		}
+		if delay == 0 {
+			delay = c.KbdDelay
+		}
+		if err := validateRepeat(device, rate, delay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the device was given with -device, or if no devices were
+// given (all devices are handled)
+func (c *Config) SelectsDevice(devnode string) bool {
+	if len(c.Devices) == 0 {
+		return true
+	}
+	for _, spec := range c.Devices {
+		if MatchDevice(spec, devnode) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the device node is one of the ignored devices
+func (c *Config) IgnoresDevice(devnode string) bool {
+	for _, spec := range c.IgnoreDevices {
+		if MatchDevice(spec, devnode) {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlays the settings in a JSON configuration file on top of the current ones
+func (c *Config) Load(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, c)
+}
+
+// Placeholder for secrets in the effective configuration
+const REDACTED = "redacted"
+
+// The configuration in use, as logged and dumped, with the control API token
+// redacted
+func (c *Config) Effective(keymap *Keymap) EffectiveConfig {
+	redacted := *c
+	if redacted.ControlToken != "" {
+		redacted.ControlToken = REDACTED
+	}
+	return EffectiveConfig{
+		Config:                   &redacted,
+		Scancodes:                keymap.Len(),
+		KeyboardReportLength:     KeyboardReportLength(c.Gadget.KeyboardReportId),
+		MouseReportLength:        MouseReportLength(),
+		KeyboardDescriptorLength: len(KeyboardReportDescriptor(c.Gadget.KeyboardReportId)),
+		MouseDescriptorLength:    len(MouseReportDescriptor()),
+	}
+}
+
+func (c *Config) Dump(path string, keymap *Keymap) error {
+	contents, err := json.MarshalIndent(c.Effective(keymap), "", "  ")
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = os.Stdout.Write(append(contents, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(path, append(contents, '\n'), os.FileMode(0600))
+}
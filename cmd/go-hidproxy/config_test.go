@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyboardKeepalive(t *testing.T) {
+	config := DefaultConfig()
+	// Off by default, like a host setting an idle rate of 0
+	if keepalive := config.KeyboardKeepalive(); keepalive != 0 {
+		t.Errorf("got a default keepalive of %s, want none", keepalive)
+	}
+	config.KeepaliveInterval = 1
+	config.IdleRate = 125
+	if keepalive := config.KeyboardKeepalive(); keepalive != 500*time.Millisecond {
+		t.Errorf("got %s, want the shorter idle rate of 500ms", keepalive)
+	}
+}
+
+func TestDumpRedactsControlToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hidproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.ControlToken = "secret"
+	path := filepath.Join(dir, "config.json")
+	if err := config.Dump(path, NewKeymap(Scancodes)); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "secret") || !strings.Contains(string(contents), REDACTED) {
+		t.Errorf("control token not redacted in the dump:\n%s", contents)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("dump readable by others: %v (%v)", info.Mode().Perm(), err)
+	}
+	if config.ControlToken != "secret" {
+		t.Errorf("dumping changed the control token in use to %q", config.ControlToken)
+	}
+}
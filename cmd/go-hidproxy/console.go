@@ -0,0 +1,72 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const BUS_BLUETOOTH = 0x05
+
+// The virtual console currently shown on the local display (eg. tty1), empty
+// if there is none (eg. a headless board with only a serial console)
+func ActiveConsole() string {
+	active, err := ioutil.ReadFile("/sys/class/tty/tty0/active")
+	if err != nil {
+		return ""
+	}
+	console := strings.TrimSpace(string(active))
+	if !strings.HasPrefix(console, "tty") {
+		return ""
+	}
+	return console
+}
+
+// Input handlers attached to the device (eg. kbd, sysrq, event0), from
+// /proc/bus/input/devices
+func InputHandlers(devnode string) []string {
+	contents, err := ioutil.ReadFile("/proc/bus/input/devices")
+	if err != nil {
+		return nil
+	}
+	event := filepath.Base(devnode)
+	for _, block := range strings.Split(string(contents), "\n\n") {
+		for _, line := range strings.Split(block, "\n") {
+			if !strings.HasPrefix(line, "H: Handlers=") {
+				continue
+			}
+			handlers := strings.Fields(strings.TrimPrefix(line, "H: Handlers="))
+			for _, handler := range handlers {
+				if handler == event {
+					return handlers
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the virtual console the device types into, if it is a keyboard
+// attached to the machine itself (eg. over USB) that feeds the active
+// console. Grabbing it would leave the local console without a keyboard.
+// Bluetooth keyboards, which the proxy is meant for, also feed the console
+// but are never treated as the console keyboard. The kernel attaches every
+// keyboard to the console, so this can't tell the keyboard someone logs in
+// with from any other wired keyboard, which is why the check is opt-in
+// (-protect-console).
+func ConsoleKeyboard(dev *evdev.InputDevice) (string, bool) {
+	if dev.Bustype == BUS_BLUETOOTH || dev.Bustype == BUS_VIRTUAL {
+		return "", false
+	}
+	console := ActiveConsole()
+	if console == "" {
+		return "", false
+	}
+	for _, handler := range InputHandlers(dev.Fn) {
+		if handler == "kbd" {
+			return console, true
+		}
+	}
+	return "", false
+}
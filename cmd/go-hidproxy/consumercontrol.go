@@ -0,0 +1,87 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Highest Consumer page usage the consumer control report can hold
+const USAGE_CONSUMER_MAX = 0x3ff
+
+// Keys sent as Consumer Control reports when they come from the consumer
+// control node of a keyboard (see RouteKey). Hosts handle media keys more
+// reliably on the Consumer page than on the keyboard page, some ignore the
+// keyboard page volume keys altogether.
+var ConsumerKeys = map[uint16]uint16{
+	113: 0xe2,  // KEY_MUTE
+	114: 0xea,  // KEY_VOLUMEDOWN
+	115: 0xe9,  // KEY_VOLUMEUP
+	140: 0x192, // KEY_CALC
+	155: 0x18a, // KEY_MAIL
+	158: 0x224, // KEY_BACK
+	159: 0x225, // KEY_FORWARD
+	161: 0xb8,  // KEY_EJECTCD
+	163: 0xb5,  // KEY_NEXTSONG
+	164: 0xcd,  // KEY_PLAYPAUSE
+	165: 0xb6,  // KEY_PREVIOUSSONG
+	166: 0xb7,  // KEY_STOPCD
+	172: 0x223, // KEY_HOMEPAGE
+	200: 0xb0,  // KEY_PLAYCD
+	201: 0xb1,  // KEY_PAUSECD
+	217: 0x221, // KEY_SEARCH
+	224: 0x70,  // KEY_BRIGHTNESSDOWN
+	225: 0x6f,  // KEY_BRIGHTNESSUP
+}
+
+// Two byte report holding the Consumer page usage of the pressed control, 0
+// for none
+func ConsumerControlReportDescriptor() []byte {
+	return NewDescriptor().
+		UsagePage(USAGE_PAGE_CONSUMER).
+		Usage(0x01). // Consumer Control
+		Collection(COLLECTION_APPLICATION).
+		LogicalMinimum(0).
+		LogicalMaximum(USAGE_CONSUMER_MAX).
+		UsageMinimum(0).
+		UsageMaximum(USAGE_CONSUMER_MAX).
+		ReportSize(16).
+		ReportCount(1).
+		Input(HID_DATA | HID_ARRAY | HID_ABSOLUTE).
+		EndCollection().
+		Bytes()
+}
+
+func BuildConsumerControlReport(usage uint16) []uint8 {
+	return []uint8{uint8(usage), uint8(usage >> 8)}
+}
+
+// Length of the consumer control report, as built by
+// BuildConsumerControlReport
+func ConsumerControlReportLength() int {
+	return len(BuildConsumerControlReport(0))
+}
+
+func SendConsumerControlReports(path string, input <-chan InputMessage, ready chan<- bool, reportLength int) error {
+	log.Infof("Opening consumer control %s for writing...", path)
+	file, err := OpenHidOutput(path)
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+	defer file.Close()
+	ready <- true
+
+	err = WriteReports(file, path, input, Latencies["consumer"], Throughputs["consumer"], WriterOptions{Type: "consumer", LatencyEvery: 10, ReportLength: reportLength})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return err
+}
+
+// Device node the consumer control function usually gets: the one after the
+// system control function's, if the gadget has one
+func (g GadgetConfig) ConsumerControlNode() string {
+	if g.SystemControl {
+		return "/dev/hidg3"
+	}
+	return "/dev/hidg2"
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Longest text accepted by POST /type
+const MAX_TYPE_LENGTH = 4096
+
+// HTTP API for inspecting and controlling the proxy at runtime
+type ControlServer struct {
+	mux    *http.ServeMux
+	queues ReportQueues
+	mouse  *MouseState
+	keymap *Keymap
+	// Listen address, for checking the Host and Origin of requests
+	addr string
+	// Bearer token required on POST requests, if set
+	token string
+}
+
+func NewControlServer(queues ReportQueues, mouse *MouseState, keymap *Keymap, addr string, token string) *ControlServer {
+	c := &ControlServer{
+		mux:    http.NewServeMux(),
+		queues: queues,
+		mouse:  mouse,
+		keymap: keymap,
+		addr:   addr,
+		token:  token,
+	}
+	c.mux.HandleFunc("/devices", c.handleDevices)
+	c.mux.HandleFunc("/sequence/", c.handleSequence)
+	c.mux.HandleFunc("/type", c.handleType)
+	c.mux.HandleFunc("/latency", c.handleLatency)
+	c.mux.HandleFunc("/throughput", c.handleThroughput)
+	c.mux.HandleFunc("/state", c.handleState)
+	c.mux.HandleFunc("/enable", c.handleEnable)
+	c.mux.HandleFunc("/health", c.handleHealth)
+	return c
+}
+
+func (c *ControlServer) ListenAndServe() {
+	log.Infof("Starting control API on %s", c.addr)
+	if err := http.ListenAndServe(c.addr, c); err != nil {
+		log.Errorf("Control API stopped: %s", err.Error())
+	}
+}
+
+// Serves requests addressed to the proxy itself. A web page open on the
+// proxy's machine can send simple cross-origin POSTs to localhost, or reach
+// it through a name resolving there (DNS rebinding), so requests naming
+// another host or coming from another origin are refused. POST requests also
+// need the bearer token if one is set, otherwise a JSON content type, which
+// browsers only send cross-origin after a preflight the API doesn't answer.
+// The token is also needed for the endpoints showing the keys held (which
+// could be polled to log keystrokes).
+func (c *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !c.isOwnHost(r.Host) {
+		http.Error(w, "unknown host", http.StatusForbidden)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "cross-origin requests not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	if c.token != "" && (r.Method == http.MethodPost || showsHeldKeys(r.URL.Path)) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(c.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+	} else if r.Method == http.MethodPost && !isJSON(r) {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	c.mux.ServeHTTP(w, r)
+}
+
+func showsHeldKeys(path string) bool {
+	return path == "/state" || path == "/devices"
+}
+
+// Whether the keys held on the devices can be shown: to requests with the
+// token if one is set, otherwise only when listening on loopback, where
+// only users of the machine itself can ask
+func (c *ControlServer) canShowHeldKeys() bool {
+	if c.token != "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Whether the Host of a request is the proxy: an IP address, localhost, the
+// machine's host name or the host listened on, with the port listened on
+func (c *ControlServer) isOwnHost(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "80"
+	}
+	listenHost, listenPort, err := net.SplitHostPort(c.addr)
+	if err != nil || port != listenPort {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil || host == "localhost" || host == strings.ToLower(listenHost) {
+		return true
+	}
+	hostname, err := os.Hostname()
+	return err == nil && host == strings.ToLower(hostname)
+}
+
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("Failed to write control API response: %s", err.Error())
+	}
+}
+
+func (c *ControlServer) handleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	devices := Devices.Snapshot()
+	if !c.canShowHeldKeys() {
+		for i := range devices {
+			devices[i].Held = HeldState{}
+		}
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+type health struct {
+	UDC         UDCStatus `json:"udc"`
+	Description string    `json:"description,omitempty"`
+	Devices     int       `json:"devices"`
+}
+
+// USB device controller state (whether the host has enumerated the gadget)
+// and the number of devices handled
+func (c *ControlServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := CurrentUDCStatus()
+	writeJSON(w, http.StatusOK, health{
+		UDC:         status,
+		Description: DescribeUDCState(status.State),
+		Devices:     Devices.Len(),
+	})
+}
+
+type heldKeys struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"`
+	Keys    []string `json:"keys"`
+	Usages  []uint16 `json:"usages"`
+	Buttons uint8    `json:"buttons"`
+}
+
+type heldState struct {
+	Devices      []heldKeys `json:"devices"`
+	MouseButtons uint8      `json:"mouseButtons"`
+}
+
+// Keys and buttons currently held down per device, and the buttons in the
+// combined mouse report
+func (c *ControlServer) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	state := heldState{
+		Devices:      make([]heldKeys, 0),
+		MouseButtons: c.mouse.HeldButtons(),
+	}
+	if !c.canShowHeldKeys() {
+		http.Error(w, "held keys are only shown with -control-token or on a loopback address", http.StatusForbidden)
+		return
+	}
+	for _, device := range Devices.Snapshot() {
+		if device.State == DEVICE_NOT_GRABBED {
+			continue
+		}
+		state.Devices = append(state.Devices, heldKeys{
+			Name:    device.Name,
+			Path:    device.Path,
+			Keys:    c.keymap.UsageNames(device.Held.Keys),
+			Usages:  append(make([]uint16, 0), device.Held.Keys...),
+			Buttons: device.Held.Buttons,
+		})
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// Report write latency percentiles per report type, in nanoseconds, or with
+// ?stage=capture the capture latency per handler type
+func (c *ControlServer) handleLatency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	latencies := Latencies
+	switch r.URL.Query().Get("stage") {
+	case "", "write":
+	case "capture":
+		latencies = CaptureLatencies
+	default:
+		http.Error(w, "unknown stage (expected write or capture)", http.StatusBadRequest)
+		return
+	}
+	summaries := make(map[string]LatencySummary, len(latencies))
+	for name, stats := range latencies {
+		summaries[name] = stats.Summary()
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// Report write rate and input queue depth per report type
+func (c *ControlServer) handleThroughput(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	summaries := make(map[string]ThroughputSummary, len(Throughputs))
+	for name, stats := range Throughputs {
+		summaries[name] = stats.Summary()
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// POST /sequence/ctrl-alt-del or /sequence/sysrq-<key>
+func (c *ControlServer) handleSequence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/sequence/")
+	if _, err := SequenceSteps(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Infof("Sending sequence via control API: %s", name)
+	if err := SendSequence(c.queues.Keyboard, name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type typeRequest struct {
+	Text string `json:"text"`
+}
+
+// POST /type with {"text": "..."}, or with a bearer token also the text to
+// type as the body
+func (c *ControlServer) handleType(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, MAX_TYPE_LENGTH)
+	var text []byte
+	if isJSON(r) {
+		var request typeRequest
+		if err := json.NewDecoder(body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		text = []byte(request.Text)
+	} else {
+		var err error
+		if text, err = ioutil.ReadAll(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := TypeSteps(string(text)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Typing %d characters via control API", len([]rune(string(text))))
+	if err := SendText(c.queues.Keyboard, string(text)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type enableRequest struct {
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+// GET /enable for whether each report type is forwarded, POST /enable with
+// {"type": "mouse", "enabled": false} to change it
+func (c *ControlServer) handleEnable(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request enableRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.queues.SetEnabled(request.Type, request.Enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	enabled := make(map[string]bool, 0)
+	for _, reportType := range ReportTypes() {
+		enabled[reportType] = IsEnabled(reportType)
+	}
+	writeJSON(w, http.StatusOK, enabled)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Sends a request to a control server listening on localhost:8080, returning
+// the status and the number of keyboard reports queued
+func controlRequest(token string, path string, body string, header map[string]string) (int, int) {
+	keyboard := make(chan InputMessage, 16)
+	control := NewControlServer(ReportQueues{Keyboard: keyboard}, nil, NewKeymap(Scancodes), "localhost:8080", token)
+	request := httptest.NewRequest(http.MethodPost, "http://localhost:8080"+path, strings.NewReader(body))
+	for name, value := range header {
+		if name == "Host" {
+			request.Host = value
+		} else {
+			request.Header.Set(name, value)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	control.ServeHTTP(recorder, request)
+	return recorder.Code, len(keyboard)
+}
+
+func TestControlRejectsCrossSiteRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		header map[string]string
+		want   int
+	}{
+		{"simple form post", "/type", "rm -rf ~\n", map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"no content type", "/sequence/ctrl-alt-del", "", nil, http.StatusUnsupportedMediaType},
+		{"other origin", "/type", `{"text": "hi"}`, map[string]string{"Content-Type": "application/json", "Origin": "http://example.com"}, http.StatusForbidden},
+		{"rebound host", "/type", `{"text": "hi"}`, map[string]string{"Content-Type": "application/json", "Host": "example.com:8080"}, http.StatusForbidden},
+		{"other port", "/type", `{"text": "hi"}`, map[string]string{"Content-Type": "application/json", "Host": "127.0.0.1:8081"}, http.StatusForbidden},
+		{"json", "/sequence/ctrl-alt-del", "", map[string]string{"Content-Type": "application/json"}, http.StatusNoContent},
+		{"json text", "/type", `{"text": "hi"}`, map[string]string{"Content-Type": "application/json; charset=utf-8", "Host": "127.0.0.1:8080"}, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		status, queued := controlRequest("", test.path, test.body, test.header)
+		if status != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, status, test.want)
+		}
+		if sent := status == http.StatusNoContent; sent != (queued > 0) {
+			t.Errorf("%s: got status %d with %d reports queued", test.name, status, queued)
+		}
+	}
+}
+
+func TestControlToken(t *testing.T) {
+	if status, _ := controlRequest("secret", "/type", "hi", map[string]string{"Content-Type": "application/json"}); status != http.StatusUnauthorized {
+		t.Errorf("got status %d without the token, want %d", status, http.StatusUnauthorized)
+	}
+	if status, queued := controlRequest("secret", "/type", "hi", map[string]string{"Authorization": "Bearer secret"}); status != http.StatusNoContent || queued == 0 {
+		t.Errorf("got status %d with %d reports queued for plain text with the token, want it typed", status, queued)
+	}
+}
+
+// Sends a GET request to a control server listening on the address
+func controlGet(addr string, token string, path string, header map[string]string) *httptest.ResponseRecorder {
+	control := NewControlServer(ReportQueues{}, NewMouseState(), NewKeymap(Scancodes), addr, token)
+	request := httptest.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	control.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestControlHeldKeys(t *testing.T) {
+	Devices.Add(&evdev.InputDevice{Fn: "/dev/input/event91", Name: "test"}, string(DEVICE_KEYBOARD))
+	defer Devices.Remove("/dev/input/event91")
+	Devices.SetState("/dev/input/event91", DEVICE_GRABBED)
+	Devices.SetHeld("/dev/input/event91", []uint16{Scancodes[30]}, 0)
+	bearer := map[string]string{"Authorization": "Bearer secret"}
+	tests := []struct {
+		name   string
+		addr   string
+		token  string
+		header map[string]string
+		want   int
+	}{
+		{"loopback", "127.0.0.1:8080", "", nil, http.StatusOK},
+		{"all interfaces", "0.0.0.0:8080", "", nil, http.StatusForbidden},
+		{"without the token", "0.0.0.0:8080", "secret", nil, http.StatusUnauthorized},
+		{"loopback without the token", "localhost:8080", "secret", nil, http.StatusUnauthorized},
+		{"with the token", "0.0.0.0:8080", "secret", bearer, http.StatusOK},
+	}
+	for _, test := range tests {
+		if status := controlGet(test.addr, test.token, "/state", test.header).Code; status != test.want {
+			t.Errorf("%s: got status %d for /state, want %d", test.name, status, test.want)
+		}
+	}
+
+	if status := controlGet("0.0.0.0:8080", "secret", "/devices", nil).Code; status != http.StatusUnauthorized {
+		t.Errorf("got status %d for /devices without the token, want %d", status, http.StatusUnauthorized)
+	}
+	if devices := controlGet("127.0.0.1:8080", "", "/devices", nil); !strings.Contains(devices.Body.String(), `"keys":[4]`) {
+		t.Errorf("held keys missing from /devices on loopback:\n%s", devices.Body.String())
+	}
+	devices := controlGet("0.0.0.0:8080", "", "/devices", nil)
+	if devices.Code != http.StatusOK || strings.Contains(devices.Body.String(), `"keys":[4]`) {
+		t.Errorf("got status %d for /devices on all interfaces, want it without the held keys:\n%s", devices.Code, devices.Body.String())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+)
+
+// Filters out key and button chatter: a press of a code within the window of
+// its previous release is ignored. Releases are never ignored, so a key can't
+// get stuck down, but genuine double taps faster than the window lose their
+// second press, so keep the window small.
+type Debouncer struct {
+	window      time.Duration
+	held        map[uint16]bool
+	lastRelease map[uint16]time.Time
+}
+
+func NewDebouncer(window time.Duration) *Debouncer {
+	return &Debouncer{
+		window:      window,
+		held:        make(map[uint16]bool, 0),
+		lastRelease: make(map[uint16]time.Time, 0),
+	}
+}
+
+// Returns true if the press (or release, if pressed is false) of code at the
+// given time should be ignored
+func (d *Debouncer) Bounce(code uint16, pressed bool, at time.Time) bool {
+	if d.window <= 0 {
+		return false
+	}
+	if !pressed {
+		if d.held[code] {
+			d.held[code] = false
+			d.lastRelease[code] = at
+		}
+		return false
+	}
+	if d.held[code] {
+		return false
+	}
+	if last, ok := d.lastRelease[code]; ok && at.Sub(last) < d.window {
+		return true
+	}
+	d.held[code] = true
+	return false
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebouncerSuppressesRepresses(t *testing.T) {
+	d := NewDebouncer(10 * time.Millisecond)
+	start := time.Unix(0, 0)
+	events := []struct {
+		pressed bool
+		ms      int
+		bounce  bool
+	}{
+		{true, 0, false},   // press
+		{false, 2, false},  // chatter release, never dropped
+		{true, 4, true},    // chatter re-press within the window
+		{false, 6, false},  // release of a key already released
+		{true, 20, false},  // genuine press after the window
+		{true, 21, false},  // repeat while held
+		{false, 22, false}, // release right after the press
+	}
+	for i, e := range events {
+		if got := d.Bounce(30, e.pressed, start.Add(time.Duration(e.ms)*time.Millisecond)); got != e.bounce {
+			t.Errorf("event %d (pressed=%v at %dms): got bounce=%v, want %v", i, e.pressed, e.ms, got, e.bounce)
+		}
+	}
+}
+
+func TestDebouncerDisabled(t *testing.T) {
+	d := NewDebouncer(0)
+	at := time.Unix(0, 0)
+	for i := 0; i < 4; i++ {
+		if d.Bounce(30, i%2 == 0, at) {
+			t.Fatalf("event %d bounced with debouncing disabled", i)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+// Builder for HID report descriptors, so descriptors are written as items
+// rather than hand-encoded bytes
+
+// Usage pages
+const (
+	USAGE_PAGE_GENERIC_DESKTOP = 0x01
+	USAGE_PAGE_KEYBOARD        = 0x07
+	USAGE_PAGE_LEDS            = 0x08
+	USAGE_PAGE_BUTTON          = 0x09
+	USAGE_PAGE_CONSUMER        = 0x0c
+)
+
+// Collection types
+const (
+	COLLECTION_PHYSICAL    = 0x00
+	COLLECTION_APPLICATION = 0x01
+)
+
+// Flags of Input and Output items, combined with |
+const (
+	HID_DATA     = 0x00
+	HID_CONSTANT = 0x01
+	HID_ARRAY    = 0x00
+	HID_VARIABLE = 0x02
+	HID_ABSOLUTE = 0x00
+	HID_RELATIVE = 0x04
+)
+
+// Item prefixes, without the size bits
+const (
+	itemInput         = 0x80
+	itemOutput        = 0x90
+	itemCollection    = 0xa0
+	itemEndCollection = 0xc0
+	itemUsagePage     = 0x04
+	itemLogicalMin    = 0x14
+	itemLogicalMax    = 0x24
+	itemReportSize    = 0x74
+	itemReportId      = 0x84
+	itemReportCount   = 0x94
+	itemUsage         = 0x08
+	itemUsageMin      = 0x18
+	itemUsageMax      = 0x28
+)
+
+// Builds a report descriptor from short items, each encoded with the
+// smallest data size (at least one byte) that holds its value:
+//
+//	NewDescriptor().
+//		UsagePage(USAGE_PAGE_GENERIC_DESKTOP).
+//		Usage(0x06).
+//		Collection(COLLECTION_APPLICATION).
+//		...
+//		EndCollection().
+//		Bytes()
+type DescriptorBuilder struct {
+	bytes []byte
+}
+
+func NewDescriptor() *DescriptorBuilder {
+	return &DescriptorBuilder{bytes: make([]byte, 0, 64)}
+}
+
+func (d *DescriptorBuilder) item(prefix byte, data []byte) *DescriptorBuilder {
+	size := map[int]byte{0: 0, 1: 1, 2: 2, 4: 3}[len(data)]
+	d.bytes = append(d.bytes, prefix|size)
+	d.bytes = append(d.bytes, data...)
+	return d
+}
+
+// Item with an unsigned value
+func (d *DescriptorBuilder) unsigned(prefix byte, value uint32) *DescriptorBuilder {
+	switch {
+	case value <= 0xff:
+		return d.item(prefix, []byte{byte(value)})
+	case value <= 0xffff:
+		return d.item(prefix, []byte{byte(value), byte(value >> 8)})
+	}
+	return d.item(prefix, []byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)})
+}
+
+// Item with a signed value, for logical minimums and maximums
+func (d *DescriptorBuilder) signed(prefix byte, value int32) *DescriptorBuilder {
+	switch {
+	case value >= -0x80 && value <= 0x7f:
+		return d.item(prefix, []byte{byte(value)})
+	case value >= -0x8000 && value <= 0x7fff:
+		return d.item(prefix, []byte{byte(value), byte(value >> 8)})
+	}
+	return d.item(prefix, []byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)})
+}
+
+func (d *DescriptorBuilder) UsagePage(page uint16) *DescriptorBuilder {
+	return d.unsigned(itemUsagePage, uint32(page))
+}
+
+func (d *DescriptorBuilder) Usage(usage uint16) *DescriptorBuilder {
+	return d.unsigned(itemUsage, uint32(usage))
+}
+
+func (d *DescriptorBuilder) UsageMinimum(usage uint16) *DescriptorBuilder {
+	return d.unsigned(itemUsageMin, uint32(usage))
+}
+
+func (d *DescriptorBuilder) UsageMaximum(usage uint16) *DescriptorBuilder {
+	return d.unsigned(itemUsageMax, uint32(usage))
+}
+
+func (d *DescriptorBuilder) LogicalMinimum(value int32) *DescriptorBuilder {
+	return d.signed(itemLogicalMin, value)
+}
+
+func (d *DescriptorBuilder) LogicalMaximum(value int32) *DescriptorBuilder {
+	return d.signed(itemLogicalMax, value)
+}
+
+// Size of each field in bits
+func (d *DescriptorBuilder) ReportSize(bits uint8) *DescriptorBuilder {
+	return d.unsigned(itemReportSize, uint32(bits))
+}
+
+func (d *DescriptorBuilder) ReportCount(count uint8) *DescriptorBuilder {
+	return d.unsigned(itemReportCount, uint32(count))
+}
+
+// Adds the report ID item, unless the ID is zero (no report IDs)
+func (d *DescriptorBuilder) ReportId(id uint8) *DescriptorBuilder {
+	if id == 0 {
+		return d
+	}
+	return d.unsigned(itemReportId, uint32(id))
+}
+
+func (d *DescriptorBuilder) Input(flags uint8) *DescriptorBuilder {
+	return d.unsigned(itemInput, uint32(flags))
+}
+
+func (d *DescriptorBuilder) Output(flags uint8) *DescriptorBuilder {
+	return d.unsigned(itemOutput, uint32(flags))
+}
+
+func (d *DescriptorBuilder) Collection(kind uint8) *DescriptorBuilder {
+	return d.unsigned(itemCollection, uint32(kind))
+}
+
+func (d *DescriptorBuilder) EndCollection() *DescriptorBuilder {
+	return d.item(itemEndCollection, nil)
+}
+
+// Adds a constant input field of the given number of bits, eg. to pad a
+// report to a byte boundary
+func (d *DescriptorBuilder) Padding(bits uint8) *DescriptorBuilder {
+	return d.ReportSize(1).ReportCount(bits).Input(HID_CONSTANT | HID_VARIABLE)
+}
+
+func (d *DescriptorBuilder) Bytes() []byte {
+	return d.bytes
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Keyboard descriptor as it was hand-encoded before the descriptor builder,
+// with the report ID item if the ID is non-zero
+func handEncodedKeyboardDescriptor(reportId uint8, slots int, bitmap []uint16) []byte {
+	desc := []byte{
+		0x05, 0x01, // Usage Page (Generic Desktop)
+		0x09, 0x06, // Usage (Keyboard)
+		0xa1, 0x01, // Collection (Application)
+	}
+	if reportId > 0 {
+		desc = append(desc, 0x85, reportId) // Report ID
+	}
+	desc = append(desc,
+		0x05, 0x07, // Usage Page (Keyboard)
+		0x19, 0xe0, // Usage Minimum (Left Control)
+		0x29, 0xe7, // Usage Maximum (Right GUI)
+		0x15, 0x00, // Logical Minimum (0)
+		0x25, 0x01, // Logical Maximum (1)
+		0x75, 0x01, // Report Size (1)
+		0x95, 0x08, // Report Count (8)
+		0x81, 0x02, // Input (Data, Variable, Absolute), modifiers
+		0x95, 0x01, // Report Count (1)
+		0x75, 0x08, // Report Size (8)
+		0x81, 0x03, // Input (Constant), reserved
+		0x95, 0x05, // Report Count (5)
+		0x75, 0x01, // Report Size (1)
+		0x05, 0x08, // Usage Page (LEDs)
+		0x19, 0x01, // Usage Minimum (Num Lock)
+		0x29, 0x05, // Usage Maximum (Kana)
+		0x91, 0x02, // Output (Data, Variable, Absolute), LEDs
+		0x95, 0x01, // Report Count (1)
+		0x75, 0x03, // Report Size (3)
+		0x91, 0x03, // Output (Constant), padding
+		0x95, uint8(slots), // Report Count (key slots)
+		0x75, 0x08, // Report Size (8)
+		0x15, 0x00, // Logical Minimum (0)
+		0x25, 0x65, // Logical Maximum (101)
+		0x05, 0x07, // Usage Page (Keyboard)
+		0x19, 0x00, // Usage Minimum (0)
+		0x29, 0x65, // Usage Maximum (101)
+		0x81, 0x00, // Input (Data, Array), keys
+	)
+	if len(bitmap) > 0 {
+		desc = append(desc,
+			0x05, 0x07, // Usage Page (Keyboard)
+			0x15, 0x00, // Logical Minimum (0)
+			0x25, 0x01, // Logical Maximum (1)
+			0x75, 0x01, // Report Size (1)
+			0x95, uint8(len(bitmap)), // Report Count (bitmap keys)
+		)
+		for _, usage := range bitmap {
+			desc = append(desc, 0x09, uint8(usage)) // Usage
+		}
+		desc = append(desc, 0x81, 0x02) // Input (Data, Variable, Absolute), bitmap
+		if padding := (len(bitmap)+7)/8*8 - len(bitmap); padding > 0 {
+			desc = append(desc,
+				0x75, 0x01, // Report Size (1)
+				0x95, uint8(padding), // Report Count (padding)
+				0x81, 0x03, // Input (Constant)
+			)
+		}
+	}
+	return append(desc, 0xc0) // End Collection
+}
+
+func TestKeyboardDescriptorMatchesHandEncoded(t *testing.T) {
+	tests := []struct {
+		reportId uint8
+		slots    int
+		bitmap   []string
+	}{
+		{0, BOOT_KEY_SLOTS, nil},
+		{1, BOOT_KEY_SLOTS, nil},
+		{0, 10, nil},
+		{0, BOOT_KEY_SLOTS, []string{"KEY_F13", "KEY_F14", "KEY_F15"}},
+		{2, 8, []string{"KEY_A", "KEY_B", "KEY_C", "KEY_D", "KEY_E", "KEY_F", "KEY_G", "KEY_H"}},
+	}
+	for _, test := range tests {
+		layout, err := ParseKeyboardLayout(test.slots, test.bitmap, NewKeymap(Scancodes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := handEncodedKeyboardDescriptor(test.reportId, test.slots, layout.Bitmap)
+		if got := layout.Descriptor(test.reportId); !bytes.Equal(got, want) {
+			t.Errorf("report ID %d, %d slots, bitmap %v:\ngot  % x\nwant % x", test.reportId, test.slots, test.bitmap, got, want)
+		}
+	}
+}
+
+func TestMouseDescriptorMatchesHandEncoded(t *testing.T) {
+	// Boot mouse descriptor as hand-encoded before the descriptor builder
+	boot := []byte{0x05, 0x01, 0x09, 0x02, 0xa1, 0x01, 0x09, 0x01, 0xa1, 0x00, 0x05, 0x09, 0x19, 0x01, 0x29, 0x05, 0x15, 0x00, 0x25, 0x01, 0x95, 0x05, 0x75, 0x01, 0x81, 0x02, 0x95, 0x01, 0x75, 0x03, 0x81, 0x01, 0x05, 0x01, 0x09, 0x30, 0x09, 0x31, 0x09, 0x38, 0x15, 0x81, 0x25, 0x7f, 0x75, 0x08, 0x95, 0x03, 0x81, 0x06, 0xc0, 0xc0}
+	// Since followed by the horizontal wheel, before the end of the collections
+	want := append(append([]byte{}, boot[:len(boot)-2]...),
+		0x05, 0x0c, // Usage Page (Consumer)
+		0x0a, 0x38, 0x02, // Usage (AC Pan)
+		0x15, 0x81, // Logical Minimum (-127)
+		0x25, 0x7f, // Logical Maximum (127)
+		0x75, 0x08, // Report Size (8)
+		0x95, 0x01, // Report Count (1)
+		0x81, 0x06, // Input (Data, Variable, Relative)
+		0xc0, 0xc0, // End Collection, End Collection
+	)
+	layout, err := ParseMouseLayout(MOUSE_FORMAT_BOOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := layout.Descriptor(); !bytes.Equal(got, want) {
+		t.Errorf("got  % x\nwant % x", got, want)
+	}
+}
+
+func TestSystemControlDescriptorMatchesHandEncoded(t *testing.T) {
+	want := []byte{
+		0x05, 0x01, // Usage Page (Generic Desktop)
+		0x09, 0x80, // Usage (System Control)
+		0xa1, 0x01, // Collection (Application)
+		0x19, USAGE_SYSTEM_POWER_DOWN, // Usage Minimum
+		0x29, USAGE_SYSTEM_WAKE_UP, // Usage Maximum
+		0x15, 0x01, // Logical Minimum (1)
+		0x25, 0x03, // Logical Maximum (3)
+		0x75, 0x02, // Report Size (2)
+		0x95, 0x01, // Report Count (1)
+		0x81, 0x00, // Input (Data, Array, Absolute)
+		0x75, 0x06, // Report Size (6)
+		0x81, 0x03, // Input (Constant), padding
+		0xc0, // End Collection
+	}
+	if got := SystemControlReportDescriptor(); !bytes.Equal(got, want) {
+		t.Errorf("got  % x\nwant % x", got, want)
+	}
+}
+
+func TestConsumerControlDescriptorMatchesHandEncoded(t *testing.T) {
+	want := []byte{
+		0x05, 0x0c, // Usage Page (Consumer)
+		0x09, 0x01, // Usage (Consumer Control)
+		0xa1, 0x01, // Collection (Application)
+		0x15, 0x00, // Logical Minimum (0)
+		0x26, 0xff, 0x03, // Logical Maximum (0x3ff)
+		0x19, 0x00, // Usage Minimum (0)
+		0x2a, 0xff, 0x03, // Usage Maximum (0x3ff)
+		0x75, 0x10, // Report Size (16)
+		0x95, 0x01, // Report Count (1)
+		0x81, 0x00, // Input (Data, Array, Absolute)
+		0xc0, // End Collection
+	}
+	if got := ConsumerControlReportDescriptor(); !bytes.Equal(got, want) {
+		t.Errorf("got  % x\nwant % x", got, want)
+	}
+}
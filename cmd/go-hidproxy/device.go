@@ -0,0 +1,412 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// _IOW('E', 0x91, int), revokes all access to the device for this file descriptor
+const EVIOCREVOKE = 0x40044591
+
+// Releases the grab, revokes access and closes the device. Safe to call on
+// every handler exit path; errors are only logged since the device may
+// already be gone.
+func ReleaseDevice(logger *log.Entry, dev *evdev.InputDevice) {
+	if dev.File == nil {
+		return
+	}
+	if err := dev.Release(); err != nil {
+		logger.Debugf("Failed to release %s (%s): %s", dev.Name, dev.Fn, err.Error())
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.File.Fd(), EVIOCREVOKE, 0); errno != 0 {
+		logger.Debugf("Failed to revoke %s (%s): %s", dev.Name, dev.Fn, errno.Error())
+	}
+	dev.File.Close()
+	logger.Infof("Released device: %s (%s)", dev.Name, dev.Fn)
+}
+
+var ErrDeviceBusy = errors.New("device is grabbed by another process")
+var ErrGrabAborted = errors.New("stopped while waiting to grab device")
+var ErrGrabTimeout = errors.New("grabbing device timed out")
+
+func describeHolders(devnode string) string {
+	holders := make([]string, 0)
+	for _, pid := range DeviceHolders(devnode) {
+		holders = append(holders, fmt.Sprintf("pid %d (%s)", pid, ProcessName(pid)))
+	}
+	if len(holders) == 0 {
+		return "unknown process"
+	}
+	return strings.Join(holders, ", ")
+}
+
+// Errors from grabbing a device that has only just appeared and isn't ready
+// yet, eg. while udev and BlueZ are still setting it up at boot
+func grabErrorTransient(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ENODEV, syscall.ENXIO, syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+			return true
+		}
+	}
+	return false
+}
+
+// How long a device whose grab timed out is left alone once the stuck grab
+// has returned, doubling with each further timeout up to the maximum
+const (
+	GRAB_TIMEOUT_BACKOFF     = 10 * time.Second
+	GRAB_TIMEOUT_BACKOFF_MAX = 5 * time.Minute
+)
+
+// Devices whose grab timed out. They aren't grabbed again while the stuck
+// grab is still running, so that rescans don't pile up more stuck grabs,
+// and then only after a backoff.
+type GrabTimeouts struct {
+	sync.Mutex
+	devices map[string]*grabTimeout
+}
+
+type grabTimeout struct {
+	stuck   bool
+	backoff time.Duration
+	retryAt time.Time
+}
+
+var StuckGrabs = NewGrabTimeouts()
+
+func NewGrabTimeouts() *GrabTimeouts {
+	return &GrabTimeouts{devices: make(map[string]*grabTimeout, 0)}
+}
+
+// Records that grabbing the device timed out
+func (g *GrabTimeouts) TimedOut(devnode string) {
+	g.Lock()
+	defer g.Unlock()
+	timeout, ok := g.devices[devnode]
+	if !ok {
+		timeout = &grabTimeout{backoff: GRAB_TIMEOUT_BACKOFF}
+		g.devices[devnode] = timeout
+	} else if timeout.backoff *= 2; timeout.backoff > GRAB_TIMEOUT_BACKOFF_MAX {
+		timeout.backoff = GRAB_TIMEOUT_BACKOFF_MAX
+	}
+	timeout.stuck = true
+}
+
+// Records that the stuck grab of the device has returned, starting the
+// backoff
+func (g *GrabTimeouts) Returned(devnode string, now time.Time) {
+	g.Lock()
+	defer g.Unlock()
+	if timeout, ok := g.devices[devnode]; ok {
+		timeout.stuck = false
+		timeout.retryAt = now.Add(timeout.backoff)
+	}
+}
+
+// Forgets the device's timeouts once it has been grabbed
+func (g *GrabTimeouts) Grabbed(devnode string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.devices, devnode)
+}
+
+// Returns true if the device may be grabbed: no grab of it is stuck and its
+// backoff has passed
+func (g *GrabTimeouts) Ready(devnode string, now time.Time) bool {
+	g.Lock()
+	defer g.Unlock()
+	timeout, ok := g.devices[devnode]
+	return !ok || (!timeout.stuck && !now.Before(timeout.retryAt))
+}
+
+// Grabs the device, giving up with ErrGrabTimeout if the grab doesn't return
+// within the timeout (zero for no timeout), eg. with a misbehaving driver. The
+// grab keeps going in the background and the device is closed once it
+// returns, which also releases it should it have succeeded, so the caller
+// must not close the device after a timeout. Until then the device is not
+// ready to be grabbed again (see StuckGrabs).
+func grabWithTimeout(dev *evdev.InputDevice, timeout time.Duration) error {
+	if timeout <= 0 {
+		return dev.Grab()
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- dev.Grab()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		StuckGrabs.TimedOut(dev.Fn)
+		go func() {
+			err := <-result
+			log.Infof("Timed out grab of %s (%s) returned (%v), closing it", dev.Name, dev.Fn, err)
+			dev.File.Close()
+			StuckGrabs.Returned(dev.Fn, time.Now())
+		}()
+		return ErrGrabTimeout
+	}
+}
+
+// Grabs the device exclusively. Transient failures are retried up to retries
+// times, waiting backoff before the first retry and twice as long before each
+// further one. If another process (eg. X or another capture tool) still has
+// the device grabbed after that, either gives up with ErrDeviceBusy or, if
+// wait is set, keeps retrying until the grab succeeds or the handler is
+// stopped. Each attempt is given up on after timeout (see grabWithTimeout).
+func GrabDevice(logger *log.Entry, dev *evdev.InputDevice, wait bool, retries int, backoff time.Duration, timeout time.Duration, close <-chan bool) error {
+	logged := false
+	for attempt := 1; ; attempt++ {
+		err := grabWithTimeout(dev, timeout)
+		if err == ErrGrabTimeout {
+			return fmt.Errorf("%w after %s", err, timeout)
+		}
+		if err == nil {
+			StuckGrabs.Grabbed(dev.Fn)
+			if attempt > 1 {
+				logger.Infof("Grabbed %s (%s) on attempt %d", dev.Name, dev.Fn, attempt)
+			}
+			return nil
+		}
+		if attempt <= retries && grabErrorTransient(err) {
+			logger.Warnf("Failed to grab %s (%s) on attempt %d of %d: %s, retrying in %s", dev.Name, dev.Fn, attempt, retries+1, err.Error(), backoff)
+			select {
+			case <-close:
+				return ErrGrabAborted
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			continue
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+		if !wait {
+			logger.Warnf("Device %s (%s) is grabbed by another process: %s, skipping it", dev.Name, dev.Fn, describeHolders(dev.Fn))
+			return ErrDeviceBusy
+		}
+		if !logged {
+			logger.Warnf("Device %s (%s) is grabbed by another process: %s, waiting for it to be released", dev.Name, dev.Fn, describeHolders(dev.Fn))
+			logged = true
+		}
+		select {
+		case <-close:
+			return ErrGrabAborted
+		case <-time.After(1000 * time.Millisecond):
+		}
+	}
+}
+
+// Tracks how long a device has been silent. A silent device is only probed,
+// since an idle keyboard is perfectly normal; it is restarted only if the
+// probe shows the handle no longer works.
+type SilenceWatchdog struct {
+	timeout time.Duration
+	last    time.Time
+}
+
+func NewSilenceWatchdog(timeout time.Duration) *SilenceWatchdog {
+	return &SilenceWatchdog{
+		timeout: timeout,
+		last:    time.Now(),
+	}
+}
+
+func (w *SilenceWatchdog) Kick() {
+	w.last = time.Now()
+}
+
+// Returns true once per timeout period of silence
+func (w *SilenceWatchdog) Expired() bool {
+	if w.timeout <= 0 || time.Since(w.last) < w.timeout {
+		return false
+	}
+	w.last = time.Now()
+	return true
+}
+
+// Checks that the open handle still refers to a working device: the driver
+// still answers ioctls and the device node hasn't been reused by another
+// device in the meantime.
+func ProbeDevice(dev *evdev.InputDevice) error {
+	var version int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.File.Fd(), uintptr(evdev.EVIOCGVERSION), uintptr(unsafe.Pointer(&version))); errno != 0 {
+		return errno
+	}
+	var opened, current syscall.Stat_t
+	if err := syscall.Fstat(int(dev.File.Fd()), &opened); err != nil {
+		return err
+	}
+	if err := syscall.Stat(dev.Fn, &current); err != nil {
+		return err
+	}
+	if opened.Rdev != current.Rdev {
+		return fmt.Errorf("device node %s now refers to another device", dev.Fn)
+	}
+	return nil
+}
+
+type ReadErrorKind int
+
+const (
+	READ_TIMEOUT     ReadErrorKind = iota // read deadline expired, poll again
+	READ_TRANSIENT                        // interrupted or would block, retry
+	READ_DEVICE_GONE                      // device disconnected, stop cleanly
+	READ_FATAL                            // anything else
+)
+
+// Classifies an error from reading an input device by the underlying errno.
+// End of file (the device node went away mid-read, eg. a Bluetooth keyboard
+// going out of range) counts as the device being gone.
+func ClassifyReadError(err error) ReadErrorKind {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return READ_TIMEOUT
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return READ_DEVICE_GONE
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EINTR, syscall.EAGAIN:
+			return READ_TRANSIENT
+		case syscall.ENODEV, syscall.ENXIO:
+			return READ_DEVICE_GONE
+		}
+	}
+	return READ_FATAL
+}
+
+// Watches the stop signal of a device handler. A signal interrupts the read
+// in progress by moving the read deadline to now, so the handler stops right
+// away rather than after its next event or read deadline.
+type StopWatcher struct {
+	stopped int32
+	done    chan struct{}
+}
+
+func WatchStop(close <-chan bool, dev *evdev.InputDevice) *StopWatcher {
+	w := &StopWatcher{done: make(chan struct{})}
+	go func() {
+		select {
+		case <-close:
+			atomic.StoreInt32(&w.stopped, 1)
+			dev.File.SetReadDeadline(time.Now())
+		case <-w.done:
+		}
+	}()
+	return w
+}
+
+// Returns true once the stop signal has been received. Checked after setting
+// the read deadline, a signal arriving later still interrupts the read.
+func (w *StopWatcher) Stopped() bool {
+	return atomic.LoadInt32(&w.stopped) != 0
+}
+
+// Stops watching, when the handler returns
+func (w *StopWatcher) Release() {
+	close(w.done)
+}
+
+// Returns the PIDs of other processes that have the given device node open
+func DeviceHolders(devnode string) []int {
+	holders := make([]int, 0)
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || target != devnode {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.Split(fd, "/")[2])
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		if len(holders) == 0 || holders[len(holders)-1] != pid {
+			holders = append(holders, pid)
+		}
+	}
+	return holders
+}
+
+func ProcessName(pid int) string {
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// Name other instances of the proxy have in /proc/<pid>/comm
+func proxyProcessName() string {
+	self := filepath.Base(os.Args[0])
+	if len(self) > 15 {
+		self = self[:15] // comm is truncated to TASK_COMM_LEN
+	}
+	return self
+}
+
+// Looks for earlier instances of the proxy that are still holding input
+// devices (eg. hung after a crash), which leaves those devices grabbed and
+// unusable until the stale process is stopped.
+func CheckStaleInstances() {
+	self := proxyProcessName()
+	devices, _ := filepath.Glob("/dev/input/event*")
+	for _, devnode := range devices {
+		for _, pid := range DeviceHolders(devnode) {
+			if ProcessName(pid) == self {
+				log.Warnf("Device %s is held by another %s instance (pid %d), it will stay grabbed until that process is stopped", devnode, self, pid)
+			}
+		}
+	}
+}
+
+// struct input_absinfo
+type AbsInfo struct {
+	Value      int32
+	Minimum    int32
+	Maximum    int32
+	Fuzz       int32
+	Flat       int32
+	Resolution int32
+}
+
+// Queries the range and current value of an absolute axis
+func GetAbsInfo(dev *evdev.InputDevice, axis int) (AbsInfo, error) {
+	info := AbsInfo{}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.File.Fd(), uintptr(evdev.EVIOCGABS(axis)), uintptr(unsafe.Pointer(&info))); errno != 0 {
+		return info, errno
+	}
+	return info, nil
+}
+
+// _IOW('E', 0x03, unsigned int[2]), sets the autorepeat delay and period
+const EVIOCSREP = 0x40084503
+
+// Sets the autorepeat rate (keys per second) and delay (ms) of the device.
+// Unlike evdev's SetRepeatRate this passes the values in the order the kernel
+// expects (delay, then period) and as 32 bit values on all architectures.
+func SetRepeat(dev *evdev.InputDevice, rate int, delay int) error {
+	repeat := [2]uint32{uint32(delay), uint32(1000 / rate)}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.File.Fd(), EVIOCSREP, uintptr(unsafe.Pointer(&repeat))); errno != 0 {
+		return errno
+	}
+	return nil
+}
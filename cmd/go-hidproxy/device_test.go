@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGrabTimeoutsBackoff(t *testing.T) {
+	g := NewGrabTimeouts()
+	now := time.Now()
+	dev := "/dev/input/event90"
+	if !g.Ready(dev, now) {
+		t.Fatal("new device not ready")
+	}
+
+	g.TimedOut(dev)
+	if g.Ready(dev, now.Add(time.Hour)) {
+		t.Error("ready while the grab is stuck")
+	}
+	g.Returned(dev, now)
+	if g.Ready(dev, now.Add(GRAB_TIMEOUT_BACKOFF-time.Second)) {
+		t.Error("ready before the backoff passed")
+	}
+	if !g.Ready(dev, now.Add(GRAB_TIMEOUT_BACKOFF)) {
+		t.Error("not ready after the backoff")
+	}
+
+	// Each further timeout doubles the backoff, up to the maximum
+	backoff := GRAB_TIMEOUT_BACKOFF
+	for i := 0; i < 10; i++ {
+		g.TimedOut(dev)
+		g.Returned(dev, now)
+		if backoff *= 2; backoff > GRAB_TIMEOUT_BACKOFF_MAX {
+			backoff = GRAB_TIMEOUT_BACKOFF_MAX
+		}
+		if g.Ready(dev, now.Add(backoff-time.Second)) || !g.Ready(dev, now.Add(backoff)) {
+			t.Errorf("timeout %d: not ready exactly after %s", i+2, backoff)
+		}
+	}
+
+	g.Grabbed(dev)
+	if !g.Ready(dev, now) {
+		t.Error("not ready after a successful grab")
+	}
+	if !g.Ready("/dev/input/event91", now) {
+		t.Error("other device not ready")
+	}
+}
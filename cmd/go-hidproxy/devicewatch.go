@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Directory the kernel (through udev) creates input device nodes in
+const INPUT_DEVICE_PATH = "/dev/input"
+
+// Delay after a change in the watched directories before rescanning, so
+// that the nodes and links udev creates for a device are all there
+const DEVICE_RESCAN_DELAY = 200 * time.Millisecond
+
+// Devices are rescanned this often even without changes in the watched
+// directories, in case a change was missed
+const DEVICE_RESCAN_INTERVAL = 30 * time.Second
+
+// Directories to watch for devices: /dev/input, and the directories of the
+// devices given with -device (eg. /dev/input/by-id)
+func deviceWatchDirs(specs []string) []string {
+	dirs := []string{INPUT_DEVICE_PATH, DEVICE_BY_ID_PATH}
+	for _, spec := range specs {
+		dirs = append(dirs, filepath.Dir(spec))
+	}
+	unique := make([]string, 0, len(dirs))
+	seen := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			unique = append(unique, dir)
+			seen[dir] = true
+		}
+	}
+	return unique
+}
+
+// Watches the directories devices appear in and signals on the returned
+// channel once the changes have settled, so devices are rescanned when they
+// come and go instead of on a timer. Directories that don't exist yet are
+// watched once they are created in a watched directory (eg. by-id in
+// /dev/input).
+func WatchInputDevices(specs []string) (<-chan bool, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := deviceWatchDirs(specs)
+	wanted := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		wanted[dir] = true
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	changed := make(chan bool, 1)
+	go func() {
+		defer watcher.Close()
+		var settled <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Create != 0 && wanted[filepath.Clean(event.Name)] {
+					if err := watcher.Add(event.Name); err != nil {
+						log.Warnf("Failed to watch %s: %s", event.Name, err.Error())
+					}
+				}
+				settled = time.After(DEVICE_RESCAN_DELAY)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("Error watching for input devices: %s", err.Error())
+			case <-settled:
+				settled = nil
+				select {
+				case changed <- true:
+				default:
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
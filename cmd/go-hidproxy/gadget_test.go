@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSetupUSBGadget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hidproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gadget := DefaultConfig().Gadget
+	gadget.SystemControl = true
+	gadget.ConsumerControl = true
+	// Runs twice, the second time over the existing tree
+	for run := 0; run < 2; run++ {
+		SetupUSBGadget(dir, gadget, 0, false)
+	}
+
+	base := filepath.Join(dir, gadget.Name)
+	config := filepath.Join(base, "configs", gadget.ConfigName)
+	files := map[string]string{
+		"idVendor":                   gadget.IdVendor,
+		"idProduct":                  gadget.IdProduct,
+		"bcdDevice":                  gadget.BcdDevice,
+		"bcdUSB":                     gadget.BcdUSB,
+		"bDeviceClass":               gadget.DeviceClass,
+		"os_desc/use":                "1",
+		"os_desc/qw_sign":            "MSFT100",
+		"strings/0x409/serialnumber": gadget.SerialNumber,
+		"strings/0x409/manufacturer": gadget.Manufacturer,
+		"strings/0x409/product":      gadget.Product,
+		"configs/c.1/strings/0x409/configuration": gadget.Configuration,
+		"configs/c.1/MaxPower":                    gadget.MaxPower,
+		"functions/hid.usb0/protocol":             "1",
+		"functions/hid.usb0/subclass":             "1",
+		"functions/hid.usb0/report_length":        "8",
+		"functions/hid.usb1/protocol":             "2",
+		"functions/hid.usb1/subclass":             "1",
+		"functions/hid.usb2/protocol":             "0",
+		"functions/hid.usb3/report_length":        "2",
+	}
+	for name, want := range files {
+		content, err := ioutil.ReadFile(filepath.Join(base, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+		} else if string(content) != want {
+			t.Errorf("%s: got %q, want %q", name, content, want)
+		}
+	}
+
+	descriptors := map[string][]byte{
+		"functions/hid.usb0/report_desc": KeyboardReportDescriptor(gadget.KeyboardReportId),
+		"functions/hid.usb1/report_desc": MouseReportDescriptor(),
+		"functions/hid.usb2/report_desc": SystemControlReportDescriptor(),
+		"functions/hid.usb3/report_desc": ConsumerControlReportDescriptor(),
+	}
+	for name, want := range descriptors {
+		content, err := ioutil.ReadFile(filepath.Join(base, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+		} else if !bytes.Equal(content, want) {
+			t.Errorf("%s: got % x, want % x", name, content, want)
+		}
+	}
+
+	for _, function := range []string{"hid.usb0", "hid.usb1", "hid.usb2", "hid.usb3"} {
+		target, err := os.Readlink(filepath.Join(config, function))
+		if err != nil {
+			t.Errorf("%s not linked into the configuration: %s", function, err.Error())
+		} else if target != filepath.Join(base, "functions", function) {
+			t.Errorf("%s linked to %s", function, target)
+		}
+	}
+}
+
+func TestSetupUSBGadgetUnbindsToUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hidproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer atomic.StoreInt32(&gadgetBound, 1)
+	gadget := DefaultConfig().Gadget
+	SetupUSBGadget(dir, gadget, 0, false)
+
+	base := filepath.Join(dir, gadget.Name)
+	udc := filepath.Join(base, "UDC")
+	if err := ioutil.WriteFile(udc, []byte("fe980000.usb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged, stays bound
+	SetupUSBGadget(dir, gadget, 0, false)
+	if bound := BoundUDC(dir, gadget.Name); bound != "fe980000.usb" {
+		t.Fatalf("unchanged gadget unbound, UDC %q", bound)
+	}
+	// Configfs reads the numbers back in its own format, which isn't a change
+	readback := map[string]string{
+		"idVendor":        "0x1d6b\n",
+		"idProduct":       "0x0104\n",
+		"bcdDevice":       "0x0100\n",
+		"bDeviceClass":    "0xef\n",
+		"bDeviceSubClass": "0x02\n",
+		"MaxPower":        "250\n",
+	}
+	for name, content := range readback {
+		if err := ioutil.WriteFile(filepath.Join(base, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetupUSBGadget(dir, gadget, 0, false)
+	if bound := BoundUDC(dir, gadget.Name); bound != "fe980000.usb" {
+		t.Fatalf("gadget read back in the kernel's format unbound, UDC %q", bound)
+	}
+
+	gadget.IdProduct = "0x0105"
+	SetupUSBGadget(dir, gadget, 0, false)
+	if bound := BoundUDC(dir, gadget.Name); bound != "" {
+		t.Errorf("changed gadget still bound to %q", bound)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(base, "idProduct"))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(content) != gadget.IdProduct {
+		t.Errorf("idProduct %q, want %q", content, gadget.IdProduct)
+	}
+}
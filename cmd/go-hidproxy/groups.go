@@ -0,0 +1,183 @@
+package main
+
+// Sibling input devices of one physical keyboard. Many keyboards show up as
+// several event nodes, eg. one for the normal keys, one for consumer control
+// (media keys) and one for system control (power keys), all handled as
+// keyboards.
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// What a keyboard node is for, from the keys it has
+type KeyboardRole string
+
+const (
+	ROLE_KEYS     KeyboardRole = "keys"
+	ROLE_CONSUMER KeyboardRole = "consumer"
+	ROLE_SYSTEM   KeyboardRole = "system"
+)
+
+var physInputSuffix = regexp.MustCompile(`/input[0-9]+$`)
+
+// Physical path of the device, eg. usb-3f980000.usb-1/input0
+func DevicePhys(devnode string) string {
+	phys, err := ioutil.ReadFile(filepath.Join("/sys/class/input", filepath.Base(devnode), "device/phys"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(phys))
+}
+
+// Key shared by the event nodes of the same physical device: the identity
+// and the unique ID (the address, for Bluetooth devices), or the physical
+// path without the interface if there is no unique ID. Empty if the device
+// can't be told apart from others.
+func DeviceGroupKey(dev *evdev.InputDevice) string {
+	if uniq := DeviceUniq(dev.Fn); uniq != "" {
+		return DeviceIdentity(dev) + "/" + strings.ToLower(uniq)
+	}
+	if phys := DevicePhys(dev.Fn); phys != "" {
+		return DeviceIdentity(dev) + "/" + physInputSuffix.ReplaceAllString(phys, "")
+	}
+	return ""
+}
+
+// Tells the nodes of a keyboard apart: the one with letter keys, the one with
+// only the power, sleep and wake up keys and the one with the rest (media
+// keys and the like)
+func ClassifyKeyboardRole(dev *evdev.InputDevice) KeyboardRole {
+	caps := capabilitiesOf(dev)
+	if caps.has(evdev.EV_KEY, evdev.KEY_A, evdev.KEY_Q, evdev.KEY_SPACE) {
+		return ROLE_KEYS
+	}
+	for code := range caps[evdev.EV_KEY] {
+		if _, ok := SystemControlKeys[uint16(code)]; !ok {
+			return ROLE_CONSUMER
+		}
+	}
+	return ROLE_SYSTEM
+}
+
+// Reports a key can be sent in, named like the report types
+const (
+	ROUTE_KEYBOARD = "keyboard"
+	ROUTE_CONSUMER = "consumer"
+	ROUTE_SYSTEM   = "system"
+)
+
+// Picks the report for a key from the role of the node it came from. Power
+// keys go to the system control report from any node, as hosts ignore them
+// in keyboard reports. Media keys go to the consumer control report only from
+// the consumer control node; on the main node they stay in keyboard reports,
+// so that they combine with the modifiers held there. Keys for a report the
+// gadget doesn't have go to the keyboard report.
+func RouteKey(role KeyboardRole, code uint16, system bool, consumer bool) string {
+	if _, ok := SystemControlKeys[code]; ok && system {
+		return ROUTE_SYSTEM
+	}
+	if _, ok := ConsumerKeys[code]; ok && consumer && role == ROLE_CONSUMER {
+		return ROUTE_CONSUMER
+	}
+	return ROUTE_KEYBOARD
+}
+
+// Keys held on each node of a physical keyboard. Keyboard reports describe
+// every key held, so each node's reports have to include the keys held on
+// its siblings; otherwise eg. a media key on the consumer control node would
+// release a modifier held on the main node.
+type KeyboardGroup struct {
+	sync.Mutex
+	key  string
+	held map[string][]uint16
+}
+
+var keyboardGroups = struct {
+	sync.Mutex
+	groups map[string]*KeyboardGroup
+}{groups: make(map[string]*KeyboardGroup, 0)}
+
+// Returns the group of the device's siblings, joining it. Devices that can't
+// be grouped get a group of their own.
+func JoinKeyboardGroup(dev *evdev.InputDevice) *KeyboardGroup {
+	key := DeviceGroupKey(dev)
+	if key == "" {
+		return &KeyboardGroup{held: make(map[string][]uint16, 0)}
+	}
+	keyboardGroups.Lock()
+	defer keyboardGroups.Unlock()
+	group, ok := keyboardGroups.groups[key]
+	if !ok {
+		group = &KeyboardGroup{key: key, held: make(map[string][]uint16, 0)}
+		keyboardGroups.groups[key] = group
+	}
+	group.Lock()
+	group.held[dev.Fn] = nil
+	group.Unlock()
+	return group
+}
+
+// Sets the keys held on the node and returns the keys held on the whole
+// group, the node's own keys first
+func (g *KeyboardGroup) Set(node string, keys []uint16) []uint16 {
+	g.Lock()
+	defer g.Unlock()
+	g.held[node] = append([]uint16{}, keys...)
+	all := append([]uint16{}, keys...)
+	nodes := make([]string, 0, len(g.held))
+	for other := range g.held {
+		nodes = append(nodes, other)
+	}
+	sort.Strings(nodes)
+	for _, other := range nodes {
+		if other == node {
+			continue
+		}
+		for _, key := range g.held[other] {
+			found := false
+			for _, k := range all {
+				if k == key {
+					found = true
+					break
+				}
+			}
+			if !found {
+				all = append(all, key)
+			}
+		}
+	}
+	return all
+}
+
+// Other nodes in the group
+func (g *KeyboardGroup) Siblings(node string) []string {
+	g.Lock()
+	defer g.Unlock()
+	siblings := make([]string, 0)
+	for other := range g.held {
+		if other != node {
+			siblings = append(siblings, other)
+		}
+	}
+	sort.Strings(siblings)
+	return siblings
+}
+
+// Removes the node from the group, dropping the group once it is empty
+func (g *KeyboardGroup) Leave(node string) {
+	keyboardGroups.Lock()
+	defer keyboardGroups.Unlock()
+	g.Lock()
+	delete(g.held, node)
+	empty := len(g.held) == 0
+	g.Unlock()
+	if empty && g.key != "" && keyboardGroups.groups[g.key] == g {
+		delete(keyboardGroups.groups, g.key)
+	}
+}
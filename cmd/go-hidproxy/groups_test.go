@@ -0,0 +1,94 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"reflect"
+	"testing"
+)
+
+func TestClassifyKeyboardRole(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []int
+		want KeyboardRole
+	}{
+		{"keys", []int{evdev.KEY_A, evdev.KEY_Q, evdev.KEY_SPACE, evdev.KEY_MUTE}, ROLE_KEYS},
+		{"consumer", []int{evdev.KEY_MUTE, evdev.KEY_VOLUMEUP, evdev.KEY_POWER}, ROLE_CONSUMER},
+		{"system", []int{evdev.KEY_POWER, evdev.KEY_SLEEP, evdev.KEY_WAKEUP}, ROLE_SYSTEM},
+	}
+	for _, test := range tests {
+		dev := deviceWithCapabilities(test.name, map[int][]int{evdev.EV_KEY: test.keys})
+		if got := ClassifyKeyboardRole(dev); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	tests := []struct {
+		role     KeyboardRole
+		code     uint16
+		system   bool
+		consumer bool
+		want     string
+	}{
+		{ROLE_CONSUMER, evdev.KEY_VOLUMEUP, true, true, ROUTE_CONSUMER},
+		{ROLE_CONSUMER, evdev.KEY_VOLUMEUP, true, false, ROUTE_KEYBOARD},
+		// Media keys on the main node stay with its modifiers
+		{ROLE_KEYS, evdev.KEY_VOLUMEUP, true, true, ROUTE_KEYBOARD},
+		{ROLE_KEYS, evdev.KEY_A, true, true, ROUTE_KEYBOARD},
+		{ROLE_CONSUMER, evdev.KEY_A, true, true, ROUTE_KEYBOARD},
+		{ROLE_SYSTEM, evdev.KEY_POWER, true, true, ROUTE_SYSTEM},
+		{ROLE_KEYS, evdev.KEY_POWER, true, true, ROUTE_SYSTEM},
+		{ROLE_CONSUMER, evdev.KEY_POWER, true, true, ROUTE_SYSTEM},
+		{ROLE_SYSTEM, evdev.KEY_POWER, false, true, ROUTE_KEYBOARD},
+	}
+	for _, test := range tests {
+		if got := RouteKey(test.role, test.code, test.system, test.consumer); got != test.want {
+			t.Errorf("%s node, %s (system %v, consumer %v): got %s, want %s", test.role, evdev.KEY[int(test.code)], test.system, test.consumer, got, test.want)
+		}
+	}
+}
+
+func TestConsumerKeyCodes(t *testing.T) {
+	names := map[string]uint16{
+		"KEY_MUTE":           0xe2,
+		"KEY_VOLUMEDOWN":     0xea,
+		"KEY_VOLUMEUP":       0xe9,
+		"KEY_CALC":           0x192,
+		"KEY_MAIL":           0x18a,
+		"KEY_BACK":           0x224,
+		"KEY_FORWARD":        0x225,
+		"KEY_EJECTCD":        0xb8,
+		"KEY_NEXTSONG":       0xb5,
+		"KEY_PLAYPAUSE":      0xcd,
+		"KEY_PREVIOUSSONG":   0xb6,
+		"KEY_STOPCD":         0xb7,
+		"KEY_HOMEPAGE":       0x223,
+		"KEY_PLAYCD":         0xb0,
+		"KEY_PAUSECD":        0xb1,
+		"KEY_SEARCH":         0x221,
+		"KEY_BRIGHTNESSDOWN": 0x70,
+		"KEY_BRIGHTNESSUP":   0x6f,
+	}
+	want := make(map[uint16]uint16, len(names))
+	for name, usage := range names {
+		code, ok := KeyCode(name)
+		if !ok {
+			t.Fatalf("unknown key %s", name)
+		}
+		want[code] = usage
+	}
+	if !reflect.DeepEqual(ConsumerKeys, want) {
+		t.Errorf("got %v, want %v", ConsumerKeys, want)
+	}
+}
+
+func TestConsumerControlReport(t *testing.T) {
+	if got := BuildConsumerControlReport(0x223); !reflect.DeepEqual(got, []uint8{0x23, 0x02}) {
+		t.Errorf("got % x, want 23 02", got)
+	}
+	if got := BuildConsumerControlReport(0); !reflect.DeepEqual(got, []uint8{0, 0}) {
+		t.Errorf("got % x, want 00 00", got)
+	}
+}
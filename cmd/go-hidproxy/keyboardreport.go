@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Number of key slots in a boot protocol keyboard report
+const BOOT_KEY_SLOTS = 6
+
+// Usage filling all key slots when more keys are held than there are slots
+// (ErrorRollOver), so the host knows the report is incomplete rather than
+// seeing some of the keys released
+const USAGE_ERROR_ROLLOVER = 0x01
+
+// Layout of the keyboard report: modifiers, a reserved byte and the key
+// array, which are boot compatible with the default 6 slots, optionally
+// followed by a bitmap with a bit for each of a set of keys. Keys in the
+// bitmap don't take up key slots, so they can be chorded with any number of
+// other keys, but hosts using the boot protocol (eg. BIOS setup) don't see
+// them.
+type KeyboardLayout struct {
+	KeySlots int
+	// HID usages reported in the bitmap, in bit order
+	Bitmap []uint16
+	// Bit of each usage in Bitmap
+	bitIndex map[uint16]int
+}
+
+var Keyboard = KeyboardLayout{KeySlots: BOOT_KEY_SLOTS}
+
+// Builds the layout from the number of key slots and the evdev names of the
+// keys to report in the bitmap
+func ParseKeyboardLayout(slots int, bitmap []string, keymap *Keymap) (KeyboardLayout, error) {
+	layout := KeyboardLayout{KeySlots: slots}
+	if slots < 1 || slots > 64 {
+		return layout, fmt.Errorf("key slots must be between 1 and 64, got %d", slots)
+	}
+	layout.bitIndex = make(map[uint16]int, len(bitmap))
+	for _, name := range bitmap {
+		code, ok := KeyCode(name)
+		if !ok {
+			return layout, fmt.Errorf("unknown key: %s", name)
+		}
+		usage, ok := keymap.Lookup(code)
+		if !ok {
+			return layout, fmt.Errorf("key %s has no HID usage", name)
+		}
+		if usage >= USAGE_LEFT_CONTROL && usage <= USAGE_LEFT_CONTROL+7 {
+			return layout, fmt.Errorf("modifier %s can't be in the key bitmap", name)
+		}
+		if _, ok := layout.bitIndex[usage]; !ok {
+			layout.bitIndex[usage] = len(layout.Bitmap)
+			layout.Bitmap = append(layout.Bitmap, usage)
+		}
+	}
+	return layout, nil
+}
+
+func (l KeyboardLayout) bitmapBytes() int {
+	return (len(l.Bitmap) + 7) / 8
+}
+
+// Returns true if reports (with the given report ID, 0 for none) start with a
+// boot protocol report, so hosts that switched the keyboard to the boot
+// protocol with SET_PROTOCOL (eg. a BIOS) read the keys in the first 6 slots
+// correctly. The gadget driver answers SET_PROTOCOL itself without telling us,
+// so the reports can't be adapted to the protocol the host selected.
+func (l KeyboardLayout) BootCompatible(reportId uint8) bool {
+	return reportId == 0 && l.KeySlots >= BOOT_KEY_SLOTS
+}
+
+// Length of the report, without a report ID
+func (l KeyboardLayout) ReportLength() int {
+	return 2 + l.KeySlots + l.bitmapBytes()
+}
+
+// Generates the report descriptor for the layout, with the report ID item
+// if the ID is non-zero
+func (l KeyboardLayout) Descriptor(reportId uint8) []byte {
+	d := NewDescriptor().
+		UsagePage(USAGE_PAGE_GENERIC_DESKTOP).
+		Usage(0x06). // Keyboard
+		Collection(COLLECTION_APPLICATION).
+		ReportId(reportId).
+		// Modifiers, Left Control to Right GUI
+		UsagePage(USAGE_PAGE_KEYBOARD).
+		UsageMinimum(USAGE_LEFT_CONTROL).
+		UsageMaximum(USAGE_LEFT_CONTROL + 7).
+		LogicalMinimum(0).
+		LogicalMaximum(1).
+		ReportSize(1).
+		ReportCount(8).
+		Input(HID_DATA | HID_VARIABLE | HID_ABSOLUTE).
+		// Reserved byte
+		ReportCount(1).
+		ReportSize(8).
+		Input(HID_CONSTANT | HID_VARIABLE).
+		// LEDs, Num Lock to Kana, padded to a byte
+		ReportCount(5).
+		ReportSize(1).
+		UsagePage(USAGE_PAGE_LEDS).
+		UsageMinimum(0x01).
+		UsageMaximum(0x05).
+		Output(HID_DATA | HID_VARIABLE | HID_ABSOLUTE).
+		ReportCount(1).
+		ReportSize(3).
+		Output(HID_CONSTANT | HID_VARIABLE).
+		// Key slots
+		ReportCount(uint8(l.KeySlots)).
+		ReportSize(8).
+		LogicalMinimum(0).
+		LogicalMaximum(0x65).
+		UsagePage(USAGE_PAGE_KEYBOARD).
+		UsageMinimum(0).
+		UsageMaximum(0x65).
+		Input(HID_DATA | HID_ARRAY)
+	if len(l.Bitmap) > 0 {
+		d.UsagePage(USAGE_PAGE_KEYBOARD).
+			LogicalMinimum(0).
+			LogicalMaximum(1).
+			ReportSize(1).
+			ReportCount(uint8(len(l.Bitmap)))
+		for _, usage := range l.Bitmap {
+			d.Usage(usage)
+		}
+		d.Input(HID_DATA | HID_VARIABLE | HID_ABSOLUTE)
+		if padding := l.bitmapBytes()*8 - len(l.Bitmap); padding > 0 {
+			d.Padding(uint8(padding))
+		}
+	}
+	return d.EndCollection().Bytes()
+}
+
+// Builds a report from the HID usages of the keys currently held down. If
+// more keys need a slot than there are slots, every slot is set to
+// USAGE_ERROR_ROLLOVER as the HID spec asks; modifiers and bitmap keys are
+// still reported.
+func (l KeyboardLayout) Build(keysDown []uint16) []uint8 {
+	report := make([]uint8, l.ReportLength())
+	slot := 0
+	for _, k := range keysDown {
+		if bit, ok := Modifiers[k]; ok {
+			report[0] |= bit
+		} else if i, ok := l.bitIndex[k]; ok {
+			report[2+l.KeySlots+i/8] |= 1 << (i % 8)
+		} else if slot < l.KeySlots {
+			report[2+slot] = uint8(k)
+			slot += 1
+		} else {
+			for i := 0; i < l.KeySlots; i++ {
+				report[2+i] = USAGE_ERROR_ROLLOVER
+			}
+		}
+	}
+	return report
+}
+
+// Returns true if the report's key slots signal a rollover error, in which
+// case the keys held before are still held
+func (l KeyboardLayout) RolledOver(report []uint8) bool {
+	return len(report) >= 2+l.KeySlots && report[2] == USAGE_ERROR_ROLLOVER
+}
+
+// Returns the HID usages of the keys (not including modifiers) in a report,
+// leaving out the slots of a rollover error
+func (l KeyboardLayout) Keys(report []uint8) []uint16 {
+	keys := make([]uint16, 0)
+	for i := 2; i < len(report) && i < 2+l.KeySlots; i++ {
+		if report[i] != 0 && report[i] != USAGE_ERROR_ROLLOVER {
+			keys = append(keys, uint16(report[i]))
+		}
+	}
+	for i, usage := range l.Bitmap {
+		if n := 2 + l.KeySlots + i/8; n < len(report) && report[n]&(1<<(i%8)) != 0 {
+			keys = append(keys, usage)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyboardReportRollover(t *testing.T) {
+	layout := KeyboardLayout{KeySlots: BOOT_KEY_SLOTS}
+	shift := uint16(USAGE_LEFT_CONTROL + 1)
+	tests := []struct {
+		keys     []uint16
+		want     []byte
+		rollover bool
+	}{
+		{[]uint16{0x04, 0x05, 0x06, 0x07, 0x08, 0x09}, []byte{0, 0, 4, 5, 6, 7, 8, 9}, false},
+		{[]uint16{0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a}, []byte{0, 0, 1, 1, 1, 1, 1, 1}, true},
+		// Modifiers don't take a slot and are still reported on rollover
+		{[]uint16{shift, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}, []byte{2, 0, 4, 5, 6, 7, 8, 9}, false},
+		{[]uint16{0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, shift}, []byte{2, 0, 1, 1, 1, 1, 1, 1}, true},
+	}
+	for _, test := range tests {
+		report := layout.Build(test.keys)
+		if !bytes.Equal(report, test.want) {
+			t.Errorf("%v: got %v, want %v", test.keys, report, test.want)
+		}
+		if layout.RolledOver(report) != test.rollover {
+			t.Errorf("%v: rolled over %t, want %t", test.keys, layout.RolledOver(report), test.rollover)
+		}
+	}
+	if keys := layout.Keys(layout.Build([]uint16{0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a})); len(keys) != 0 {
+		t.Errorf("got keys %v from a rollover report, want none", keys)
+	}
+}
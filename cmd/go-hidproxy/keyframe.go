@@ -0,0 +1,92 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/loov/hrtime"
+	"time"
+)
+
+// Decides when a keyboard's key changes go out: with the SYN_REPORT that ends
+// the evdev frame they came in, so that keys changing together (eg. a key and
+// the modifier a keyboard sends with it) reach the host in one report without
+// the order they came in, or with a chord window, once the window after the
+// first change has passed, with the keys held by then
+type KeyFrame struct {
+	window  time.Duration
+	due     time.Time
+	changed bool
+	// When the first change since the last report came in, for its latency
+	since time.Duration
+}
+
+func NewKeyFrame(window time.Duration) *KeyFrame {
+	return &KeyFrame{window: window}
+}
+
+// Steps the frame through an event of the keyboard. A key event, with the HID
+// usage of the key, changes the keys held and is recorded as a change (key
+// repeats too, so that the host sees the key still held); a SYN_REPORT ends
+// the evdev frame. Returns the keys held and true if a report with them is
+// due. Reports due at the end of a chord window are found with Due instead.
+func (f *KeyFrame) Step(keysDown []uint16, event *evdev.InputEvent, usage uint16, now time.Time) ([]uint16, bool) {
+	switch event.Type {
+	case evdev.EV_KEY:
+		switch event.Value {
+		case 1: // Key down
+			keysDown = withKey(keysDown, usage)
+		case 0: // Key up
+			keysDown = withoutKey(keysDown, usage)
+		}
+		f.Change(now)
+	case evdev.EV_SYN:
+		return keysDown, event.Code == evdev.SYN_REPORT && f.Sync()
+	}
+	return keysDown, false
+}
+
+// Records a key change
+func (f *KeyFrame) Change(now time.Time) {
+	if f.due.IsZero() && !f.changed {
+		f.since = hrtime.Now()
+	}
+	if f.window > 0 {
+		if f.due.IsZero() {
+			f.due = now.Add(f.window)
+		}
+	} else {
+		f.changed = true
+	}
+}
+
+// Ends the evdev frame on SYN_REPORT, returns true if keys changed in it and
+// the report is due
+func (f *KeyFrame) Sync() bool {
+	changed := f.changed
+	f.changed = false
+	return changed
+}
+
+// Returns true once the chord window after the first change has passed
+func (f *KeyFrame) Due(now time.Time) bool {
+	return !f.due.IsZero() && !now.Before(f.due)
+}
+
+// Returns the read deadline, moved up to the end of the chord window if that
+// is earlier
+func (f *KeyFrame) Deadline(deadline time.Time) time.Time {
+	if !f.due.IsZero() && f.due.Before(deadline) {
+		return f.due
+	}
+	return deadline
+}
+
+// When the first change since the last report came in
+func (f *KeyFrame) Since() time.Duration {
+	return f.since
+}
+
+// Starts over once a report with the keys held is sent
+func (f *KeyFrame) Sent() {
+	f.due = time.Time{}
+	f.changed = false
+}
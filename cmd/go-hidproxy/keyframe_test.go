@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	evdev "github.com/gvalkov/golang-evdev"
+	"testing"
+	"time"
+)
+
+// Steps a key frame through key events (value 1 for down, 0 for up) and
+// SYN_REPORTs, returning the reports sent
+func feedKeyFrame(frame *KeyFrame, events []evdev.InputEvent) [][]byte {
+	reports := make([][]byte, 0)
+	keys := make([]uint16, 0)
+	now := time.Now()
+	for i := range events {
+		if frame.Due(now) {
+			frame.Sent()
+			reports = append(reports, BuildKeyboardReport(keys))
+		}
+		var due bool
+		keys, due = frame.Step(keys, &events[i], Scancodes[events[i].Code], now)
+		if due {
+			frame.Sent()
+			reports = append(reports, BuildKeyboardReport(keys))
+		}
+	}
+	return reports
+}
+
+func TestKeyFrameOneReportPerFrame(t *testing.T) {
+	syn := evdev.InputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT}
+	events := []evdev.InputEvent{
+		{Type: evdev.EV_KEY, Code: evdev.KEY_LEFTSHIFT, Value: 1},
+		{Type: evdev.EV_KEY, Code: evdev.KEY_A, Value: 1},
+		syn,
+		{Type: evdev.EV_KEY, Code: evdev.KEY_A, Value: 0},
+		{Type: evdev.EV_KEY, Code: evdev.KEY_LEFTSHIFT, Value: 0},
+		syn,
+		// A frame without key changes sends nothing
+		syn,
+	}
+	reports := feedKeyFrame(NewKeyFrame(0), events)
+	want := [][]byte{
+		BuildKeyboardReport([]uint16{Scancodes[evdev.KEY_LEFTSHIFT], Scancodes[evdev.KEY_A]}),
+		BuildKeyboardReport(nil),
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("got %d reports, want one per frame: %v", len(reports), reports)
+	}
+	for i := range want {
+		if !bytes.Equal(reports[i], want[i]) {
+			t.Errorf("report %d: got %v, want %v", i, reports[i], want[i])
+		}
+	}
+	if reports[0][0] != 0x02 || reports[0][2] != 0x04 {
+		t.Errorf("got %v, want shift and A together", reports[0])
+	}
+}
+
+func TestKeyFrameRepeatResendsKeys(t *testing.T) {
+	syn := evdev.InputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT}
+	events := []evdev.InputEvent{
+		{Type: evdev.EV_KEY, Code: evdev.KEY_A, Value: 1},
+		syn,
+		{Type: evdev.EV_KEY, Code: evdev.KEY_A, Value: 2},
+		syn,
+	}
+	reports := feedKeyFrame(NewKeyFrame(0), events)
+	held := BuildKeyboardReport([]uint16{Scancodes[evdev.KEY_A]})
+	if len(reports) != 2 || !bytes.Equal(reports[0], held) || !bytes.Equal(reports[1], held) {
+		t.Errorf("got %v, want A held in both reports", reports)
+	}
+}
+
+func TestKeyFrameChordWindow(t *testing.T) {
+	frame := NewKeyFrame(20 * time.Millisecond)
+	start := time.Now()
+	keys, _ := frame.Step(nil, &evdev.InputEvent{Type: evdev.EV_KEY, Code: evdev.KEY_LEFTCTRL, Value: 1}, Scancodes[evdev.KEY_LEFTCTRL], start)
+	keys, _ = frame.Step(keys, &evdev.InputEvent{Type: evdev.EV_KEY, Code: evdev.KEY_C, Value: 1}, Scancodes[evdev.KEY_C], start.Add(10*time.Millisecond))
+	if _, due := frame.Step(keys, &evdev.InputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT}, 0, start.Add(10*time.Millisecond)); due {
+		t.Error("report sent with the frame inside the chord window")
+	}
+	if len(keys) != 2 {
+		t.Errorf("got keys %v, want both keys of the chord held", keys)
+	}
+	if frame.Due(start.Add(19 * time.Millisecond)) {
+		t.Error("report due before the chord window passed")
+	}
+	if deadline := frame.Deadline(start.Add(time.Second)); !deadline.Equal(start.Add(20 * time.Millisecond)) {
+		t.Errorf("got a read deadline %s after the first change, want the end of the window", deadline.Sub(start))
+	}
+	if !frame.Due(start.Add(20 * time.Millisecond)) {
+		t.Error("report not due once the chord window passed")
+	}
+	frame.Sent()
+	if frame.Due(start.Add(time.Second)) {
+		t.Error("report due again after it was sent")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KEYMAP_RELOAD_DELAY = 100 * time.Millisecond
+
+// Names of the keys with the given HID usages, by their evdev names
+func (k *Keymap) UsageNames(usages []uint16) []string {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	names := make([]string, 0, len(usages))
+	for _, usage := range usages {
+		name := fmt.Sprintf("0x%02x", usage)
+		for code, u := range k.usages {
+			if u == usage && evdev.KEY[int(code)] != "" {
+				name = evdev.KEY[int(code)]
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// Applies the remappings in a hwdb file to the table, replacing the ones
+// applied before
+func (k *Keymap) LoadRemappings(hwdb string) error {
+	scancodes := k.Base()
+	applied, err := LoadHwdb(hwdb, scancodes)
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	k.usages = scancodes
+	k.lock.Unlock()
+	log.Infof("Applied %d keyboard remappings from %s", applied, hwdb)
+	return nil
+}
+
+// Reloads the remappings whenever the hwdb file changes. The directory is
+// watched rather than the file, since editors usually replace the file. If
+// the file fails to load, the previous remappings stay in use.
+func (k *Keymap) WatchRemappings(hwdb string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(hwdb)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(hwdb) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				// Wait for the writes to settle before reloading
+				reload = time.After(KEYMAP_RELOAD_DELAY)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("Error watching %s: %s", hwdb, err.Error())
+			case <-reload:
+				reload = nil
+				if err := k.LoadRemappings(hwdb); err != nil {
+					log.Errorf("Failed to reload keyboard mappings from %s, keeping the previous ones: %s", hwdb, err.Error())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Applies the keyboard remappings from a udev hwdb file (eg. from
+// /etc/udev/hwdb.d/) to the scancode table, the same way udev would have the
+// kernel apply them on a host:
+//
+//	evdev:input:b0005v*
+//	 KEYBOARD_KEY_70039=leftctrl
+//
+// Scancodes on the keyboard usage page (0x7xxxx) are matched by their HID
+// usage, scancodes below 0x80 are taken to be AT set 1 scancodes, which are
+// equal to the evdev key codes. The device match lines are not evaluated, all
+// remappings in the file apply to every keyboard. Returns the number of
+// remappings applied.
+func LoadHwdb(path string, scancodes map[uint16]uint16) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// Scancodes and targets are looked up in the table as it was before any
+	// of the remappings, so that eg. swapping two keys works
+	base := make(map[uint16]uint16, len(scancodes))
+	usageCodes := make(map[uint16]uint16, len(scancodes))
+	for code, usage := range scancodes {
+		base[code] = usage
+		usageCodes[usage] = code
+	}
+
+	applied := 0
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "KEYBOARD_KEY_") {
+			if !strings.Contains(line, "=") {
+				log.Debugf("%s:%d: match %s (applied to all devices)", path, lineNo, line)
+			}
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, "KEYBOARD_KEY_"), "=", 2)
+		if len(kv) != 2 {
+			return applied, fmt.Errorf("%s:%d: invalid line: %s", path, lineNo, line)
+		}
+		scancode, err := strconv.ParseUint(kv[0], 16, 32)
+		if err != nil {
+			return applied, fmt.Errorf("%s:%d: invalid scancode: %s", path, lineNo, kv[0])
+		}
+
+		var code uint16
+		switch {
+		case scancode&0xffff0000 == 0x70000:
+			var ok bool
+			code, ok = usageCodes[uint16(scancode&0xffff)]
+			if !ok {
+				log.Warnf("%s:%d: no key for HID usage 0x%x, skipping", path, lineNo, scancode&0xffff)
+				continue
+			}
+		case scancode < 0x80:
+			code = uint16(scancode)
+		default:
+			log.Warnf("%s:%d: unsupported scancode 0x%x, skipping", path, lineNo, scancode)
+			continue
+		}
+
+		keyName := strings.TrimSpace(kv[1])
+		if keyName == "reserved" {
+			delete(scancodes, code)
+			applied += 1
+			continue
+		}
+		target, ok := KeyCode("KEY_" + strings.ToUpper(keyName))
+		if !ok {
+			return applied, fmt.Errorf("%s:%d: unknown key: %s", path, lineNo, keyName)
+		}
+		usage, ok := base[target]
+		if !ok {
+			log.Warnf("%s:%d: key %s has no HID usage, skipping", path, lineNo, keyName)
+			continue
+		}
+		log.Debugf("Remapping key %d to HID usage %d (%s)", code, usage, keyName)
+		scancodes[code] = usage
+		applied += 1
+	}
+	return applied, scanner.Err()
+}
+
+// Parses remappings of raw hardware scancodes (as sent in MSC_SCAN events,
+// in hex) to either an evdev key name or a HID usage number, eg.
+// {"0xc00b6": "KEY_PREVIOUSSONG", "0x70073": "0x68"}
+func ParseRawScancodes(raw map[string]string, keymap *Keymap) (map[uint32]uint16, error) {
+	usages := make(map[uint32]uint16, len(raw))
+	for scancode, target := range raw {
+		code, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(scancode), "0x"), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid raw scancode: %s", scancode)
+		}
+		if usage, err := strconv.ParseUint(target, 0, 16); err == nil {
+			usages[uint32(code)] = uint16(usage)
+			continue
+		}
+		key, ok := KeyCode(target)
+		if !ok {
+			return nil, fmt.Errorf("unknown key for raw scancode %s: %s", scancode, target)
+		}
+		usage, ok := keymap.Lookup(key)
+		if !ok {
+			return nil, fmt.Errorf("key %s for raw scancode %s has no HID usage", target, scancode)
+		}
+		usages[uint32(code)] = usage
+	}
+	return usages, nil
+}
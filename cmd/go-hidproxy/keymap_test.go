@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadHwdbSwapsKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hidproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "70-keyboard.hwdb")
+	hwdb := "evdev:input:b0005v*\n" +
+		" KEYBOARD_KEY_70004=b\n" + // A by HID usage
+		" KEYBOARD_KEY_30=a\n" + // B by AT scancode
+		" KEYBOARD_KEY_1=reserved\n" // Esc
+	if err := ioutil.WriteFile(path, []byte(hwdb), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scancodes := map[uint16]uint16{
+		1:  41,   // KEY_ESC
+		30: 0x04, // KEY_A
+		48: 0x05, // KEY_B
+	}
+	applied, err := LoadHwdb(path, scancodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 3 {
+		t.Errorf("got %d remappings applied, want 3", applied)
+	}
+	if scancodes[30] != 0x05 || scancodes[48] != 0x04 {
+		t.Errorf("got KEY_A=0x%x, KEY_B=0x%x, want them swapped", scancodes[30], scancodes[48])
+	}
+	if _, ok := scancodes[1]; ok {
+		t.Errorf("reserved key still mapped")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+// Custom scancode tables loaded from a file, eg. for keyboards whose evdev
+// key codes don't match the built-in US table
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Table of evdev key codes to HID usages on the keyboard page. The hwdb
+// remappings (see LoadRemappings) are kept apart from the table they apply
+// to, so that reloading them starts over from the table.
+type Keymap struct {
+	lock   sync.RWMutex
+	base   map[uint16]uint16
+	usages map[uint16]uint16
+}
+
+// Makes a keymap with a copy of the given table
+func NewKeymap(usages map[uint16]uint16) *Keymap {
+	base := make(map[uint16]uint16, len(usages))
+	for code, usage := range usages {
+		base[code] = usage
+	}
+	return &Keymap{base: base, usages: base}
+}
+
+// Builds the scancode table for the configuration: the built-in table with
+// the physical layout's adjustments, then the -keymap file, whose entries win
+// over the layout's, and then the -hwdb remappings
+func BuildKeymap(config Config) (*Keymap, error) {
+	keymap, err := NewKeymap(Scancodes).WithPhysicalLayout(config.PhysicalLayout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid physical layout: %s", err.Error())
+	}
+	if config.Keymap != "" {
+		keymap, err = LoadKeymapFile(config.Keymap, keymap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load keymap: %s", err.Error())
+		}
+	}
+	if config.Hwdb != "" {
+		if err := keymap.LoadRemappings(config.Hwdb); err != nil {
+			return nil, fmt.Errorf("failed to load keyboard mappings from %s: %s", config.Hwdb, err.Error())
+		}
+	}
+	return keymap, nil
+}
+
+// Looks up the HID usage of an evdev key code
+func (k *Keymap) Lookup(code uint16) (uint16, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	usage, ok := k.usages[code]
+	return usage, ok
+}
+
+func (k *Keymap) Len() int {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return len(k.usages)
+}
+
+// Returns a copy of the table, without the hwdb remappings
+func (k *Keymap) Base() map[uint16]uint16 {
+	return NewKeymap(k.base).base
+}
+
+// A line of a keymap file, with where it came from for errors
+type keymapEntry struct {
+	where string
+	code  string
+	usage string
+}
+
+// Lines of evdev_code,hid_usage. Empty lines and lines starting with # are
+// skipped.
+func parseKeymapCSV(path string, data []byte) ([]keymapEntry, error) {
+	entries := make([]keymapEntry, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid line: %s (expected evdev_code,hid_usage)", path, lineNo, line)
+		}
+		entries = append(entries, keymapEntry{
+			where: fmt.Sprintf("%s:%d", path, lineNo),
+			code:  strings.TrimSpace(fields[0]),
+			usage: strings.TrimSpace(fields[1]),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// An object of evdev codes to HID usages, eg. {"30": 4, "KEY_B": "0x05"}. The
+// object is read key by key so that duplicate keys are caught.
+func parseKeymapJSON(path string, data []byte) ([]keymapEntry, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("%s: expected an object of evdev codes to HID usages", path)
+	}
+	entries := make([]keymapEntry, 0)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		code := token.(string)
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", path, code, err.Error())
+		}
+		entry := keymapEntry{where: fmt.Sprintf("%s: %s", path, code), code: code}
+		switch v := value.(type) {
+		case json.Number:
+			entry.usage = v.String()
+		case string:
+			entry.usage = v
+		default:
+			return nil, fmt.Errorf("%s: invalid HID usage: %v", entry.where, value)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Loads a keymap file on top of a base table: the file's entries override or
+// extend the base, codes not in the file keep their base usage. Files ending
+// in .json are read as JSON, anything else as CSV. Codes are evdev key codes
+// (decimal, 0x hex or key names like KEY_A) and usages HID usages on the
+// keyboard page; a code may only appear once.
+func LoadKeymapFile(path string, base *Keymap) (*Keymap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []keymapEntry
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		entries, err = parseKeymapJSON(path, data)
+	} else {
+		entries, err = parseKeymapCSV(path, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	usages := base.Base()
+	seen := make(map[uint16]string, len(entries))
+	for _, entry := range entries {
+		code, err := strconv.ParseUint(entry.code, 0, 16)
+		if err != nil {
+			key, ok := KeyCode(entry.code)
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid evdev code: %s", entry.where, entry.code)
+			}
+			code = uint64(key)
+		}
+		usage, err := strconv.ParseUint(entry.usage, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid HID usage: %s", entry.where, entry.usage)
+		}
+		if previous, ok := seen[uint16(code)]; ok {
+			return nil, fmt.Errorf("%s: duplicate evdev code %d (also at %s)", entry.where, code, previous)
+		}
+		seen[uint16(code)] = entry.where
+		usages[uint16(code)] = uint16(usage)
+	}
+	log.Infof("Loaded %d key mappings from %s", len(entries), path)
+	return NewKeymap(usages), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Loads the keymap file contents over a base table of KEY_A and KEY_B
+func loadKeymap(t *testing.T, name string, contents string) (*Keymap, error) {
+	dir, err := ioutil.TempDir("", "hidproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadKeymapFile(path, NewKeymap(map[uint16]uint16{30: 0x04, 48: 0x05}))
+}
+
+func TestLoadKeymapFile(t *testing.T) {
+	files := map[string]string{
+		"keymap.csv":  "# Dvorak-ish\n\n30, 0x05\nKEY_B,4\n0x2e,0x06\n",
+		"keymap.JSON": `{"30": "0x05", "KEY_B": 4, "0x2e": 6}`,
+	}
+	for name, contents := range files {
+		keymap, err := loadKeymap(t, name, contents)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		want := map[uint16]uint16{30: 0x05, 48: 0x04, 46: 0x06}
+		for code, usage := range want {
+			if got, ok := keymap.Lookup(code); !ok || got != usage {
+				t.Errorf("%s: got key %d as 0x%x, want 0x%x", name, code, got, usage)
+			}
+		}
+		if keymap.Len() != len(want) {
+			t.Errorf("%s: got %d keys, want %d", name, keymap.Len(), len(want))
+		}
+	}
+}
+
+func TestLoadKeymapFileKeepsBase(t *testing.T) {
+	keymap, err := loadKeymap(t, "keymap.csv", "46,6\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := keymap.Lookup(30); usage != 0x04 {
+		t.Errorf("got KEY_A as 0x%x, want the base table's 0x04", usage)
+	}
+}
+
+func TestLoadKeymapFileErrors(t *testing.T) {
+	files := map[string]string{
+		"duplicate.csv":      "30,5\n31,6\n30,7\n",
+		"duplicate-name.csv": "30,5\nKEY_A,6\n",
+		"duplicate.json":     `{"30": 5, "KEY_A": 6}`,
+		"code-range.csv":     "65536,4\n",
+		"usage-range.csv":    "30,0x10000\n",
+		"negative.csv":       "30,-1\n",
+		"code-range.json":    `{"65536": 4}`,
+		"usage-range.json":   `{"30": 65536}`,
+		"fraction.json":      `{"30": 4.5}`,
+		"unknown-key.csv":    "KEY_NOPE,4\n",
+		"fields.csv":         "30,4,5\n",
+		"array.json":         `[[30, 4]]`,
+		"usage-type.json":    `{"30": [4]}`,
+	}
+	for name, contents := range files {
+		if _, err := loadKeymap(t, name, contents); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Number of most recent samples percentiles are computed over
+const LATENCY_WINDOW = 1024
+
+// Capture latencies above this are taken to be clock steps and dropped
+const MAX_CAPTURE_LATENCY = 10 * time.Second
+
+// Upper bounds of the latency histogram buckets, samples above the last one
+// go to an overflow bucket
+var LATENCY_BUCKETS = []time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	4 * time.Millisecond,
+	8 * time.Millisecond,
+	16 * time.Millisecond,
+	32 * time.Millisecond,
+	64 * time.Millisecond,
+}
+
+// Write latency of reports (from input event to HID write), keeping a window
+// of the most recent samples for percentiles and a histogram of all samples
+type LatencyStats struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+	count   uint64
+	sum     time.Duration
+	buckets []uint64
+}
+
+type LatencySummary struct {
+	Count uint64        `json:"count"`
+	Min   time.Duration `json:"min"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// Latency statistics per report type
+var Latencies = map[string]*LatencyStats{
+	"keyboard": NewLatencyStats(LATENCY_WINDOW),
+	"mouse":    NewLatencyStats(LATENCY_WINDOW),
+	"system":   NewLatencyStats(LATENCY_WINDOW),
+	"consumer": NewLatencyStats(LATENCY_WINDOW),
+}
+
+// Capture latency per handler type: from the kernel timestamping an input
+// event to its handler reading it, before the report is built. High capture
+// latency with low write latency means the proxy is slow to pick up events
+// rather than slow to write them.
+var CaptureLatencies = map[string]*LatencyStats{
+	"keyboard": NewLatencyStats(LATENCY_WINDOW),
+	"mouse":    NewLatencyStats(LATENCY_WINDOW),
+}
+
+func NewLatencyStats(window int) *LatencyStats {
+	return &LatencyStats{
+		samples: make([]time.Duration, 0, window),
+		buckets: make([]uint64, len(LATENCY_BUCKETS)+1),
+	}
+}
+
+func (s *LatencyStats) Observe(latency time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.samples) < cap(s.samples) {
+		s.samples = append(s.samples, latency)
+	} else {
+		s.samples[s.next] = latency
+		s.next = (s.next + 1) % len(s.samples)
+	}
+	s.count += 1
+	s.sum += latency
+	s.buckets[sort.Search(len(LATENCY_BUCKETS), func(i int) bool { return LATENCY_BUCKETS[i] >= latency })] += 1
+}
+
+// Observes the latency from an event's timestamp to now. Events are stamped
+// with the realtime clock, so samples across a clock step (negative or above
+// MAX_CAPTURE_LATENCY) are dropped.
+func (s *LatencyStats) ObserveEvent(t syscall.Timeval) {
+	latency := time.Since(time.Unix(0, t.Nano()))
+	if latency < 0 || latency > MAX_CAPTURE_LATENCY {
+		return
+	}
+	s.Observe(latency)
+}
+
+// Returns the number of samples observed in each bucket of LATENCY_BUCKETS
+// since the start, the last one counting the samples above the last bound
+func (s *LatencyStats) Histogram() []uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return append(make([]uint64, 0, len(s.buckets)), s.buckets...)
+}
+
+// Returns the total of all samples observed since the start
+func (s *LatencyStats) Sum() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.sum
+}
+
+// Summarizes the samples in the window. Count is the total number of samples
+// observed.
+func (s *LatencyStats) Summary() LatencySummary {
+	s.Lock()
+	sorted := make([]time.Duration, len(s.samples))
+	copy(sorted, s.samples)
+	summary := LatencySummary{Count: s.count}
+	s.Unlock()
+
+	if len(sorted) == 0 {
+		return summary
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, latency := range sorted {
+		total += latency
+	}
+	summary.Min = sorted[0]
+	summary.Max = sorted[len(sorted)-1]
+	summary.Mean = total / time.Duration(len(sorted))
+	summary.P50 = percentile(sorted, 50)
+	summary.P95 = percentile(sorted, 95)
+	summary.P99 = percentile(sorted, 99)
+	return summary
+}
+
+// Nearest-rank percentile of sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
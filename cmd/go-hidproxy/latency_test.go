@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencySummary(t *testing.T) {
+	stats := NewLatencyStats(LATENCY_WINDOW)
+	// 1 to 100 ms, out of order
+	for i := 100; i >= 1; i-- {
+		stats.Observe(time.Duration(i) * time.Millisecond)
+	}
+	summary := stats.Summary()
+	want := LatencySummary{
+		Count: 100,
+		Min:   1 * time.Millisecond,
+		Mean:  50500 * time.Microsecond,
+		P50:   50 * time.Millisecond,
+		P95:   95 * time.Millisecond,
+		P99:   99 * time.Millisecond,
+		Max:   100 * time.Millisecond,
+	}
+	if summary != want {
+		t.Errorf("got %+v, want %+v", summary, want)
+	}
+	if sum := stats.Sum(); sum != 5050*time.Millisecond {
+		t.Errorf("got a sum of %s, want 5.05s", sum)
+	}
+}
+
+func TestLatencySummaryEmpty(t *testing.T) {
+	if summary := NewLatencyStats(LATENCY_WINDOW).Summary(); summary != (LatencySummary{}) {
+		t.Errorf("got %+v for no samples", summary)
+	}
+}
+
+func TestLatencyWindowWraps(t *testing.T) {
+	stats := NewLatencyStats(LATENCY_WINDOW)
+	for i := 0; i < LATENCY_WINDOW; i++ {
+		stats.Observe(1 * time.Millisecond)
+	}
+	// Replaces the oldest sample
+	stats.Observe(5 * time.Millisecond)
+	summary := stats.Summary()
+	if summary.Count != LATENCY_WINDOW+1 || summary.Min != 1*time.Millisecond || summary.Max != 5*time.Millisecond {
+		t.Errorf("after one more sample than the window: got %+v", summary)
+	}
+
+	// The rest of the first samples are replaced in turn
+	for i := 1; i < LATENCY_WINDOW; i++ {
+		stats.Observe(2 * time.Millisecond)
+	}
+	summary = stats.Summary()
+	if summary.Count != 2*LATENCY_WINDOW || summary.Min != 2*time.Millisecond || summary.Max != 5*time.Millisecond {
+		t.Errorf("after twice the window: got %+v", summary)
+	}
+
+	// The histogram counts every sample, not just the window
+	var count uint64
+	for _, n := range stats.Histogram() {
+		count += n
+	}
+	if count != 2*LATENCY_WINDOW {
+		t.Errorf("got %d samples in the histogram, want %d", count, 2*LATENCY_WINDOW)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+// Writing the latency histograms to a file for offline analysis
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LatencyBucket struct {
+	// Upper bound in nanoseconds, nil for the overflow bucket
+	Le    *time.Duration `json:"le"`
+	Count uint64         `json:"count"`
+}
+
+type LatencyExportEntry struct {
+	Summary LatencySummary  `json:"summary"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+type LatencyExport struct {
+	Time      time.Time                     `json:"time"`
+	Latencies map[string]LatencyExportEntry `json:"latencies"`
+	Capture   map[string]LatencyExportEntry `json:"capture"`
+}
+
+// Writes snapshots of the latency statistics to a file, as JSON or, if the
+// file name ends with .csv, as CSV with a row per report type and bucket
+type LatencyExporter struct {
+	sync.Mutex
+	path string
+}
+
+func NewLatencyExporter(path string) *LatencyExporter {
+	return &LatencyExporter{path: path}
+}
+
+func latencyEntries(latencies map[string]*LatencyStats) map[string]LatencyExportEntry {
+	entries := make(map[string]LatencyExportEntry, len(latencies))
+	for name, stats := range latencies {
+		entry := LatencyExportEntry{Summary: stats.Summary()}
+		for i, count := range stats.Histogram() {
+			bucket := LatencyBucket{Count: count}
+			if i < len(LATENCY_BUCKETS) {
+				bucket.Le = &LATENCY_BUCKETS[i]
+			}
+			entry.Buckets = append(entry.Buckets, bucket)
+		}
+		entries[name] = entry
+	}
+	return entries
+}
+
+func latencySnapshot() LatencyExport {
+	return LatencyExport{
+		Time:      time.Now(),
+		Latencies: latencyEntries(Latencies),
+		Capture:   latencyEntries(CaptureLatencies),
+	}
+}
+
+func writeLatencyRows(w *csv.Writer, entries map[string]LatencyExportEntry, suffix string) {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, bucket := range entries[name].Buckets {
+			le := "+Inf"
+			if bucket.Le != nil {
+				le = strconv.FormatInt(bucket.Le.Microseconds(), 10)
+			}
+			w.Write([]string{name + suffix, le, strconv.FormatUint(bucket.Count, 10)})
+		}
+	}
+}
+
+// Columns: report type (with a -capture suffix for capture latency), bucket
+// upper bound in microseconds (+Inf for the overflow bucket) and the number of
+// samples in the bucket
+func (e LatencyExport) csv() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"type", "le_us", "count"})
+	writeLatencyRows(w, e.Latencies, "")
+	writeLatencyRows(w, e.Capture, "-capture")
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Writes the current statistics, replacing the file so readers never see a
+// partial one
+func (x *LatencyExporter) Write() error {
+	x.Lock()
+	defer x.Unlock()
+	export := latencySnapshot()
+	var data []byte
+	var err error
+	if strings.HasSuffix(strings.ToLower(x.path), ".csv") {
+		data, err = export.csv()
+	} else {
+		data, err = json.MarshalIndent(export, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(x.path), "."+filepath.Base(x.path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), x.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace %s: %s", x.path, err.Error())
+	}
+	return nil
+}
+
+// Writes the current statistics, logging rather than returning failures
+func (x *LatencyExporter) Save() {
+	if x == nil {
+		return
+	}
+	if err := x.Write(); err != nil {
+		log.Warnf("Failed to write latency statistics to %s: %s", x.path, err.Error())
+	}
+}
+
+// Writes the statistics every interval. RunProxy saves them once more when it
+// returns.
+func (x *LatencyExporter) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		x.Save()
+	}
+}
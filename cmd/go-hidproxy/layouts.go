@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+// HID usage of the key left of Enter on ISO keyboards (Non-US # and ~)
+const USAGE_NON_US_HASH = 0x32
+
+// Keys that sit in different places on ISO keyboards than on the ANSI (US)
+// keyboards the built-in table is for. The kernel gives the key left of Enter
+// the same key code (KEY_BACKSLASH) on both, so it is sent as the ISO usage,
+// which hosts configured for an ISO layout (notably macOS) expect.
+var isoScancodes = map[uint16]uint16{
+	43: USAGE_NON_US_HASH, // KEY_BACKSLASH
+}
+
+// Adjustments to the built-in scancode table for the physical layout of the
+// keyboard. These only move keys whose position differs between physical
+// layouts; the characters the keys produce (eg. AZERTY) are up to the host's
+// layout setting, so all ISO keyboards share one layout.
+var PhysicalLayouts = map[string]map[uint16]uint16{
+	"us":  {},
+	"iso": isoScancodes,
+}
+
+// Other names accepted for the physical layouts
+var physicalLayoutAliases = map[string]string{
+	"uk": "iso",
+	"de": "iso",
+	"fr": "iso",
+}
+
+func physicalLayoutNames() string {
+	names := make([]string, 0, len(PhysicalLayouts))
+	for name := range PhysicalLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Returns a copy of the keymap with the physical layout's adjustments
+func (k *Keymap) WithPhysicalLayout(name string) (*Keymap, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := physicalLayoutAliases[name]; ok {
+		name = alias
+	}
+	adjustments, ok := PhysicalLayouts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown physical layout %s (available: %s)", name, physicalLayoutNames())
+	}
+	scancodes := k.Base()
+	for code, usage := range adjustments {
+		scancodes[code] = usage
+	}
+	if len(adjustments) > 0 {
+		log.Infof("Using the %s physical keyboard layout (%d keys adjusted)", name, len(adjustments))
+	}
+	return NewKeymap(scancodes), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithPhysicalLayout(t *testing.T) {
+	builtin := NewKeymap(Scancodes)
+	for _, name := range []string{"iso", "UK", " de", "fr"} {
+		keymap, err := builtin.WithPhysicalLayout(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if usage, _ := keymap.Lookup(43); usage != USAGE_NON_US_HASH {
+			t.Errorf("%s: got KEY_BACKSLASH as 0x%x, want 0x%x", name, usage, USAGE_NON_US_HASH)
+		}
+	}
+	keymap, err := builtin.WithPhysicalLayout("us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := keymap.Lookup(43); usage != 0x31 {
+		t.Errorf("us: got KEY_BACKSLASH as 0x%x, want 0x31", usage)
+	}
+	if usage, _ := builtin.Lookup(43); usage != 0x31 {
+		t.Errorf("layout changed the keymap it was applied to")
+	}
+	if _, err := builtin.WithPhysicalLayout("jis"); err == nil {
+		t.Errorf("unknown layout accepted")
+	}
+}
+
+func TestBuildKeymapAppliesFileLast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hidproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keymap.csv")
+	if err := ioutil.WriteFile(path, []byte("KEY_BACKSLASH,0x31\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.PhysicalLayout = "uk"
+	config.Keymap = path
+	keymap, err := BuildKeymap(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := keymap.Lookup(43); usage != 0x31 {
+		t.Errorf("got KEY_BACKSLASH as 0x%x, want the file's 0x31 over the layout's", usage)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Log file that can be reopened after it has been rotated away
+type LogFile struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	f := &LogFile{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *LogFile) Reopen() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	old := f.file
+	f.file = file
+	f.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.file.Write(p)
+}
+
+// Directs log output to a file (reopened on SIGHUP for log rotation) and/or
+// the local syslog. Logs go to stderr only if neither is configured.
+func SetupLogging(logFile string, logSyslog bool) error {
+	if logSyslog {
+		hook, err := lsyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, "go-hidproxy")
+		if err != nil {
+			return err
+		}
+		log.AddHook(hook)
+		log.SetOutput(ioutil.Discard)
+	}
+	if logFile != "" {
+		f, err := OpenLogFile(logFile)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := f.Reopen(); err != nil {
+					log.Errorf("Failed to reopen log file %s: %s", logFile, err.Error())
+				} else {
+					log.Infof("Reopened log file: %s", logFile)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// Last handler instance ID handed out
+var handlerIds uint64
+
+// Logger for an input handler, with fields for the device and a short
+// instance ID (eg. keyboard-3), so that lines from concurrent handlers, and
+// from successive handlers for the same device, can be told apart
+func HandlerLogger(kind string, dev *evdev.InputDevice) *log.Entry {
+	return log.WithFields(log.Fields{
+		"handler": fmt.Sprintf("%s-%d", kind, atomic.AddUint64(&handlerIds, 1)),
+		"device":  dev.Name,
+		"path":    dev.Fn,
+	})
+}
+
+// Limits how often each message is logged, for messages logged from the
+// input and report loops that can flood the log (and slow down everything
+// else on an SD card) when a device misbehaves. Messages are told apart by
+// their format string; after burst messages in an interval the rest are
+// dropped, and their number is logged at the end of the interval.
+type RateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	burst    int
+	entries  map[string]*rateEntry
+}
+
+type rateEntry struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// Rate limiter for the hot paths, unlimited until set up from the
+// configuration
+var Limited = NewRateLimiter(time.Second, 0)
+
+// Allows burst messages of each kind per interval, or any number if burst
+// is zero
+func NewRateLimiter(interval time.Duration, burst int) *RateLimiter {
+	return &RateLimiter{
+		interval: interval,
+		burst:    burst,
+		entries:  make(map[string]*rateEntry, 0),
+	}
+}
+
+func (r *RateLimiter) Logf(logger *log.Entry, level log.Level, format string, args ...interface{}) {
+	if !log.IsLevelEnabled(level) {
+		return
+	}
+	if r.burst <= 0 {
+		logger.Logf(level, format, args...)
+		return
+	}
+	r.Lock()
+	now := time.Now()
+	entry, ok := r.entries[format]
+	if !ok || now.Sub(entry.start) >= r.interval {
+		entry = &rateEntry{start: now}
+		r.entries[format] = entry
+	}
+	entry.count += 1
+	if entry.count <= r.burst {
+		r.Unlock()
+		logger.Logf(level, format, args...)
+		return
+	}
+	if entry.suppressed == 0 {
+		time.AfterFunc(r.interval-now.Sub(entry.start), func() {
+			r.Lock()
+			suppressed := entry.suppressed
+			r.Unlock()
+			logger.Logf(level, "Suppressed %d more %q messages in %s", suppressed, format, r.interval)
+		})
+	}
+	entry.suppressed += 1
+	r.Unlock()
+}
+
+func (r *RateLimiter) Debugf(logger *log.Entry, format string, args ...interface{}) {
+	r.Logf(logger, log.DebugLevel, format, args...)
+}
+
+func (r *RateLimiter) Warnf(logger *log.Entry, format string, args ...interface{}) {
+	r.Logf(logger, log.WarnLevel, format, args...)
+}
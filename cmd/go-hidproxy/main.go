@@ -7,7 +7,8 @@ package main
 import (
 	"bytes"
 	"context"
-	"flag"
+	"encoding/json"
+	"errors"
 	"fmt"
 	evdev "github.com/gvalkov/golang-evdev"
 	udev "github.com/jochenvg/go-udev"
@@ -16,9 +17,13 @@ import (
 	"github.com/muka/go-bluetooth/bluez/profile/adapter"
 	log "github.com/sirupsen/logrus"
 	orderedmap "github.com/wk8/go-ordered-map"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -33,8 +38,118 @@ type InputDevice struct {
 type InputMessage struct {
 	Message   []byte
 	Timestamp time.Duration
+	// Written even while forwarding is paused (eg. releasing held keys)
+	Forced bool
 }
 
+type DropPolicy int
+
+const (
+	DROP_OLDEST DropPolicy = iota // discard the oldest queued report to make room
+	DROP_NEWEST                   // discard the report being sent, keep the queue intact
+)
+
+func ParseDropPolicy(policy string) (DropPolicy, error) {
+	switch policy {
+	case "oldest":
+		return DROP_OLDEST, nil
+	case "newest":
+		return DROP_NEWEST, nil
+	}
+	return DROP_OLDEST, fmt.Errorf("unknown drop policy: %s (expected oldest or newest)", policy)
+}
+
+func (p DropPolicy) String() string {
+	if p == DROP_NEWEST {
+		return "newest"
+	}
+	return "oldest"
+}
+
+func (p *DropPolicy) Set(policy string) error {
+	parsed, err := ParseDropPolicy(policy)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+func (p DropPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *DropPolicy) UnmarshalText(text []byte) error {
+	return p.Set(string(text))
+}
+
+// Sends a report without ever blocking the input handler. If the writer
+// can't keep up and the channel is full, a report is dropped according to
+// the policy. Forced reports (releasing held keys) are never the ones
+// dropped: they evict the oldest report like DROP_OLDEST, and are passed
+// over, keeping their place in the queue, when choosing the report to evict.
+// Returns false if the report itself was dropped.
+func SendInput(input chan InputMessage, msg InputMessage, policy DropPolicy) bool {
+	select {
+	case input <- msg:
+		return true
+	default:
+	}
+	if policy == DROP_NEWEST && !msg.Forced {
+		log.Debugf("Input queue full, dropping newest report: %v", msg.Message)
+		return false
+	}
+	// Evict the oldest report that isn't forced. The queued reports are taken
+	// out and put back in order, so that forced ones stay ahead of the reports
+	// queued after them.
+	evictMutex.Lock()
+	defer evictMutex.Unlock()
+	queued := make([]InputMessage, 0, cap(input)+1)
+drain:
+	for len(queued) < cap(input) {
+		select {
+		case queuedMsg := <-input:
+			queued = append(queued, queuedMsg)
+		default:
+			break drain
+		}
+	}
+	// The writer may have made room in the meantime
+	for i, queuedMsg := range queued {
+		if len(queued) < cap(input) {
+			break
+		}
+		if !queuedMsg.Forced {
+			log.Debugf("Input queue full, dropping oldest report: %v", queuedMsg.Message)
+			queued = append(queued[:i], queued[i+1:]...)
+			break
+		}
+	}
+	queued = append(queued, msg)
+	// A queue holding only forced reports has no room left for the new one
+	sent := true
+	for i, queuedMsg := range queued {
+		select {
+		case input <- queuedMsg:
+			continue
+		default:
+		}
+		if i == len(queued)-1 {
+			sent = false
+		}
+		if queuedMsg.Forced {
+			log.Warnf("Input queue full, dropping forced report: %v", queuedMsg.Message)
+		} else {
+			log.Debugf("Input queue full of forced reports, dropping report: %v", queuedMsg.Message)
+		}
+	}
+	return sent
+}
+
+// Held while a full queue is taken apart to evict a report, so that other
+// handlers evicting from it don't interleave their reports
+var evictMutex sync.Mutex
+
 var Scancodes = map[uint16]uint16{
 	1: 	41, // KEY_ESC
 	2: 	30, // KEY_1
@@ -217,84 +332,145 @@ const (
 	BUTTON_EXTRA  = 1 << 4
 )
 
-func SetupUSBGadget() {
-	const gadget string = "g1" // name of  usb_gadget
-	var basepath string = "/sys/kernel/config/usb_gadget/"+gadget
+func KeyboardReportDescriptor(reportId uint8) []byte {
+	return Keyboard.Descriptor(reportId)
+}
+
+// Mouse report: 5 buttons, X, Y, wheel and horizontal wheel, in the
+// configured format
+func MouseReportDescriptor() []byte {
+	return Mouse.Descriptor()
+}
+
+// Interface subclass and protocol for a HID function: the boot interface
+// subclass with the given boot protocol if its reports work in the boot
+// protocol, otherwise none, so hosts don't switch it to the boot protocol and
+// then misread the reports
+func bootInterface(function string, compatible bool, protocol string) (string, string) {
+	if compatible {
+		return "1", protocol
+	}
+	log.Warnf("The %s report format isn't boot protocol compatible, so the %s won't work with hosts that only support the boot protocol (eg. a BIOS)", function, function)
+	return "0", "0"
+}
+
+// Creates the gadget under the given configfs usb_gadget directory (normally
+// CONFIGFS_GADGET_PATH) and, if bind is set, binds it to the UDC (see
+// SelectUDC)
+func SetupUSBGadget(gadgetPath string, gadget GadgetConfig, wait time.Duration, bind bool) {
+	var basepath string = gadgetPath+"/"+gadget.Name
+	var configpath string = basepath+"/configs/"+gadget.ConfigName
 	var paths = []string{
 		basepath,
-		basepath+"/strings/0x409",
-		basepath+"/configs/c.1/strings/0x409",
 		basepath+"/functions/hid.usb0",
 		basepath+"/functions/hid.usb1",
 		basepath+"/os_desc",
 	}
+	languages := gadget.Languages()
+	for _, strs := range languages {
+		paths = append(paths, basepath+"/strings/"+strs.Lang, configpath+"/strings/"+strs.Lang)
+	}
 	filesStr := orderedmap.New()
-	filesStr.Set(basepath+"/idVendor", "0x1d6b") 	//Linux Foundation
-	filesStr.Set(basepath+"/idProduct", "0x0104")	//Multifunction Composite Gadget
-	filesStr.Set(basepath+"/bcdDevice", "0x0100")
-	filesStr.Set(basepath+"/bcdUSB", "0x0200")
-	filesStr.Set(basepath+"/bDeviceClass", "0xEF")
-	filesStr.Set(basepath+"/bDeviceSubClass", "0x02")
-	filesStr.Set(basepath+"/bDeviceProtocol", "0x01")
+	filesStr.Set(basepath+"/idVendor", gadget.IdVendor)
+	filesStr.Set(basepath+"/idProduct", gadget.IdProduct)
+	filesStr.Set(basepath+"/bcdDevice", gadget.BcdDevice)
+	filesStr.Set(basepath+"/bcdUSB", gadget.BcdUSB)
+	filesStr.Set(basepath+"/bDeviceClass", gadget.DeviceClass)
+	filesStr.Set(basepath+"/bDeviceSubClass", gadget.DeviceSubClass)
+	filesStr.Set(basepath+"/bDeviceProtocol", gadget.DeviceProtocol)
 	filesStr.Set(basepath+"/os_desc/use", "1")
 	filesStr.Set(basepath+"/os_desc/b_vendor_code", "0x01")
 	filesStr.Set(basepath+"/os_desc/qw_sign", "MSFT100")
-	filesStr.Set(basepath+"/strings/0x409/serialnumber", "00100")
-	filesStr.Set(basepath+"/strings/0x409/manufacturer", "Linux Foundation")
-	filesStr.Set(basepath+"/strings/0x409/product", "Multifunction Composite Gadget")
-	filesStr.Set(basepath+"/configs/c.1/strings/0x409/configuration", "Config 1: USB Gadget")
-	filesStr.Set(basepath+"/configs/c.1/MaxPower", "250")
-	filesStr.Set(basepath+"/functions/hid.usb0/protocol", "1")
-	filesStr.Set(basepath+"/functions/hid.usb0/subclass", "1")
-	filesStr.Set(basepath+"/functions/hid.usb0/report_length", "8")
-	filesStr.Set(basepath+"/functions/hid.usb1/protocol", "2")
-	filesStr.Set(basepath+"/functions/hid.usb1/subclass", "1")
-	filesStr.Set(basepath+"/functions/hid.usb1/report_length", "4")
+	for _, strs := range languages {
+		filesStr.Set(basepath+"/strings/"+strs.Lang+"/serialnumber", strs.SerialNumber)
+		filesStr.Set(basepath+"/strings/"+strs.Lang+"/manufacturer", strs.Manufacturer)
+		filesStr.Set(basepath+"/strings/"+strs.Lang+"/product", strs.Product)
+		filesStr.Set(configpath+"/strings/"+strs.Lang+"/configuration", strs.Configuration)
+	}
+	filesStr.Set(configpath+"/MaxPower", gadget.MaxPower)
+	keyboardSubclass, keyboardProtocol := bootInterface("keyboard", Keyboard.BootCompatible(gadget.KeyboardReportId), "1")
+	mouseSubclass, mouseProtocol := bootInterface("mouse", Mouse.BootCompatible(), "2")
+	filesStr.Set(basepath+"/functions/hid.usb0/protocol", keyboardProtocol)
+	filesStr.Set(basepath+"/functions/hid.usb0/subclass", keyboardSubclass)
+	filesStr.Set(basepath+"/functions/hid.usb0/report_length", fmt.Sprintf("%d", KeyboardReportLength(gadget.KeyboardReportId)))
+	filesStr.Set(basepath+"/functions/hid.usb1/protocol", mouseProtocol)
+	filesStr.Set(basepath+"/functions/hid.usb1/subclass", mouseSubclass)
+	filesStr.Set(basepath+"/functions/hid.usb1/report_length", fmt.Sprintf("%d", MouseReportLength()))
 	var filesBytes = map[string][]byte{
-		basepath+"/functions/hid.usb0/report_desc": []byte{0x05, 0x01, 0x09, 0x06, 0xa1, 0x01, 0x05, 0x07, 0x19, 0xe0, 0x29, 0xe7, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, 0x08, 0x81, 0x02, 0x95, 0x01, 0x75, 0x08, 0x81, 0x03, 0x95, 0x05, 0x75, 0x01, 0x05, 0x08, 0x19, 0x01, 0x29, 0x05, 0x91, 0x02, 0x95, 0x01, 0x75, 0x03, 0x91, 0x03, 0x95, 0x06, 0x75, 0x08, 0x15, 0x00, 0x25, 0x65, 0x05, 0x07, 0x19, 0x00, 0x29, 0x65, 0x81, 0x00, 0xc0},
-		basepath+"/functions/hid.usb1/report_desc": []byte{0x05, 0x01, 0x09, 0x02, 0xa1, 0x01, 0x09, 0x01, 0xa1, 0x00, 0x05, 0x09, 0x19, 0x01, 0x29, 0x05, 0x15, 0x00, 0x25, 0x01, 0x95, 0x05, 0x75, 0x01, 0x81, 0x02, 0x95, 0x01, 0x75, 0x03, 0x81, 0x01, 0x05, 0x01, 0x09, 0x30, 0x09, 0x31, 0x09, 0x38, 0x15, 0x81, 0x25, 0x7f, 0x75, 0x08, 0x95, 0x03, 0x81, 0x06, 0xc0, 0xc0},
+		basepath+"/functions/hid.usb0/report_desc": KeyboardReportDescriptor(gadget.KeyboardReportId),
+		basepath+"/functions/hid.usb1/report_desc": MouseReportDescriptor(),
 	}
 	var symlinks = map[string]string{
-		basepath+"/functions/hid.usb0": basepath+"/configs/c.1/hid.usb0",
-		basepath+"/functions/hid.usb1": basepath+"/configs/c.1/hid.usb1",
+		basepath+"/functions/hid.usb0": configpath+"/hid.usb0",
+		basepath+"/functions/hid.usb1": configpath+"/hid.usb1",
+	}
+	hidDevices := []string{"/dev/hidg0", "/dev/hidg1"}
+	if gadget.SystemControl {
+		paths = append(paths, basepath+"/functions/hid.usb2")
+		filesStr.Set(basepath+"/functions/hid.usb2/protocol", "0")
+		filesStr.Set(basepath+"/functions/hid.usb2/subclass", "0")
+		filesStr.Set(basepath+"/functions/hid.usb2/report_length", fmt.Sprintf("%d", SystemControlReportLength()))
+		filesBytes[basepath+"/functions/hid.usb2/report_desc"] = SystemControlReportDescriptor()
+		symlinks[basepath+"/functions/hid.usb2"] = configpath+"/hid.usb2"
+		hidDevices = append(hidDevices, "/dev/hidg2")
+	}
+	if gadget.ConsumerControl {
+		paths = append(paths, basepath+"/functions/hid.usb3")
+		filesStr.Set(basepath+"/functions/hid.usb3/protocol", "0")
+		filesStr.Set(basepath+"/functions/hid.usb3/subclass", "0")
+		filesStr.Set(basepath+"/functions/hid.usb3/report_length", fmt.Sprintf("%d", ConsumerControlReportLength()))
+		filesBytes[basepath+"/functions/hid.usb3/report_desc"] = ConsumerControlReportDescriptor()
+		symlinks[basepath+"/functions/hid.usb3"] = configpath+"/hid.usb3"
+		hidDevices = append(hidDevices, gadget.ConsumerControlNode())
 	}
 
+	WaitFor("configfs to be mounted", wait, pathsExist(gadgetPath))
 	for _, path := range paths {
 		if _, err := os.Stat(path); os.IsNotExist(err) {
 			log.Debugf("Creating directory: %s", path)
-			err := os.MkdirAll(path, os.ModeDir)
+			err := os.MkdirAll(path, os.ModeDir|0755)
 			if err != nil {
+				if strings.Contains(path, "/functions/") && !ModuleLoaded(HID_FUNCTION_MODULE) {
+					log.Fatalf("Failed to create directory path: %s (%s), is the %s kernel module available?", path, err.Error(), HID_FUNCTION_MODULE)
+				}
 				log.Fatalf("Failed to create directory path: %s", path)
 			}
 		}
 	}
 
+	// Files whose contents differ from what is set up, in the order to write
+	// them
+	var changed []string
+	changes := make(map[string][]byte, 0)
 	for pair := filesStr.Oldest(); pair != nil; pair = pair.Next() {
 		content, err := ioutil.ReadFile(pair.Key.(string))
-		if err == nil {
-			if bytes.Compare(content[0:len(content)-1], []byte(pair.Value.(string))) == 0 {
-				continue
-			}
-		}
-
-		log.Debugf("Writing file: %s", pair.Key.(string))
-		err = ioutil.WriteFile(pair.Key.(string), []byte(pair.Value.(string)), os.FileMode(0644))
-		if err != nil {
-			log.Warnf("Failed to write file: %s (maybe already set up)", pair.Key.(string))
+		if err == nil && sameGadgetAttribute(pair.Key.(string), string(content), pair.Value.(string)) {
+			continue
 		}
+		changed = append(changed, pair.Key.(string))
+		changes[pair.Key.(string)] = []byte(pair.Value.(string))
 	}
-
 	for file, contents := range filesBytes {
 		content, err := ioutil.ReadFile(file)
-		if err == nil {
-			if bytes.Compare(content, contents) == 0 {
-				continue
-			}
+		if err == nil && bytes.Equal(content, contents) {
+			continue
 		}
+		changed = append(changed, file)
+		changes[file] = contents
+	}
+
+	// The kernel refuses changes to a bound gadget
+	if len(changed) > 0 && BoundUDC(gadgetPath, gadget.Name) != "" {
+		log.Infof("Unbinding gadget %s to update its configuration", gadget.Name)
+		if err := UnbindGadget(gadgetPath, gadget.Name); err != nil {
+			log.Fatalf("Failed to update gadget %s, it can't be unbound: %s", gadget.Name, err.Error())
+		}
+	}
+	for _, file := range changed {
 		log.Debugf("Writing file: %s", file)
-		err = ioutil.WriteFile(file, contents, os.FileMode(0644))
+		err := ioutil.WriteFile(file, changes[file], os.FileMode(0644))
 		if err != nil {
-			log.Warnf("Failed to create file: %s (maybe already set up)", file)
+			log.Fatalf("Failed to write file: %s (%s)", file, err.Error())
 		}
 	}
 
@@ -308,181 +484,505 @@ func SetupUSBGadget() {
 		}
 	}
 
-	time.Sleep(1000 * time.Millisecond)
+	if !WaitFor("a USB device controller in /sys/class/udc", wait, func() bool {
+		if gadget.UDC != "" {
+			return pathsExist("/sys/class/udc/"+gadget.UDC)()
+		}
+		return len(UDCs()) > 0
+	}) {
+		if gadget.UDC != "" {
+			log.Errorf("USB device controller %s not found, the gadget can't be bound and the host won't see any input", gadget.UDC)
+		} else {
+			log.Errorf("No USB device controller found in /sys/class/udc, the gadget can't be bound and the host won't see any input (is the controller's driver, eg. dwc2, loaded?)")
+		}
+		return
+	}
+	if _, err := SelectUDC(gadget.UDC); err != nil {
+		log.Fatalf("Failed to select a USB device controller: %s", err.Error())
+	}
+	if bind {
+		if err := BindGadget(gadgetPath, gadget); err != nil {
+			log.Warnf("%s", err.Error())
+		}
+	} else {
+		log.Infof("Leaving gadget %s unbound until a device is grabbed", gadget.Name)
+		if err := UnbindGadget(gadgetPath, gadget.Name); err != nil {
+			log.Warnf("%s", err.Error())
+		}
+	}
+	WaitFor("HID gadget devices", wait, pathsExist(hidDevices...))
+}
 
-	matches, err := filepath.Glob("/sys/class/udc/*")
+// Gadget attributes holding strings; the others are numbers
+var gadgetStringAttributes = map[string]bool{
+	"serialnumber":  true,
+	"manufacturer":  true,
+	"product":       true,
+	"configuration": true,
+	"qw_sign":       true,
+}
+
+// Whether a gadget attribute as read back from configfs has the value being
+// set up. Configfs reads the attributes back with a newline, and numbers in
+// its own format (eg. 0xef for 0xEF), so numbers are compared by value.
+func sameGadgetAttribute(path string, current string, value string) bool {
+	current = strings.TrimSuffix(current, "\n")
+	if current == value {
+		return true
+	}
+	if gadgetStringAttributes[filepath.Base(path)] {
+		return false
+	}
+	a, err := strconv.ParseUint(current, 0, 0)
 	if err != nil {
-		log.Fatalf("Failed to list files in /sys/class/udc: %s", err.Error())
+		return false
 	}
-	var udcFile string = basepath+"/UDC"
-	var udc string = ""
-	for _, match := range matches {
-		udc = udc + filepath.Base(match) + " "
+	b, err := strconv.ParseUint(value, 0, 0)
+	return err == nil && a == b
+}
+
+// Length of the keyboard report, including the report ID prefix if enabled
+func KeyboardReportLength(reportId uint8) int {
+	if reportId > 0 {
+		return Keyboard.ReportLength() + 1
 	}
-	content, err := ioutil.ReadFile(udcFile)
-	if err == nil {
-		if bytes.Compare(content[0:len(content)-1], []byte(strings.TrimSpace(udc))) != 0 {
-			err = ioutil.WriteFile(udcFile, []byte(strings.TrimSpace(udc)), os.FileMode(0644))
-			if err != nil {
-				log.Warnf("Failed to create file %s: %s: (%s)", udcFile, udc, err.Error())
-			}
-		}
+	return Keyboard.ReportLength()
+}
+
+// Builds a keyboard report (modifiers, reserved, keys and the optional key
+// bitmap) from the HID usages of the keys currently held down
+func BuildKeyboardReport(keysDown []uint16) []uint8 {
+	return Keyboard.Build(keysDown)
+}
+
+// Releases the keys of a keyboard node on the host: sends the keys still held
+// on its sibling nodes, which stay held, and empty system and consumer control
+// reports if a key was held on those. The reports go out dropping the oldest
+// queued ones whatever the configured policy, so that they are never lost.
+func ReleaseKeyboard(group *KeyboardGroup, node string, input chan InputMessage, system chan InputMessage, consumer chan InputMessage, systemHeld bool, consumerHeld bool) {
+	SendInput(input, InputMessage{Timestamp: hrtime.Now(), Message: BuildKeyboardReport(group.Set(node, nil))}, DROP_OLDEST)
+	if systemHeld {
+		SendInput(system, InputMessage{Timestamp: hrtime.Now(), Message: BuildSystemControlReport(0)}, DROP_OLDEST)
+	}
+	if consumerHeld {
+		SendInput(consumer, InputMessage{Timestamp: hrtime.Now(), Message: BuildConsumerControlReport(0)}, DROP_OLDEST)
 	}
-	// Give it a second to settle
-	time.Sleep(1000 * time.Millisecond)
 }
 
-func HandleKeyboard(output chan<- error, input chan<- InputMessage, close <-chan bool, rate uint, delay uint, dev evdev.InputDevice) error {
+func HandleKeyboard(output chan<- error, input chan InputMessage, system chan InputMessage, consumer chan InputMessage, mouse *MouseState, close <-chan bool, config *Config, keymap *Keymap, dev evdev.InputDevice) error {
+	logger := HandlerLogger("keyboard", &dev)
 	keysDown := make([]uint16, 0)
-	err := dev.Grab()
+	actions, _ := ParseMouseActions(config.MouseActions, keymap) // validated at startup
+	var buttons uint8 = 0x0
+	debouncer := NewDebouncer(time.Duration(config.DebounceMs) * time.Millisecond)
+	hotkeys, _ := ParseHotkeys(config.Hotkeys, keymap) // validated at startup
+	rules, _ := ParseRules(config.Rules) // validated at startup
+	allowlist, _ := ParseKeyAllowlist(config.AllowKeys, keymap) // validated at startup
+	rawScancodes, _ := ParseRawScancodes(config.RawScancodes, keymap) // validated at startup
+	// Hardware scancode from the MSC_SCAN event preceding a key event in the
+	// same frame
+	var scan uint32
+	scanValid := false
+	err := GrabDevice(logger, &dev, config.GrabWait, config.GrabRetries, time.Duration(config.GrabBackoffMs)*time.Millisecond, time.Duration(config.GrabTimeoutMs)*time.Millisecond, close)
+	if err == ErrGrabAborted {
+		dev.File.Close()
+		output <- nil
+		return nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		if err != ErrDeviceBusy {
+			logger.Errorf("Failed to grab %s (%s): %s", dev.Name, dev.Fn, err.Error())
+		}
+		// A timed out grab closes the device once it returns
+		if !errors.Is(err, ErrGrabTimeout) {
+			dev.File.Close()
+		}
 		output <- err
 		return err
 	}
-	defer dev.Release()
+	defer ReleaseDevice(logger, &dev)
+	defer mouse.Remove(dev.Fn)
+	stop := WatchStop(close, &dev)
+	defer stop.Release()
+	mouseKeys := NewMouseKeys(mouse, config.MouseKeysSpeed, config.MouseKeysAccel, config.MouseKeysMaxSpeed)
+	defer mouseKeys.Stop()
+	Devices.SetState(dev.Fn, DEVICE_GRABBED)
+	info := Devices.Get(dev.Fn)
+	watchdog := NewSilenceWatchdog(time.Duration(config.SilenceTimeout) * time.Second)
+	unhandled := NewUnhandledCounter(logger, &dev, time.Duration(config.LogUnhandled)*time.Second)
+	engine := NewRuleEngine(rules, &dev)
+	group := JoinKeyboardGroup(&dev)
+	defer group.Leave(dev.Fn)
+	role := ClassifyKeyboardRole(&dev)
+	// Whether a power key or a media key sent as consumer control is held,
+	// for releasing it on exit
+	systemHeld := false
+	consumerHeld := false
+	// Release the device's keys on the host however the handler exits, eg.
+	// when a Bluetooth keyboard disconnects with a key held
+	defer func() {
+		ReleaseKeyboard(group, dev.Fn, input, system, consumer, systemHeld, consumerHeld)
+	}()
+	if siblings := group.Siblings(dev.Fn); len(siblings) > 0 {
+		logger.Infof("%s (%s) is the %s node of a keyboard also on %s, sharing held keys with them", dev.Name, dev.Fn, role, strings.Join(siblings, ", "))
+	}
+	frame := NewKeyFrame(time.Duration(config.ChordWindowMs) * time.Millisecond)
+	sendKeys := func(since time.Duration) {
+		frame.Sent()
+		keysToSend := BuildKeyboardReport(group.Set(dev.Fn, RemapModifiers(keysDown)))
+		SendInput(input, InputMessage{
+			Timestamp: since,
+			Message:   keysToSend,
+		}, config.KbdDropPolicy)
+		Limited.Debugf(logger, "Key status: %v", keysToSend)
+	}
 
-	log.Infof("Grabbed keyboard-like device: %s (%s)", dev.Name, dev.Fn)
+	logger.Infof("Grabbed keyboard-like device: %s", DeviceLogName(&dev))
 	syscall.SetNonblock(int(dev.File.Fd()), true)
 
-	log.Infof("Setting repeat rate to %d, delay %d for %s (%s)", rate, delay, dev.Name, dev.Fn)
-	dev.SetRepeatRate(rate, delay)
+	repeat, delay := config.RepeatFor(&dev)
+	logger.Infof("Setting repeat rate to %d, delay %d for %s (%s)", repeat, delay, dev.Name, dev.Fn)
+	if err := SetRepeat(&dev, repeat, delay); err != nil {
+		logger.Warnf("Failed to set repeat rate for %s (%s): %s", dev.Name, dev.Fn, err.Error())
+	}
 
-	loop := 0
 	for {
-		err = dev.File.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		unhandled.Log()
+		if frame.Due(time.Now()) {
+			sendKeys(frame.Since())
+		}
+		err = dev.File.SetReadDeadline(frame.Deadline(time.Now().Add(250 * time.Millisecond)))
 		if err != nil {
-			log.Fatal(err)
+			logger.Errorf("Failed to set read deadline for %s (%s): %s", dev.Name, dev.Fn, err.Error())
 			output <- err
 			return err
 		}
+		if stop.Stopped() {
+			logger.Infof("Stopping processing keyboard input from: %s (%s)", dev.Name, dev.Fn)
+			output <- nil
+			return nil
+		}
 
 		event, err := dev.ReadOne()
-		if err != nil && strings.Contains(err.Error(), "i/o timeout") {
-			continue
-		}
 		if err != nil {
-			log.Fatal(err)
+			switch ClassifyReadError(err) {
+			case READ_TIMEOUT, READ_TRANSIENT:
+				if watchdog.Expired() {
+					if err := ProbeDevice(&dev); err != nil {
+						logger.Warnf("Device %s (%s) silent and not responding (%s), restarting its handler", dev.Name, dev.Fn, err.Error())
+						output <- err
+						return err
+					}
+				}
+				continue
+			case READ_DEVICE_GONE:
+				logger.Infof("Device gone (%s), stopping processing input from: %s (%s)", err.Error(), dev.Name, dev.Fn)
+				output <- nil
+				return nil
+			}
+			logger.Errorf("Failed to read from %s (%s): %s", dev.Name, dev.Fn, err.Error())
 			output <- err
 			return err
 		}
-		log.Debugf("Keyboard input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
+		if info != nil {
+			info.Activity()
+		}
+		watchdog.Kick()
+		CaptureLatencies["keyboard"].ObserveEvent(event.Time)
+		Limited.Debugf(logger, "Keyboard input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
+		if event.Type == evdev.EV_KEY && !allowlist.AllowsCode(event.Code) {
+			if config.LogDroppedKeys && event.Value == 1 {
+				logger.Infof("Dropping key not on the allowlist: %s", evdev.KEY[int(event.Code)])
+			}
+			continue
+		}
 		if event.Type == evdev.EV_KEY {
-			keyEvent := evdev.NewKeyEvent(event)
-			log.Debugf("Key event: scancode=%d, keycode=%d, state=%d", keyEvent.Scancode, keyEvent.Keycode, keyEvent.State)
-			if keyCode, ok := Scancodes[keyEvent.Scancode]; ok {
-				if keyEvent.State == 1 { // Key down
-					keyIsDown := false
-					for _, k := range keysDown {
-						if k == keyCode {
-							keyIsDown = true
-						}
+			if rule := engine.Apply(event.Code, event.Value); rule != nil {
+				switch rule.Action {
+				case RULE_REMAP:
+					Limited.Debugf(logger, "Rule remaps key %d to %d", event.Code, rule.To)
+					event.Code = rule.To
+					scanValid = false
+				case RULE_DROP:
+					Limited.Debugf(logger, "Rule drops key %d", event.Code)
+					continue
+				case RULE_SEQUENCE:
+					if event.Value == 1 {
+						logger.Infof("Rule for key %d sends sequence: %s", event.Code, rule.Sequence)
+						go SendSequence(input, rule.Sequence)
+					}
+					continue
+				case RULE_COMMAND:
+					if event.Value == 1 {
+						logger.Infof("Rule for key %d runs command: %s", event.Code, rule.Command)
+						go func(command string) {
+							if err := Queues.Command(command); err != nil {
+								logger.Warnf("Rule command failed: %s", err.Error())
+							}
+						}(rule.Command)
 					}
-					if !keyIsDown {
-						keysDown = append(keysDown, keyCode)
+					if !rule.Forward {
+						continue
 					}
 				}
-				if keyEvent.State == 0 { // Key up
-					newKeysDown := make([]uint16, 0)
-					for _, k := range keysDown {
-						if k != keyCode {
-							newKeysDown = append(newKeysDown, k)
-						}
+			}
+		}
+		if action, ok := actions[event.Code]; ok && event.Type == evdev.EV_KEY {
+			if action.Moves() {
+				mouseKeys.Key(event.Code, action, event.Value)
+			}
+			buttons, keysDown = action.Apply(buttons, keysDown, event.Value, mouse)
+			mouse.SetButtons(dev.Fn, buttons)
+			if action.SendsKey(event.Value) {
+				sendKeys(hrtime.Now())
+			}
+			recordHeld(logger, config, keymap, &dev, keysDown, buttons)
+		} else if event.Type == evdev.EV_KEY {
+			keyEvent := evdev.NewKeyEvent(event)
+			Limited.Debugf(logger, "Key event: scancode=%d, keycode=%d, state=%d", keyEvent.Scancode, keyEvent.Keycode, keyEvent.State)
+			route := RouteKey(role, keyEvent.Scancode, system != nil, consumer != nil)
+			if route == ROUTE_SYSTEM {
+				usage := SystemControlKeys[keyEvent.Scancode]
+				if !allowlist.AllowsSystem(keyEvent.Scancode) {
+					if config.LogDroppedKeys && keyEvent.State == 1 {
+						logger.Infof("Dropping key not on the allowlist: %s", evdev.KEY[int(keyEvent.Scancode)])
 					}
-					keysDown = newKeysDown
-				}
-
-				var modifiers uint8 = 0
-				keysToSend := make([]uint8, 0)
-				for _, k := range keysDown {
-					switch {
-					case k == 224: // Left-Ctrl
-						modifiers |= LEFT_CONTROL
-					case k == 227: // Left-Cmd
-						modifiers |= LEFT_META
-					case k == 225: // Left-Shift
-						modifiers |= LEFT_SHIFT
-					case k == 226: // Left-Alt
-						modifiers |= LEFT_ALT
-					case k == 228: // Right-Ctrl
-						modifiers |= RIGHT_CONTROL
-					case k == 231: // Right-Cmd
-						modifiers |= RIGHT_META
-					case k == 229: // Right-Shift
-						modifiers |= RIGHT_SHIFT
-					case k == 230: // Right-Alt
-						modifiers |= RIGHT_ALT
-					default:
-						keysToSend = append(keysToSend, uint8(k))
+					continue
+				}
+				if keyEvent.State == 1 {
+					SendInput(system, InputMessage{Timestamp: hrtime.Now(), Message: BuildSystemControlReport(usage)}, config.KbdDropPolicy)
+					systemHeld = true
+				} else if keyEvent.State == 0 {
+					SendInput(system, InputMessage{Timestamp: hrtime.Now(), Message: BuildSystemControlReport(0)}, config.KbdDropPolicy)
+					systemHeld = false
+				}
+			} else if route == ROUTE_CONSUMER {
+				usage := ConsumerKeys[keyEvent.Scancode]
+				if !allowlist.AllowsConsumer(keyEvent.Scancode) {
+					if config.LogDroppedKeys && keyEvent.State == 1 {
+						logger.Infof("Dropping key not on the allowlist: %s", evdev.KEY[int(keyEvent.Scancode)])
 					}
+					continue
+				}
+				if keyEvent.State == 1 {
+					SendInput(consumer, InputMessage{Timestamp: hrtime.Now(), Message: BuildConsumerControlReport(usage)}, config.KbdDropPolicy)
+					consumerHeld = true
+				} else if keyEvent.State == 0 {
+					SendInput(consumer, InputMessage{Timestamp: hrtime.Now(), Message: BuildConsumerControlReport(0)}, config.KbdDropPolicy)
+					consumerHeld = false
 				}
-				keysToSend = append([]uint8{modifiers, 0}, keysToSend...)
-				if len(keysToSend) < 8 {
-					for i := len(keysToSend); i < 8; i++ {
-						keysToSend = append(keysToSend, uint8(0))
+			} else if keyCode, ok := keyUsage(logger, keymap, keyEvent.Scancode, scan, scanValid, rawScancodes); ok {
+				if !allowlist.Allows(keyCode) {
+					if config.LogDroppedKeys && keyEvent.State == 1 {
+						logger.Infof("Dropping key not on the allowlist: %s", keymap.UsageNames([]uint16{keyCode})[0])
 					}
+					continue
 				}
-				input <- InputMessage{
-					Timestamp: hrtime.Now(),
-					Message: keysToSend,
+				if keyEvent.State != 2 && debouncer.Bounce(keyCode, keyEvent.State == 1, time.Unix(0, event.Time.Nano())) {
+					Limited.Debugf(logger, "Ignoring key chatter (scancode %d, keycode %d, state %d)", keyEvent.Scancode, keyCode, keyEvent.State)
+					continue
 				}
-
-				log.Debugf("Key status (scancode %d, keycode %d): %v\n", keyEvent.Scancode, keyCode, keysToSend)
+				// A hotkey's keys are held without sending a report
+				if keyEvent.State == 1 {
+					if hotkey := MatchHotkey(hotkeys, withKey(keysDown, keyCode)); hotkey != nil {
+						keysDown = withKey(keysDown, keyCode)
+						recordHeld(logger, config, keymap, &dev, keysDown, buttons)
+						logger.Infof("Hotkey pressed, sending sequence: %s", hotkey.Sequence)
+						go SendSequence(input, hotkey.Sequence)
+						continue
+					}
+				}
+				keysDown, _ = frame.Step(keysDown, event, keyCode, time.Now())
+				recordHeld(logger, config, keymap, &dev, keysDown, buttons)
+				Limited.Debugf(logger, "Key change (scancode %d, keycode %d, state %d)", keyEvent.Scancode, keyCode, keyEvent.State)
 			} else {
-				log.Warnf("Unknown scancode: %d\n", keyEvent.Scancode)
+				Limited.Warnf(logger, "Unknown scancode: %d\n", keyEvent.Scancode)
 			}
-		}
-		loop += 1
-		if loop > 3 {
-			select {
-			case _ = <-close:
-				log.Infof("Stopping processing keyboard input from: %s (%s)", dev.Name, dev.Fn)
-				output <- nil
-				return nil
-			default:
+		} else if event.Type == evdev.EV_MSC && event.Code == evdev.MSC_SCAN {
+			scan = uint32(event.Value)
+			scanValid = true
+		} else if event.Type == evdev.EV_SYN {
+			scanValid = false
+			if _, due := frame.Step(keysDown, event, 0, time.Now()); due {
+				sendKeys(frame.Since())
 			}
-			loop = 0
+		} else {
+			unhandled.Count(event)
 		}
 	}
+}
 
-	output <- nil
-	return nil
+// Returns the HID usage for a key event. Keys the kernel has no key code for
+// (KEY_UNKNOWN) or that have no HID usage are looked up by the hardware
+// scancode of the preceding MSC_SCAN event instead, if one was sent.
+func keyUsage(logger *log.Entry, keymap *Keymap, code uint16, scan uint32, scanValid bool, rawScancodes map[uint32]uint16) (uint16, bool) {
+	usage, ok := keymap.Lookup(code)
+	if ok && code != evdev.KEY_UNKNOWN {
+		return usage, true
+	}
+	if scanValid {
+		if raw, found := rawScancodes[scan]; found {
+			logger.Debugf("Key %d mapped by raw scancode 0x%x to HID usage %d", code, scan, raw)
+			return raw, true
+		}
+		logger.Debugf("No mapping for key %d with raw scancode 0x%x", code, scan)
+	}
+	return usage, ok
+}
+
+// Records the keys and buttons held on the device for GET /state, logging
+// changes if enabled
+func recordHeld(logger *log.Entry, config *Config, keymap *Keymap, dev *evdev.InputDevice, keysDown []uint16, buttons uint8) {
+	if Devices.SetHeld(dev.Fn, keysDown, buttons) && config.LogState {
+		logger.Infof("Held on %s (%s): keys %v, buttons 0x%02x", dev.Name, dev.Fn, keymap.UsageNames(keysDown), buttons)
+	}
+}
+
+// Builds a mouse report (buttons, X, Y, wheel, horizontal wheel) from the
+// button state and relative movement, which must already fit in the report
+func BuildMouseReport(buttons uint8, dx int32, dy int32, wheel int32, pan int32) []uint8 {
+	return Mouse.Build(buttons, dx, dy, wheel, pan)
 }
 
-func HandleMouse(output chan<- error, input chan<- InputMessage, close <-chan bool, dev evdev.InputDevice) error {
-	err := dev.Grab()
+// Length of the mouse report, as built by BuildMouseReport
+func MouseReportLength() int {
+	return len(BuildMouseReport(0, 0, 0, 0, 0))
+}
+
+func HandleMouse(output chan<- error, keyboard chan InputMessage, mouse *MouseState, close <-chan bool, config *Config, keymap *Keymap, dev evdev.InputDevice) error {
+	logger := HandlerLogger("mouse", &dev)
+	actions, _ := ParseMouseActions(config.MouseActions, keymap) // validated at startup
+	dial, _ := ParseDialAction(config.DialAction, keymap) // validated at startup
+	debouncer := NewDebouncer(time.Duration(config.DebounceMs) * time.Millisecond)
+	err := GrabDevice(logger, &dev, config.GrabWait, config.GrabRetries, time.Duration(config.GrabBackoffMs)*time.Millisecond, time.Duration(config.GrabTimeoutMs)*time.Millisecond, close)
+	if err == ErrGrabAborted {
+		dev.File.Close()
+		output <- nil
+		return nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		if err != ErrDeviceBusy {
+			logger.Errorf("Failed to grab %s (%s): %s", dev.Name, dev.Fn, err.Error())
+		}
+		// A timed out grab closes the device once it returns
+		if !errors.Is(err, ErrGrabTimeout) {
+			dev.File.Close()
+		}
 		output <- err
 		return err
 	}
-	defer dev.Release()
+	defer ReleaseDevice(logger, &dev)
+	stop := WatchStop(close, &dev)
+	defer stop.Release()
+	mouseKeys := NewMouseKeys(mouse, config.MouseKeysSpeed, config.MouseKeysAccel, config.MouseKeysMaxSpeed)
+	defer mouseKeys.Stop()
+	Devices.SetState(dev.Fn, DEVICE_GRABBED)
+	info := Devices.Get(dev.Fn)
+	watchdog := NewSilenceWatchdog(time.Duration(config.SilenceTimeout) * time.Second)
+	unhandled := NewUnhandledCounter(logger, &dev, time.Duration(config.LogUnhandled)*time.Second)
+	// Removing the device releases its buttons in the next mouse report,
+	// however the handler exits
+	defer mouse.Remove(dev.Fn)
+	// Keys the device's mouse actions hold on the host. They are sent merged
+	// with the keys held on its keyboard siblings (eg. of a keyboard with a
+	// touchpad), so that neither they nor the dial's taps release those.
+	var keysDown []uint16
+	group := JoinKeyboardGroup(&dev)
+	defer group.Leave(dev.Fn)
+	sendKeys := func(keys []uint16) {
+		SendInput(keyboard, InputMessage{Timestamp: hrtime.Now(), Message: BuildKeyboardReport(group.Set(dev.Fn, keys))}, config.KbdDropPolicy)
+	}
+	// Release the keys however the handler exits, without dropping the
+	// release (see ReleaseKeyboard)
+	defer func() {
+		if len(keysDown) > 0 {
+			SendInput(keyboard, InputMessage{Timestamp: hrtime.Now(), Message: BuildKeyboardReport(group.Set(dev.Fn, nil))}, DROP_OLDEST)
+		}
+	}()
 
-	log.Infof("Grabbed mouse-like device: %s (%s)", dev.Name, dev.Fn)
+	logger.Infof("Grabbed mouse-like device: %s", DeviceLogName(&dev))
+	scroll := NewScrollAccelerator(config.ScrollAccel)
+	hscroll := NewScrollAccelerator(config.ScrollAccel)
+	// Only touchpads and tablets are proxied as relative mice, other devices
+	// with absolute axes (eg. gamepads) report something else on them
+	var abs *AbsConverter
+	if deviceType := ClassifyDevice(&dev); config.AbsRelative && (deviceType == DEVICE_TOUCHPAD || deviceType == DEVICE_TABLET) {
+		abs = NewAbsConverter(&dev)
+	}
+	absWheel := NewAbsWheel(&dev)
+	var middle *MiddleEmulator
+	if config.EmulateMiddle {
+		middle = NewMiddleEmulator(MIDDLE_EMULATION_WINDOW)
+	}
 	syscall.SetNonblock(int(dev.File.Fd()), true)
 
-	loop := 0
 	var buttons uint8 = 0x0
+	frame := &MouseFrame{}
 	for {
-		err = dev.File.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		unhandled.Log()
+		deadline := time.Now().Add(250 * time.Millisecond)
+		if middle != nil {
+			if held := middle.Deadline(); !held.IsZero() && held.Before(deadline) {
+				deadline = held
+			}
+		}
+		err = dev.File.SetReadDeadline(deadline)
 		if err != nil {
-			log.Fatal(err)
+			logger.Errorf("Failed to set read deadline for %s (%s): %s", dev.Name, dev.Fn, err.Error())
 			output <- err
 			return err
 		}
+		if stop.Stopped() {
+			logger.Infof("Stopping processing mouse input from: %s (%s)", dev.Name, dev.Fn)
+			output <- nil
+			return nil
+		}
 
 		event, err := dev.ReadOne()
-		if err != nil && strings.Contains(err.Error(), "i/o timeout") {
-			continue
-		}
 		if err != nil {
-			log.Fatal(err)
+			switch ClassifyReadError(err) {
+			case READ_TIMEOUT, READ_TRANSIENT:
+				if middle != nil && middle.Expire(time.Now()) {
+					mouse.SetButtons(dev.Fn, middle.Report(buttons))
+				}
+				if watchdog.Expired() {
+					if err := ProbeDevice(&dev); err != nil {
+						logger.Warnf("Device %s (%s) silent and not responding (%s), restarting its handler", dev.Name, dev.Fn, err.Error())
+						output <- err
+						return err
+					}
+				}
+				continue
+			case READ_DEVICE_GONE:
+				logger.Infof("Device gone (%s), stopping processing input from: %s (%s)", err.Error(), dev.Name, dev.Fn)
+				output <- nil
+				return nil
+			}
+			logger.Errorf("Failed to read from %s (%s): %s", dev.Name, dev.Fn, err.Error())
 			output <- err
 			return err
 		}
-		log.Debugf("Mouse input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
+		if info != nil {
+			info.Activity()
+		}
+		watchdog.Kick()
+		CaptureLatencies["mouse"].ObserveEvent(event.Time)
+		Limited.Debugf(logger, "Mouse input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
 		var buttonOp bool = false
-		if event.Type == evdev.EV_KEY {
+		if event.Type == evdev.EV_KEY && debouncer.Bounce(event.Code, event.Value != 0, time.Unix(0, event.Time.Nano())) {
+			Limited.Debugf(logger, "Ignoring button chatter (code %d, value %d)", event.Code, event.Value)
+			continue
+		}
+		if action, ok := actions[event.Code]; ok && event.Type == evdev.EV_KEY {
+			if action.Moves() {
+				mouseKeys.Key(event.Code, action, event.Value)
+			}
+			buttons, keysDown = action.Apply(buttons, keysDown, event.Value, mouse)
+			if action.SendsKey(event.Value) {
+				sendKeys(keysDown)
+			}
+			buttonOp = true
+		} else if event.Type == evdev.EV_KEY {
 			if event.Code == 272 {
 				if event.Value > 0 {
 					buttons |= BUTTON_LEFT
@@ -524,126 +1024,448 @@ func HandleMouse(output chan<- error, input chan<- InputMessage, close <-chan bo
                                 buttonOp = true
                         }
 		}
-		if event.Type == evdev.EV_REL || buttonOp {
-			mouseToSend := make([]uint8, 0)
-			mouseToSend = append(mouseToSend, buttons)
-			if event.Type == evdev.EV_REL {
-				if event.Code == 0 {
-					mouseToSend = append(mouseToSend, uint8(event.Value))
-					mouseToSend = append(mouseToSend, 0x00)
-					mouseToSend = append(mouseToSend, 0x00)
-				}
-				if event.Code == 1 {
-					mouseToSend = append(mouseToSend, 0x00)
-					mouseToSend = append(mouseToSend, uint8(event.Value))
-					mouseToSend = append(mouseToSend, 0x00)
-				}
-				if event.Code == 8 {
-					mouseToSend = append(mouseToSend, 0x00)
-					mouseToSend = append(mouseToSend, 0x00)
-					mouseToSend = append(mouseToSend, uint8(event.Value))
+		if buttonOp {
+			// Movement before the button change goes out first
+			frame.Flush(mouse)
+		}
+		if buttonOp && middle != nil {
+			middle.Update(buttons, time.Now())
+			mouse.SetButtons(dev.Fn, middle.Report(buttons))
+		} else if buttonOp {
+			mouse.SetButtons(dev.Fn, buttons)
+		}
+		if buttonOp {
+			recordHeld(logger, config, keymap, &dev, nil, buttons)
+		}
+		if event.Type == evdev.EV_KEY && event.Code == evdev.BTN_TOUCH && event.Value == 0 {
+			if abs != nil {
+				abs.Reset()
+			}
+			absWheel.Reset()
+		}
+		if event.Type == evdev.EV_ABS && event.Code == evdev.ABS_WHEEL {
+			if ticks, ok := absWheel.Ticks(event.Value); ok {
+				wheel := scroll.Scale(ticks, time.Unix(0, event.Time.Nano()))
+				if config.NaturalScroll {
+					wheel = -wheel
 				}
-			} else {
-				mouseToSend = append(mouseToSend, 0x00)
-				mouseToSend = append(mouseToSend, 0x00)
-				mouseToSend = append(mouseToSend, 0x00)
+				frame.Move(0, 0, wheel)
 			}
-			input <- InputMessage{
-					Timestamp: hrtime.Now(),
-					Message: mouseToSend,
+		} else if event.Type == evdev.EV_ABS && abs != nil {
+			if delta, ok := abs.Delta(event.Code, event.Value); ok {
+				switch event.Code {
+				case evdev.ABS_X:
+					frame.Move(delta, 0, 0)
+				case evdev.ABS_Y:
+					frame.Move(0, delta, 0)
 				}
+			}
 		}
-		loop += 1
-		if loop > 3 {
-			select {
-			case _ = <-close:
-				log.Infof("Stopping processing mouse input from: %s (%s)", dev.Name, dev.Fn)
-				output <- nil
-				return nil
+		if event.Type == evdev.EV_REL {
+			switch event.Code {
+			case 0:
+				frame.Move(event.Value, 0, 0)
+			case 1:
+				frame.Move(0, event.Value, 0)
+			case 6: // REL_HWHEEL
+				pan := hscroll.Scale(event.Value, time.Unix(0, event.Time.Nano()))
+				if config.NaturalScroll {
+					pan = -pan
+				}
+				frame.Pan(pan)
+			case 7: // REL_DIAL
+				if !dial.Wheel {
+					dial.Turn(event.Value, keysDown, sendKeys)
+					break
+				}
+				fallthrough
+			case 8:
+				wheel := scroll.Scale(event.Value, time.Unix(0, event.Time.Nano()))
+				if config.NaturalScroll {
+					wheel = -wheel
+				}
+				frame.Move(0, 0, wheel)
 			default:
+				unhandled.Count(event)
 			}
-			loop = 0
+		} else if event.Type == evdev.EV_SYN {
+			switch event.Code {
+			case evdev.SYN_REPORT:
+				frame.Sync(mouse)
+			case evdev.SYN_DROPPED:
+				// The kernel's buffer overran, the frame is incomplete
+				frame.Drop()
+			}
+		} else if event.Type != evdev.EV_KEY && !(event.Type == evdev.EV_ABS && (abs != nil || event.Code == evdev.ABS_WHEEL)) {
+			unhandled.Count(event)
 		}
 	}
+}
 
-	output <- nil
-	return nil
+// Combines two consecutive reports into one with the same effect, returns
+// false if they can't be combined
+type MergeFunc func(first []byte, second []byte) ([]byte, bool)
 
+// Merges the reports already queued behind msg into it for as long as merge
+// allows. Returns the merged report and the queued report that couldn't be
+// merged, if any.
+func mergeQueued(input <-chan InputMessage, msg InputMessage, merge MergeFunc) (InputMessage, *InputMessage, int) {
+	merged := 0
+	for {
+		select {
+		case next, ok := <-input:
+			if !ok {
+				return msg, nil, merged
+			}
+			report, ok := merge(msg.Message, next.Message)
+			if !ok {
+				return msg, &next, merged
+			}
+			msg.Message = report
+			merged += 1
+		default:
+			return msg, nil, merged
+		}
+	}
 }
 
-func SendKeyboardReports(input <-chan InputMessage) error {
-	log.Info("Opening keyboard /dev/hidg0 for writing...")
-	file, err := os.OpenFile("/dev/hidg0", os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		log.Warn("Error opening /dev/hidg0, are you running as root?")
-		log.Fatal(err)
-		return err
+// Folds the next report into the one waiting for the next tick of the rate
+// cap, if nothing is lost by it
+func coalesceReport(pending []byte, next []byte, merge MergeFunc) ([]byte, bool) {
+	if bytes.Equal(pending, next) {
+		return next, true
 	}
-	defer file.Close()
+	if merge != nil {
+		return merge(pending, next)
+	}
+	return nil, false
+}
 
-	var avg, min, max, loop int64 = 0, 0, 0, 0
+// Settings for writing reports to a HID gadget device
+type WriterOptions struct {
+	// Report type (keyboard, mouse, system or consumer), for disabling it at
+	// runtime
+	Type string
+	// Prefix reports with this report ID, if non-zero
+	ReportId uint8
+	// Log latency statistics every this many reports
+	LatencyEvery int64
+	// Capture latency of the handlers building the reports, logged with the
+	// write latency if set
+	Capture *LatencyStats
+	// Write the pending report once per interval, if non-zero
+	Interval time.Duration
+	// Leave at least this long between writes, if non-zero
+	MinGap time.Duration
+	// Merge reports queued up behind the one being written, if set
+	Merge MergeFunc
+	// Repeat the last report after this long without input, if non-zero
+	Keepalive time.Duration
+	// Report repeated for keepalive before any other report has been written
+	Idle []byte
+	// Expected length of every report, including the report ID, if non-zero.
+	// Reports of any other length are dropped.
+	ReportLength int
+	// Write the reports returned by JiggleReports after this long without
+	// input, if non-zero
+	Jiggle time.Duration
+	// Reports to write when idle, given the last report written; none if nil
+	JiggleReports func(last []byte) [][]byte
+}
+
+// Writes reports from the input channel until it is closed, tracking the
+// latency from building each report to writing it out. With a non-zero
+// interval, the pending report is written once per interval, like a device
+// polled at that rate, and ticks without a new report are skipped. A report
+// arriving before the tick is folded into the pending one only if nothing is
+// lost by it: an identical report, or mouse motion the merge function adds
+// up. Any other report, eg. one changing the keys held, writes the pending
+// report right away and waits for the tick itself. Forced reports are never
+// held back for the tick. With a minimum gap, writes are spaced at least that
+// far apart. With a merge function, reports queued up behind the one being
+// written are merged into it to save writes (each write to a HID gadget is
+// exactly one report). Reports are not written while paused or while their
+// type is disabled, except forced ones.
+// With keepalive, the last report is written again whenever there's no input
+// for that long, which keeps the interface active without changing the state
+// on the host. With jiggle, the jiggle reports are written whenever there's
+// no input for that long, eg. to keep the host awake; they're never written
+// in between reports from the input. Reports not matching the device's report
+// length are dropped. The depth of the input queue is recorded with every
+// write, and every write is copied to the ReportSinks.
+func WriteReports(file io.Writer, name string, input <-chan InputMessage, latency *LatencyStats, throughput *ThroughputStats, opts WriterOptions) error {
+	logger := log.WithField("output", name)
+	file = Tee(file, name, ReportSinks)
+	var loop int64 = 0
+	var merges int = 0
+	var ticks <-chan time.Time
+	if opts.Interval > 0 {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var keepalive *time.Timer
+	var keepaliveC <-chan time.Time
+	if opts.Keepalive > 0 {
+		keepalive = time.NewTimer(opts.Keepalive)
+		defer keepalive.Stop()
+		keepaliveC = keepalive.C
+	}
+	var jiggle *time.Timer
+	var jiggleC <-chan time.Time
+	if opts.Jiggle > 0 && opts.JiggleReports != nil {
+		jiggle = time.NewTimer(opts.Jiggle)
+		defer jiggle.Stop()
+		jiggleC = jiggle.C
+	}
+	last := opts.Idle
+	var lastWrite time.Time
+	// Sleeps until the minimum gap since the previous write has passed
+	pace := func() {
+		if opts.MinGap > 0 {
+			if wait := opts.MinGap - time.Since(lastWrite); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}
+	// Writes a report, counting it for the metrics. Writes failing because
+	// the gadget was unbound while they were in flight are logged, and
+	// reported as not written.
+	write := func(report []byte) (int, bool, error) {
+		unbinds := GadgetUnbinds()
+		n, err := file.Write(report)
+		if err != nil && UnboundSince(unbinds) {
+			logger.Debugf("Write to %s failed while the gadget was unbound: %s", name, err.Error())
+			return n, false, nil
+		}
+		if err == nil {
+			CountReportWritten(opts.Type)
+		}
+		return n, err == nil, err
+	}
+	var held *InputMessage
+	// Latest report waiting for the next tick
+	var latest *InputMessage
 	for {
-		msg := <-input
-		bytesWritten, err := file.Write(msg.Message)
+		var msg InputMessage
+		if held != nil {
+			msg, held = *held, nil
+		} else {
+			select {
+			case next, ok := <-input:
+				if !ok {
+					if latest == nil {
+						return nil
+					}
+					// Write out the last state before returning
+					msg, latest = *latest, nil
+					break
+				}
+				if ticks != nil && !next.Forced {
+					if latest == nil {
+						latest = &next
+						continue
+					}
+					if report, ok := coalesceReport(latest.Message, next.Message, opts.Merge); ok {
+						latest.Message = report
+						continue
+					}
+					// Write the pending report now instead of replacing it,
+					// so that no press or release is lost
+					msg, latest = *latest, &next
+					break
+				}
+				if latest != nil {
+					// Forced reports are written right away, after the
+					// pending one
+					msg, held, latest = *latest, &next, nil
+					break
+				}
+				msg = next
+			case <-ticks:
+				if latest == nil {
+					continue
+				}
+				msg, latest = *latest, nil
+			case <-keepaliveC:
+				keepalive.Reset(opts.Keepalive)
+				if last == nil || !IsGadgetBound() {
+					continue
+				}
+				pace()
+				if _, _, err := write(last); err != nil {
+					return err
+				}
+				lastWrite = time.Now()
+				logger.Tracef("Wrote keepalive report to %s (%v)", name, last)
+				continue
+			case <-jiggleC:
+				jiggle.Reset(opts.Jiggle)
+				if IsPaused() || !IsEnabled(opts.Type) || !IsGadgetBound() {
+					continue
+				}
+				for _, report := range opts.JiggleReports(last) {
+					pace()
+					if _, _, err := write(report); err != nil {
+						return err
+					}
+					lastWrite = time.Now()
+					logger.Tracef("Wrote jiggle report to %s (%v)", name, report)
+				}
+				continue
+			}
+		}
+		if !IsGadgetBound() {
+			MarkReportWritten()
+			logger.Tracef("Gadget unbound, not writing report to %s (%v)", name, msg.Message)
+			continue
+		}
+		if IsPaused() && !msg.Forced {
+			MarkReportWritten()
+			logger.Tracef("Paused, not writing report to %s (%v)", name, msg.Message)
+			continue
+		}
+		if !IsEnabled(opts.Type) && !msg.Forced {
+			MarkReportWritten()
+			logger.Tracef("%s reports disabled, not writing report to %s (%v)", opts.Type, name, msg.Message)
+			continue
+		}
+		if opts.Merge != nil && !msg.Forced && held == nil {
+			var merged int
+			msg, held, merged = mergeQueued(input, msg, opts.Merge)
+			merges += merged
+		}
+		if opts.ReportId > 0 {
+			msg.Message = append([]byte{opts.ReportId}, msg.Message...)
+		}
+		if opts.ReportLength > 0 && len(msg.Message) != opts.ReportLength {
+			MarkReportWritten()
+			Limited.Logf(logger, log.ErrorLevel, "Dropping report of %d bytes to %s, the device takes %d byte reports (%v)", len(msg.Message), name, opts.ReportLength, msg.Message)
+			continue
+		}
+		pace()
+		bytesWritten, written, err := write(msg.Message)
 		if err != nil {
-			log.Fatal(err)
 			return err
-		} 
-		latency := hrtime.Since(msg.Timestamp).Nanoseconds()
-		if latency < min {
-			min = latency
 		}
-		if latency > max {
-			max = latency
+		lastWrite = time.Now()
+		MarkReportWritten()
+		if !written {
+			continue
+		}
+		last = msg.Message
+		if keepalive != nil {
+			if !keepalive.Stop() {
+				select {
+				case <-keepalive.C:
+				default:
+				}
+			}
+			keepalive.Reset(opts.Keepalive)
+		}
+		if jiggle != nil {
+			if !jiggle.Stop() {
+				select {
+				case <-jiggle.C:
+				default:
+				}
+			}
+			jiggle.Reset(opts.Jiggle)
 		}
-		avg = (avg + latency) / 2
+		now := hrtime.Since(msg.Timestamp)
+		latency.Observe(now)
+		depth := len(input)
+		if held != nil {
+			depth += 1
+		}
+		throughput.Observe(depth, cap(input))
 		loop += 1
-		if loop > 50 {
-			log.Debugf("Latency: now=%d, avg=%d, min=%d, max=%d μs", latency/1000, avg/1000, min/1000, max/1000)
+		if loop > opts.LatencyEvery {
+			summary := latency.Summary()
+			logger.Debugf("Latency: now=%d, mean=%d, min=%d, p50=%d, p95=%d, p99=%d, max=%d μs", now.Microseconds(), summary.Mean.Microseconds(), summary.Min.Microseconds(), summary.P50.Microseconds(), summary.P95.Microseconds(), summary.P99.Microseconds(), summary.Max.Microseconds())
+			if opts.Capture != nil {
+				capture := opts.Capture.Summary()
+				logger.Debugf("Capture latency: mean=%d, min=%d, p50=%d, p95=%d, p99=%d, max=%d μs", capture.Mean.Microseconds(), capture.Min.Microseconds(), capture.P50.Microseconds(), capture.P95.Microseconds(), capture.P99.Microseconds(), capture.Max.Microseconds())
+			}
+			rate := throughput.Summary()
+			logger.Debugf("Throughput: %.1f reports/s, queue depth %d (mean %.1f, max %d of %d)", rate.Rate, rate.Depth, rate.MeanDepth, rate.MaxDepth, rate.Capacity)
+			if merges > 0 {
+				logger.Debugf("Merged %d reports to %s, saving as many writes", merges, name)
+			}
 			loop = 0
 		}
 
-		log.Debugf("Wrote %d bytes to /dev/hidg0 (%v)", bytesWritten, msg)
+		Limited.Debugf(logger, "Wrote %d bytes to %s (%v)", bytesWritten, name, msg)
 	}
-	return nil
 }
 
-func SendMouseReports(input <-chan InputMessage) error {
-	log.Info("Opening keyboard /dev/hidg1 for writing...")
-	file, err := os.OpenFile("/dev/hidg1", os.O_APPEND|os.O_WRONLY, 0600)
+func SendKeyboardReports(path string, input <-chan InputMessage, ready chan<- bool, reportLength int, reportId uint8, interval time.Duration, keepalive time.Duration, minGap time.Duration) error {
+	log.Infof("Opening keyboard %s for writing...", path)
+	file, err := OpenHidOutput(path)
 	if err != nil {
-		log.Warn("Error opening /dev/hidg1, are you running as root?")
 		log.Fatal(err)
 		return err
 	}
 	defer file.Close()
+	ready <- true
 
-	var avg, min, max, loop int64 = 0, 0, 0, 0
-	for {
-		msg := <-input
-		bytesWritten, err := file.Write(msg.Message)
-		if err != nil {
-			log.Fatal(err)
-			return err
-		}
-		log.Debugf("Wrote %d bytes to /dev/hidg1 (%v)", bytesWritten, msg)
-		latency := hrtime.Since(msg.Timestamp).Nanoseconds()
-		if latency < min {
-			min = latency
-		}
-		if latency > max {
-			max = latency
-		}
-		avg = (avg + latency) / 2
-		loop += 1
-		if loop > 100 {
-			log.Debugf("Latency: now=%d, avg=%d, min=%d, max=%d μs", latency/1000, avg/1000, min/1000, max/1000)
-			loop = 0
-		}
+	idle := BuildKeyboardReport(nil)
+	if reportId > 0 {
+		idle = append([]byte{reportId}, idle...)
 	}
-	return nil
+	err = WriteReports(file, path, input, Latencies["keyboard"], Throughputs["keyboard"], WriterOptions{
+		Type:         "keyboard",
+		ReportId:     reportId,
+		LatencyEvery: 50,
+		Capture:      CaptureLatencies["keyboard"],
+		Interval:     interval,
+		MinGap:       minGap,
+		Keepalive:    keepalive,
+		Idle:         idle,
+		ReportLength: reportLength,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return err
 }
 
+func SendMouseReports(path string, input <-chan InputMessage, ready chan<- bool, reportLength int, batch bool, jiggle time.Duration) error {
+	log.Infof("Opening mouse %s for writing...", path)
+	file, err := OpenHidOutput(path)
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+	defer file.Close()
+	ready <- true
+
+	opts := WriterOptions{Type: "mouse", LatencyEvery: 100, Capture: CaptureLatencies["mouse"], ReportLength: reportLength}
+	if batch {
+		opts.Merge = MergeMouseReports
+	}
+	if jiggle > 0 {
+		opts.Jiggle = jiggle
+		opts.JiggleReports = MouseJiggle
+	}
+	err = WriteReports(file, path, input, Latencies["mouse"], Throughputs["mouse"], opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return err
+}
+
+// Consumes reports without writing them anywhere, for running without a gadget
+func DiscardReports(input <-chan InputMessage, ready chan<- bool) {
+	ready <- true
+	for msg := range input {
+		MarkReportWritten()
+		log.Debugf("Discarded report: %v", msg.Message)
+	}
+}
+
+// Returns the Bluetooth addresses of the devices known to the adapter that
+// are not connected
 func GetDisconnectedDevices(adapterId string) ([]string, error) {
 	log.Debugf("Getting adapter: %s", adapterId)
 	a, err := adapter.GetAdapter(adapterId)
@@ -658,7 +1480,6 @@ func GetDisconnectedDevices(adapterId string) ([]string, error) {
 	}
 
 	disconnected := make([]string, 0)
-	connected := make([]string, 0)
 	for _, dev := range devices {
 		address, err := dev.GetAddress()
 		if err != nil {
@@ -674,158 +1495,565 @@ func GetDisconnectedDevices(adapterId string) ([]string, error) {
 		if err == nil {
 			if !deviceConnected {
 				log.Infof("Device %s is disconnected.", name)
-				disconnected = append(disconnected, name)
+				disconnected = append(disconnected, address)
 			} else {
 				log.Infof("Device %s is still connected.", name)
-				connected = append(connected, name)
 			}
 		}
 	}
-	results := make([]string, 0)
-	for _, dname := range disconnected {
-		ok := true
-		for _, cname := range connected {
-			if cname == dname {
-				ok = false
-				break
-			}
-		}
-		if ok {
-			inResults := false
-			for _, rname := range results {
-				if rname == dname {
-					inResults = true
-				}
-			}
-			if !inResults {
-				results = append(results, dname)
-			}
-		}
-	}
-	return results, nil
+	return disconnected, nil
 }
 
-func main() {
+// Runs the proxy until it is stopped
+func RunProxy(config Config, dumpConfig string) {
 	var wg sync.WaitGroup
-	logLevelPtr := flag.String("loglevel", "warn", "log level (panic, fatal, error, warn, info, debug, trace)")
-	setupHid := flag.Bool("setuphid", true, "setup HID files on startup")
-	setupMouse := flag.Bool("mouse", true, "setup mouse(s)")
-	setupKeyboard := flag.Bool("keyboard", true, "setup keyboard(s)")
-	monitorUdev := flag.Bool("monitor-udev", true, "monitor udev & BlueZ events for disconnects")
-	adapterId := flag.String("bluez-adapter", "hci0", "BlueZ adapter (default hci0)")
-	kbdRepeat := flag.Int("kbdrepeat", 62, "set keyboard repeat rate (default 62)")
-	kbdDelay := flag.Int("kbddelay", 300, "set keyboard repeat delay in ms (default 300)")
-	flag.Parse()
-
-	logLevel, err := log.ParseLevel(*logLevelPtr)
+	Limited = NewRateLimiter(time.Second, config.LogRateLimit)
+
+	keymap, err := setupReportLayouts(config)
 	if err != nil {
-		panic(err)
+		log.Fatalf("Invalid configuration: %s", err.Error())
+	}
+	if config.Hwdb != "" {
+		if err := keymap.WatchRemappings(config.Hwdb); err != nil {
+			log.Warnf("Failed to watch %s for changes: %s", config.Hwdb, err.Error())
+		}
+	}
+
+	if effective, err := json.Marshal(config.Effective(keymap)); err == nil {
+		log.Infof("Effective configuration: %s", effective)
+	}
+	if dumpConfig != "" {
+		if err := config.Dump(dumpConfig, keymap); err != nil {
+			log.Fatalf("Failed to dump configuration to %s: %s", dumpConfig, err.Error())
+		}
+	}
+
+	CheckStaleInstances()
+	if len(config.Devices) > 0 {
+		log.Infof("Only handling the devices given with -device: %s", strings.Join(config.Devices, ", "))
+	}
+
+	if _, err := ParseHotkeys(config.Hotkeys, keymap); err != nil {
+		log.Fatalf("Invalid hotkey configuration: %s", err.Error())
+	}
+	if _, err := ParseMouseActions(config.MouseActions, keymap); err != nil {
+		log.Fatalf("Invalid mouse action configuration: %s", err.Error())
+	}
+	if _, err := ParseDialAction(config.DialAction, keymap); err != nil {
+		log.Fatalf("Invalid dial action: %s", err.Error())
+	}
+	if _, err := ParseRules(config.Rules); err != nil {
+		log.Fatalf("Invalid rule configuration: %s", err.Error())
+	}
+	if _, err := ParseKeyAllowlist(config.AllowKeys, keymap); err != nil {
+		log.Fatalf("Invalid key allowlist: %s", err.Error())
+	}
+	if _, err := ParseRawScancodes(config.RawScancodes, keymap); err != nil {
+		log.Fatalf("Invalid raw scancode configuration: %s", err.Error())
+	}
+	if config.DeviceLimitPolicy != DEVICE_LIMIT_REJECT && config.DeviceLimitPolicy != DEVICE_LIMIT_EVICT {
+		log.Fatalf("Invalid device limit policy: %s (expected %s or %s)", config.DeviceLimitPolicy, DEVICE_LIMIT_REJECT, DEVICE_LIMIT_EVICT)
+	}
+	if sinks, err := OpenSinks(config.Tee); err != nil {
+		log.Fatalf("Failed to set up -tee: %s", err.Error())
+	} else {
+		ReportSinks = sinks
+	}
+	if config.ExitWhenIdle < 0 {
+		log.Fatalf("Invalid idle time to exit after: %d (expected 0 or more seconds)", config.ExitWhenIdle)
+	}
+	if config.MouseQuantize < 0 || int32(config.MouseQuantize) > Mouse.MaxDelta() {
+		log.Fatalf("Invalid mouse quantization: %d (expected 0-%d)", config.MouseQuantize, Mouse.MaxDelta())
+	}
+	if !(config.MouseScale > 0) || math.IsInf(config.MouseScale, 0) || config.MouseScale > MOUSE_SCALE_MAX {
+		log.Fatalf("Invalid mouse scale: %g (expected more than 0, up to %d)", config.MouseScale, MOUSE_SCALE_MAX)
+	}
+	if config.JiggleInterval < 0 {
+		log.Fatalf("Invalid jiggle interval: %d (expected 0 or more seconds)", config.JiggleInterval)
+	}
+	if config.GrabRetries < 0 || config.GrabBackoffMs < 0 {
+		log.Fatalf("Invalid grab retries: %d retries, %d ms backoff (expected 0 or more)", config.GrabRetries, config.GrabBackoffMs)
+	}
+	if config.MouseKeysSpeed < 1 || config.MouseKeysMaxSpeed < config.MouseKeysSpeed || config.MouseKeysAccel < 0 {
+		log.Fatalf("Invalid mouse keys speed: %d to %d, acceleration %g (expected a speed of at least 1, a maximum of at least the speed and an acceleration of 0 or more)", config.MouseKeysSpeed, config.MouseKeysMaxSpeed, config.MouseKeysAccel)
+	}
+	if config.GrabTimeoutMs < 0 {
+		log.Fatalf("Invalid grab timeout: %d ms (expected 0 or more)", config.GrabTimeoutMs)
+	}
+	if config.ChordWindowMs < 0 || config.ChordWindowMs > CHORD_WINDOW_MAX_MS {
+		log.Fatalf("Invalid chord window: %d ms (expected 0-%d)", config.ChordWindowMs, CHORD_WINDOW_MAX_MS)
+	}
+	if config.IdleRate < 0 || config.IdleRate > 255 {
+		log.Fatalf("Invalid idle rate: %d (expected 0-255)", config.IdleRate)
+	}
+	if err := config.ValidateRepeat(); err != nil {
+		log.Fatalf("Invalid keyboard repeat configuration: %s", err.Error())
+	}
+	if err := config.Gadget.ValidateIds(); err != nil {
+		log.Fatalf("Invalid gadget configuration: %s", err.Error())
+	}
+	if config.LatencyExport != "" && config.LatencyExportInterval <= 0 {
+		log.Fatalf("Invalid latency export interval: %d (expected at least 1 second)", config.LatencyExportInterval)
+	}
+
+	if remap, modifiers, err := ParseModifiers(config.ModifierPreset, config.ModifierRemap, config.ModifierBits, keymap); err != nil {
+		log.Fatalf("Invalid modifier configuration: %s", err.Error())
+	} else {
+		ModifierRemap, Modifiers = remap, modifiers
+	}
+
+	if config.Output != OUTPUT_GADGET && config.Output != OUTPUT_UINPUT {
+		log.Fatalf("Invalid output: %s (expected %s or %s)", config.Output, OUTPUT_GADGET, OUTPUT_UINPUT)
+	}
+	if config.BindOnDemand && (!config.SetupHid || config.Output != OUTPUT_GADGET) {
+		log.Fatalf("Invalid -bind-on-demand: only possible with -setuphid and the %s output", OUTPUT_GADGET)
 	}
-	fmt.Printf("Set log level: %v\n", logLevel)
-	log.SetLevel(logLevel)
 
-	if *setupHid {
+	if config.SetupHid && config.Output == OUTPUT_GADGET {
 		log.Info("Setting up HID files...")
-		SetupUSBGadget()
+		if err := CheckModules(config.Modprobe); err != nil {
+			log.Errorf("Gadget setup is likely to fail: %s", err.Error())
+		}
+		SetupUSBGadget(CONFIGFS_GADGET_PATH, config.Gadget, time.Duration(config.WaitForUdc) * time.Second, !config.BindOnDemand)
 	}
 
 	keyboardInput := make(chan InputMessage, 10)
 	mouseInput := make(chan InputMessage, 100)
 	output := make(map[InputDevice]chan error, 0)
 	close := make(map[InputDevice]chan bool, 0)
+	busy := make(map[InputDevice]bool, 0)
+	// Devices not grabbed because of -max-devices, logged once
+	limited := make(map[InputDevice]bool, 0)
+	// Local console keyboards not grabbed with -protect-console, logged once
+	consoleKeyboards := make(map[InputDevice]bool, 0)
 
 	var udevCh <-chan *udev.Device
+	// Replaces udev events when udev isn't running
+	var disconnectPoll <-chan time.Time
 	var cancel context.CancelFunc
 	var ctx context.Context
 
 	defer api.Exit()
 	u := udev.Udev{}
-	if *monitorUdev {
+	if config.MonitorUdev {
 		log.Info("Starting udev monitoring for Bluetooth devices")
 		m := u.NewMonitorFromNetlink("udev")
 		m.FilterAddMatchSubsystem("bluetooth")
+		m.FilterAddMatchSubsystem("input")
 
 		ctx, cancel = context.WithCancel(context.Background())
-		udevCh, _ = m.DeviceChan(ctx)
+		defer cancel()
+		var err error
+		udevCh, err = m.DeviceChan(ctx)
+		if err == nil && !UdevRunning() {
+			err = fmt.Errorf("%s not found", UDEV_CONTROL_SOCKET)
+		}
+		if err != nil {
+			if config.DisconnectPollInterval > 0 {
+				log.Warnf("udev is not available (%s), polling Bluetooth devices every %d seconds instead", err.Error(), config.DisconnectPollInterval)
+				ticker := time.NewTicker(time.Duration(config.DisconnectPollInterval) * time.Second)
+				defer ticker.Stop()
+				disconnectPoll = ticker.C
+			} else {
+				log.Warnf("udev is not available (%s), Bluetooth disconnects won't be detected", err.Error())
+			}
+		}
+	}
+	bluetooth := NewBluetoothTracker()
+	if config.MonitorUdev {
+		if err := bluetooth.Update(config.BluezAdapter); err != nil {
+			log.Warnf("Failed to read Bluetooth devices: %s", err.Error())
+		}
+	}
+
+	writersReady := make(chan bool, 4)
+	var systemControlInput chan InputMessage
+	if config.Gadget.SystemControl {
+		systemControlInput = make(chan InputMessage, 10)
+	}
+	var consumerControlInput chan InputMessage
+	if config.Gadget.ConsumerControl {
+		consumerControlInput = make(chan InputMessage, 10)
+	}
+	if config.Output == OUTPUT_UINPUT {
+		loopback, err := NewUinputDevice()
+		if err != nil {
+			log.Fatalf("Failed to set up uinput output: %s", err.Error())
+		}
+		defer loopback.Close()
+		go SendUinputReports(loopback.Keyboard(keymap), "uinput keyboard", "keyboard", keyboardInput, writersReady, config.ReportInterval())
+		go SendUinputReports(loopback.Mouse(), "uinput mouse", "mouse", mouseInput, writersReady, 0)
+		if systemControlInput != nil {
+			go SendUinputReports(loopback.SystemControl(), "uinput system control", "system", systemControlInput, writersReady, 0)
+		}
+		if consumerControlInput != nil {
+			go SendUinputReports(loopback.ConsumerControl(), "uinput consumer control", "consumer", consumerControlInput, writersReady, 0)
+		}
+	} else if !config.SetupHid && !pathsExist("/dev/hidg0", "/dev/hidg1")() {
+		// Not a gadget (eg. a PC used only for capturing input)
+		log.Warn("No HID gadget devices and -setuphid=false, running as a capture only node")
+		go DiscardReports(keyboardInput, writersReady)
+		go DiscardReports(mouseInput, writersReady)
+		if systemControlInput != nil {
+			go DiscardReports(systemControlInput, writersReady)
+		}
+		if consumerControlInput != nil {
+			go DiscardReports(consumerControlInput, writersReady)
+		}
+	} else {
+		keyboardDevice, err := HidDeviceFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, "hid.usb0", KeyboardReportLength(config.Gadget.KeyboardReportId), "/dev/hidg0")
+		if err != nil {
+			log.Fatalf("Keyboard HID function not usable: %s", err.Error())
+		}
+		mouseDevice, err := HidDeviceFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, "hid.usb1", MouseReportLength(), "/dev/hidg1")
+		if err != nil {
+			log.Fatalf("Mouse HID function not usable: %s", err.Error())
+		}
+		go SendKeyboardReports(keyboardDevice, keyboardInput, writersReady, ReportLengthFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, "hid.usb0", KeyboardReportLength(config.Gadget.KeyboardReportId)), config.Gadget.KeyboardReportId, config.ReportInterval(), config.KeyboardKeepalive(), time.Duration(config.MinReportGapMs)*time.Millisecond)
+		go SendMouseReports(mouseDevice, mouseInput, writersReady, ReportLengthFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, "hid.usb1", MouseReportLength()), config.BatchWrites, time.Duration(config.JiggleInterval)*time.Second)
+		if systemControlInput != nil {
+			systemControlDevice, err := HidDeviceFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, "hid.usb2", SystemControlReportLength(), "/dev/hidg2")
+			if err != nil {
+				log.Fatalf("System control HID function not usable: %s", err.Error())
+			}
+			go SendSystemControlReports(systemControlDevice, systemControlInput, writersReady, ReportLengthFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, "hid.usb2", SystemControlReportLength()))
+		}
+		if consumerControlInput != nil {
+			consumerControlDevice, err := HidDeviceFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, "hid.usb3", ConsumerControlReportLength(), config.Gadget.ConsumerControlNode())
+			if err != nil {
+				log.Fatalf("Consumer control HID function not usable: %s", err.Error())
+			}
+			go SendConsumerControlReports(consumerControlDevice, consumerControlInput, writersReady, ReportLengthFor(CONFIGFS_GADGET_PATH, config.Gadget.Name, "hid.usb3", ConsumerControlReportLength()))
+		}
+		go WatchUDCState(CONFIGFS_GADGET_PATH, config.Gadget.Name)
+	}
+	mouseState := NewMouseState()
+	mouseState.SetAxes(AxisTransform{InvertX: config.InvertX, InvertY: config.InvertY, SwapXY: config.SwapXY})
+	mouseState.SetQuantum(config.MouseQuantize)
+	mouseState.SetScale(config.MouseScale)
+	mouseInterval := config.ReportInterval()
+	if config.SmoothSteps > 0 && config.SmoothMs > 0 {
+		step := mouseState.Smooth(config.SmoothSteps, time.Duration(config.SmoothMs)*time.Millisecond)
+		if step > mouseInterval {
+			mouseInterval = step
+		}
 	}
+	go mouseState.Emit(mouseInput, config.MouseDropPolicy, mouseInterval)
 
-	go SendKeyboardReports(keyboardInput)
-	go SendMouseReports(mouseInput)
+	queues := ReportQueues{Keyboard: keyboardInput, Mouse: mouseInput, System: systemControlInput, Consumer: consumerControlInput}
+	Queues = queues
+	if config.ControlFifo != "" {
+		go queues.WatchFifo(config.ControlFifo)
+	}
+	if config.ControlAddr != "" {
+		control := NewControlServer(queues, mouseState, keymap, config.ControlAddr, config.ControlToken)
+		go control.ListenAndServe()
+	}
+	if config.MetricsAddr != "" {
+		go ServeMetrics(config.MetricsAddr)
+	}
+	var latencyExport *LatencyExporter
+	if config.LatencyExport != "" {
+		latencyExport = NewLatencyExporter(config.LatencyExport)
+		go latencyExport.Run(time.Duration(config.LatencyExportInterval) * time.Second)
+		defer latencyExport.Save()
+	}
+	if config.SystemdNotify || config.TypeFile != "" {
+		<-writersReady
+		<-writersReady
+		if systemControlInput != nil {
+			<-writersReady
+		}
+		if consumerControlInput != nil {
+			<-writersReady
+		}
+	}
+	if config.SystemdNotify {
+		if ok, err := SdNotify("READY=1"); err != nil {
+			log.Warnf("Failed to notify systemd: %s", err.Error())
+		} else if !ok {
+			log.Warn("NOTIFY_SOCKET not set, not running under systemd?")
+		} else if interval := SdWatchdogInterval(); interval > 0 {
+			go SdWatchdog(interval, keyboardInput, mouseInput, systemControlInput, consumerControlInput)
+		}
+	}
+	if config.TypeFile != "" {
+		go func() {
+			if err := TypeFile(keyboardInput, config.TypeFile, time.Duration(config.TypeDelayMs)*time.Millisecond); err != nil {
+				log.Errorf("Failed to type %s: %s", config.TypeFile, err.Error())
+			}
+			if config.TypeFileExit {
+				// Let the writer catch up before exiting
+				for len(keyboardInput) > 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+				time.Sleep(SEQUENCE_STEP_DELAY)
+				log.Infof("Typed %s, exiting", config.TypeFile)
+				latencyExport.Save()
+				os.Exit(0)
+			}
+		}()
+	}
+	// Asks BlueZ for the Bluetooth devices that have disconnected, in the
+	// background so that a slow D-Bus doesn't hold up the main loop, which
+	// stops their handlers once the addresses come back. A check asked for
+	// while one is running is run once that is done.
+	disconnectedCh := make(chan []string, 1)
+	checking, checkAgain := false, false
+	checkDisconnected := func() {
+		if checking {
+			checkAgain = true
+			return
+		}
+		checking = true
+		go func() {
+			if err := bluetooth.Update(config.BluezAdapter); err != nil {
+				log.Warnf("Failed to read Bluetooth devices: %s", err.Error())
+			}
+			disconnected, err := GetDisconnectedDevices(config.BluezAdapter)
+			if err != nil {
+				log.Errorf("Error checking disconnected devices: %s", err.Error())
+			}
+			disconnectedCh <- disconnected
+		}()
+	}
+	stopDisconnected := func(disconnected []string) {
+		for _, address := range disconnected {
+			for devId, _ := range output {
+				// The kernel sets the uniq of Bluetooth input devices to
+				// the address
+				if info := Devices.Get(devId.Device); info != nil && strings.EqualFold(info.Address, address) {
+					log.Infof("Disconnected device, stopping listening to: %s (%s)", devId.Name, devId.Device)
+					select {
+					case close[devId] <- true:
+						log.Infof("Sent stop signal to: %s (%s)", devId.Name, devId.Device)
+					default:
+					}
+
+				}
+			}
+		}
+	}
+	exitWhenIdle := time.Duration(config.ExitWhenIdle) * time.Second
+	// When the last device handler exited, for -exit-when-idle
+	idleSince := time.Now()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	// Devices are rescanned when something changes in /dev/input and when a
+	// handler exits, or without inotify every second
+	rescanInterval := DEVICE_RESCAN_INTERVAL
+	deviceChanges, watchErr := WatchInputDevices(config.Devices)
+	if watchErr != nil {
+		log.Warnf("Failed to watch for input devices (%s), scanning for them every second instead", watchErr.Error())
+		rescanInterval = time.Second
+	}
+	rescanTicker := time.NewTicker(rescanInterval)
+	defer rescanTicker.Stop()
+	rescan := true
 	wg.Add(1)
 	for {
 		select {
 		case d := <-udevCh:
-			if d.Action() == "add" || d.Action() == "remove" {
-				disconnected, err := GetDisconnectedDevices(*adapterId)
-				if err != nil {
-					log.Errorf("Error checking disconnected devices: %s", err.Error())
-				} else {
-					for _, device := range disconnected {
-						for devId, _ := range output {
-							if strings.HasPrefix(devId.Name, device) {
-								log.Infof("Disconnected device, stopping listening to: %s (%s)", devId.Name, devId.Device)
+			if d.Subsystem() == "input" {
+				if address, ok := BluetoothInputAddress(d); ok && d.Action() == "add" {
+					go bluetooth.LogInputConnected(config.BluezAdapter, address, d.Devnode())
+				}
+			} else if d.Action() == "add" || d.Action() == "remove" {
+				log.Debugf("Bluetooth udev event: %s %s", d.Action(), d.Syspath())
+				checkDisconnected()
+			}
+		case <-disconnectPoll:
+			checkDisconnected()
+		default:
+		}
+
+		if rescan {
+			rescan = false
+			var devices []*evdev.InputDevice
+			if len(config.Devices) > 0 {
+				devices = OpenDevices(config.Devices)
+			} else {
+				devices, _ = evdev.ListInputDevices()
+			}
+			present := make(map[InputDevice]bool, 0)
+			seen := make(map[string]bool, 0)
+			// Devices given to a new handler, which closes them; the others
+			// are closed once scanned
+			handled := make(map[*evdev.InputDevice]bool, 0)
+			for _, dev := range devices {
+				deviceType := ClassifyDevice(dev)
+				log.Debugf("Device %s (%s), capabilities: %v (%s)", dev.Name, dev.Fn, dev.Capabilities, deviceType)
+				handler := DEVICE_IGNORED
+				switch deviceType {
+				case DEVICE_KEYBOARD:
+					if config.Keyboard {
+						handler = DEVICE_KEYBOARD
+					}
+				case DEVICE_MOUSE:
+					if config.Mouse {
+						handler = DEVICE_MOUSE
+					}
+				case DEVICE_TOUCHPAD, DEVICE_TABLET:
+					if config.Mouse && config.AbsRelative {
+						handler = DEVICE_MOUSE
+					}
+				}
+				if handler == DEVICE_IGNORED && deviceType != DEVICE_IGNORED {
+					// Listed in the control API, eg. gamepads
+					Devices.Seen(dev, string(deviceType))
+					seen[dev.Fn] = true
+				}
+				if handler != DEVICE_IGNORED {
+					devId := InputDevice{
+						Device: dev.Fn,
+						Name:   dev.Name,
+					}
+					present[devId] = true
+					if busy[devId] || config.IgnoresDevice(dev.Fn) {
+						continue
+					}
+					if _, ok := output[devId]; !ok && !StuckGrabs.Ready(dev.Fn, time.Now()) {
+						log.Debugf("Not grabbing %s (%s) yet, its last grab timed out", dev.Name, dev.Fn)
+						continue
+					}
+					if _, ok := output[devId]; !ok && handler == DEVICE_KEYBOARD && config.ProtectConsole {
+						if console, ok := ConsoleKeyboard(dev); ok {
+							if !consoleKeyboards[devId] {
+								log.Warnf("*** Not grabbing %s (%s): it is the keyboard of the local console (%s), grabbing it could lock you out. Run without -protect-console to grab it anyway. ***", dev.Name, dev.Fn, console)
+								consoleKeyboards[devId] = true
+							}
+							continue
+						}
+					}
+					if _, ok := output[devId]; !ok && config.MaxDevices > 0 && len(output) >= config.MaxDevices {
+						if config.DeviceLimitPolicy == DEVICE_LIMIT_EVICT && !limited[devId] {
+							if oldest := Devices.OldestIdle(); oldest != nil {
+								oldestId := InputDevice{Device: oldest.Path, Name: oldest.Name}
+								log.Warnf("Device limit (%d) reached, releasing the longest idle device %s (%s) for %s (%s)", config.MaxDevices, oldest.Name, oldest.Path, dev.Name, dev.Fn)
+								limited[oldestId] = true
 								select {
-								case close[devId] <- true:
-									log.Infof("Sent stop signal to: %s (%s)", devId.Name, devId.Device)
+								case close[oldestId] <- true:
 								default:
 								}
-
 							}
+						} else {
+							if !limited[devId] {
+								log.Warnf("Device limit (%d) reached, not grabbing %s (%s)", config.MaxDevices, dev.Name, dev.Fn)
+								limited[devId] = true
+							}
+							continue
 						}
 					}
+					if _, ok := output[devId]; !ok {
+						delete(limited, devId)
+						output[devId] = make(chan error, 10)
+						close[devId] = make(chan bool, 10)
+						if info := Devices.Add(dev, string(deviceType)); info.Address != "" {
+							if device, ok := bluetooth.Describe(info.Address); ok {
+								log.Infof("Input device %s (%s) belongs to Bluetooth device %s", dev.Name, dev.Fn, device)
+							}
+						}
+						if handler == DEVICE_KEYBOARD {
+							go HandleKeyboard(output[devId], keyboardInput, systemControlInput, consumerControlInput, mouseState, close[devId], &config, keymap, *dev)
+						} else {
+							go HandleMouse(output[devId], keyboardInput, mouseState, close[devId], &config, keymap, *dev)
+						}
+						handled[dev] = true
+						wg.Add(1)
+					}
 				}
 			}
-		default:
-		}
-
-		//log.Debugf("Polling for new devices in /dev/input")
-		devices, _ := evdev.ListInputDevices()
-		for _, dev := range devices {
-			isMouse := false
-			isKeyboard := false
-			for k := range dev.Capabilities {
-				if k.Name == "EV_REL" {
-					isMouse = true
+			for _, dev := range devices {
+				if !handled[dev] {
+					dev.File.Close()
 				}
-				if k.Name == "EV_KEY" {
-					isKeyboard = true
+			}
+			Devices.PruneSeen(seen)
+			// Devices grabbed by another process are retried only once they reappear
+			for id := range busy {
+				if !present[id] {
+					delete(busy, id)
 				}
 			}
-			log.Debugf("Device %s (%s), capabilities: %v (mouse=%t, kbd=%t)", dev.Name, dev.Fn, dev.Capabilities, isMouse, isKeyboard)
-			if isKeyboard || isMouse {
-				devId := InputDevice{
-					Device: dev.Fn,
-					Name:   dev.Name,
+			for id := range limited {
+				if !present[id] {
+					delete(limited, id)
 				}
-				if _, ok := output[devId]; !ok {
-					output[devId] = make(chan error, 10)
-					close[devId] = make(chan bool, 10)
-					if isKeyboard && !isMouse && *setupKeyboard {
-						go HandleKeyboard(output[devId], keyboardInput, close[devId], uint(*kbdRepeat), uint(*kbdDelay), *dev)
-						wg.Add(1)
-					}
-					log.Debugf("isKeyboard: %t, isMouse: %t, setupMouse: %t", !isKeyboard, isMouse, *setupMouse)
-					if isMouse && *setupMouse {
-						go HandleMouse(output[devId], mouseInput, close[devId], *dev)
-						wg.Add(1)
-					}
+			}
+			for id := range consoleKeyboards {
+				if !present[id] {
+					delete(consoleKeyboards, id)
 				}
 			}
 		}
-		time.Sleep(1000 * time.Millisecond)
+		select {
+		case sig := <-signals:
+			// A second signal terminates right away
+			signal.Stop(signals)
+			log.Infof("Received %s, releasing %d devices and exiting", sig, len(output))
+			if !StopHandlers(&wg, output, close, SHUTDOWN_TIMEOUT) {
+				log.Warnf("Device handlers didn't stop in %s, exiting anyway", SHUTDOWN_TIMEOUT)
+			}
+			queues.Flush(SHUTDOWN_TIMEOUT)
+			return
+		case <-deviceChanges:
+			rescan = true
+		case <-rescanTicker.C:
+			rescan = true
+		case disconnected := <-disconnectedCh:
+			checking = false
+			stopDisconnected(disconnected)
+			if checkAgain {
+				checkAgain = false
+				checkDisconnected()
+			}
+		case <-time.After(1000 * time.Millisecond):
+			// Checks on the handlers
+		}
 		for id, eventOutput := range output {
 			select {
 			case msg := <-eventOutput:
-				if msg == nil {
+				if msg == ErrDeviceBusy {
+					busy[id] = true
+				} else if msg == nil {
 					log.Warnf("Event handler quit: %s", id.Device)
 				} else {
 					log.Errorf("Received error from %s: %s", id.Device, msg.Error())
 				}
 				delete(output, id)
+				Devices.Remove(id.Device)
 				wg.Done()
+				rescan = true
 			default:
 			}
 		}
+		if config.BindOnDemand {
+			grabbed := Devices.CountState(DEVICE_GRABBED)
+			if grabbed > 0 && !IsGadgetBound() {
+				if err := BindGadget(CONFIGFS_GADGET_PATH, config.Gadget); err != nil {
+					log.Errorf("Failed to bind the gadget: %s", err.Error())
+				}
+			} else if grabbed == 0 && IsGadgetBound() {
+				log.Info("No devices grabbed, unbinding the gadget")
+				if err := UnbindGadget(CONFIGFS_GADGET_PATH, config.Gadget.Name); err != nil {
+					log.Errorf("Failed to unbind the gadget: %s", err.Error())
+				}
+			}
+		}
+		if exitWhenIdle > 0 {
+			if len(output) > 0 {
+				idleSince = time.Time{}
+			} else if idleSince.IsZero() {
+				idleSince = time.Now()
+			} else if time.Since(idleSince) >= exitWhenIdle {
+				log.Infof("No devices grabbed for %s, exiting", exitWhenIdle)
+				if config.SetupHid && config.Output == OUTPUT_GADGET {
+					if err := TeardownUSBGadget(CONFIGFS_GADGET_PATH, config.Gadget); err != nil {
+						log.Errorf("Failed to tear down the gadget: %s", err.Error())
+					}
+				}
+				return
+			}
+		}
 	}
-	cancel()
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Last report in the queue, emptying it
+func lastReport(queue chan InputMessage) []byte {
+	var last []byte
+	for len(queue) > 0 {
+		last = (<-queue).Message
+	}
+	return last
+}
+
+func TestReleaseKeyboardOnFullQueue(t *testing.T) {
+	group := &KeyboardGroup{held: make(map[string][]uint16, 0)}
+	input := make(chan InputMessage, 4)
+	system := make(chan InputMessage, 1)
+	consumer := make(chan InputMessage, 1)
+
+	// The keyboard disconnects with KEY_A and the power key held, while the
+	// writers are behind
+	keys := []uint16{Scancodes[30]}
+	for len(input) < cap(input) {
+		SendInput(input, InputMessage{Message: BuildKeyboardReport(group.Set("/dev/input/event3", keys))}, DROP_NEWEST)
+	}
+	system <- InputMessage{Message: BuildSystemControlReport(1)}
+	ReleaseKeyboard(group, "/dev/input/event3", input, system, consumer, true, false)
+
+	if last := lastReport(input); !bytes.Equal(last, BuildKeyboardReport(nil)) {
+		t.Errorf("last keyboard report %v, want the keys released", last)
+	}
+	if last := lastReport(system); !bytes.Equal(last, BuildSystemControlReport(0)) {
+		t.Errorf("last system control report %v, want the power key released", last)
+	}
+	if len(consumer) > 0 {
+		t.Errorf("consumer control released without a key held on it")
+	}
+}
+
+func TestReleaseKeyboardKeepsSiblingKeys(t *testing.T) {
+	group := &KeyboardGroup{held: make(map[string][]uint16, 0)}
+	input := make(chan InputMessage, 1)
+	sibling := []uint16{Scancodes[48]}
+	group.Set("/dev/input/event4", sibling)
+	group.Set("/dev/input/event3", []uint16{Scancodes[30]})
+
+	ReleaseKeyboard(group, "/dev/input/event3", input, nil, nil, false, false)
+	if last := lastReport(input); !bytes.Equal(last, BuildKeyboardReport(sibling)) {
+		t.Errorf("last keyboard report %v, want the sibling's KEY_B still held", last)
+	}
+}
+
+func TestSendInputKeepsForcedReports(t *testing.T) {
+	input := make(chan InputMessage, 2)
+	input <- InputMessage{Message: BuildKeyboardReport(nil), Forced: true}
+	input <- InputMessage{Message: []byte{1}}
+
+	if !SendInput(input, InputMessage{Message: []byte{2}}, DROP_OLDEST) {
+		t.Fatalf("newest report dropped, want the oldest unforced one dropped")
+	}
+	if first := <-input; !first.Forced {
+		t.Errorf("first queued report %v, want the forced release kept", first.Message)
+	}
+	if second := <-input; !bytes.Equal(second.Message, []byte{2}) {
+		t.Errorf("second queued report %v, want the newest report", second.Message)
+	}
+
+	// With only forced reports queued, the new report is the one dropped
+	input <- InputMessage{Message: []byte{3}, Forced: true}
+	input <- InputMessage{Message: []byte{4}, Forced: true}
+	if SendInput(input, InputMessage{Message: []byte{5}}, DROP_OLDEST) {
+		t.Errorf("report queued over forced reports")
+	}
+	if len(input) != 2 || !bytes.Equal((<-input).Message, []byte{3}) || !bytes.Equal((<-input).Message, []byte{4}) {
+		t.Errorf("forced reports not kept in order")
+	}
+}
+
+func TestSendInputKeepsForcedReportsInOrder(t *testing.T) {
+	input := make(chan InputMessage, 3)
+	input <- InputMessage{Message: []byte{0}, Forced: true}
+	input <- InputMessage{Message: []byte{1}}
+	input <- InputMessage{Message: []byte{2}}
+
+	if !SendInput(input, InputMessage{Message: []byte{3}}, DROP_OLDEST) {
+		t.Fatalf("newest report dropped, want the oldest unforced one dropped")
+	}
+	for _, want := range []byte{0, 2, 3} {
+		if got := (<-input).Message; !bytes.Equal(got, []byte{want}) {
+			t.Errorf("got report %v, want [%d]: the forced release first, then the newer reports in order", got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+// Prometheus metrics, in the text exposition format
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Reports written to the host per report type. Every write is counted, so
+// keepalive and jiggle reports, which aren't sampled for latency, count too.
+var reportsWritten = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64, 0)}
+
+func CountReportWritten(reportType string) {
+	reportsWritten.Lock()
+	defer reportsWritten.Unlock()
+	reportsWritten.counts[reportType] += 1
+}
+
+func ReportsWritten(reportType string) uint64 {
+	reportsWritten.Lock()
+	defer reportsWritten.Unlock()
+	return reportsWritten.counts[reportType]
+}
+
+// Serves the latency histograms, the number of reports written and the number
+// of grabbed devices on /metrics
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	log.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Metrics server stopped: %s", err.Error())
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeLatencyHistogram(w, "hidproxy_write_latency_seconds", "Time from building a report to writing it.", Latencies)
+	writeLatencyHistogram(w, "hidproxy_capture_latency_seconds", "Time from the kernel timestamping an input event to its handler reading it.", CaptureLatencies)
+
+	fmt.Fprintf(w, "# HELP hidproxy_reports_written_total Reports written to the host.\n")
+	fmt.Fprintf(w, "# TYPE hidproxy_reports_written_total counter\n")
+	for _, name := range latencyNames(Latencies) {
+		fmt.Fprintf(w, "hidproxy_reports_written_total{type=%q} %d\n", name, ReportsWritten(name))
+	}
+
+	fmt.Fprintf(w, "# HELP hidproxy_grabbed_devices Input devices currently grabbed.\n")
+	fmt.Fprintf(w, "# TYPE hidproxy_grabbed_devices gauge\n")
+	fmt.Fprintf(w, "hidproxy_grabbed_devices %d\n", Devices.CountState(DEVICE_GRABBED))
+}
+
+func latencyNames(latencies map[string]*LatencyStats) []string {
+	names := make([]string, 0, len(latencies))
+	for name := range latencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Writes the statistics as a histogram with a series per type. Prometheus
+// buckets are cumulative, unlike the ones of LatencyStats.
+func writeLatencyHistogram(w http.ResponseWriter, metric string, help string, latencies map[string]*LatencyStats) {
+	fmt.Fprintf(w, "# HELP %s %s\n", metric, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", metric)
+	for _, name := range latencyNames(latencies) {
+		stats := latencies[name]
+		var cumulative uint64
+		for i, n := range stats.Histogram() {
+			cumulative += n
+			le := "+Inf"
+			if i < len(LATENCY_BUCKETS) {
+				le = strconv.FormatFloat(LATENCY_BUCKETS[i].Seconds(), 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{type=%q,le=%q} %d\n", metric, name, le, cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum{type=%q} %s\n", metric, name, strconv.FormatFloat(stats.Sum().Seconds(), 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{type=%q} %d\n", metric, name, cumulative)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportsWrittenCountsKeepalives(t *testing.T) {
+	before := ReportsWritten("mouse")
+	written := writeReports([][]byte{{1, 0, 0, 0}}, 50*time.Millisecond, WriterOptions{Type: "mouse", Keepalive: 5 * time.Millisecond})
+	if len(written) < 2 {
+		t.Fatalf("got %d writes, want the report and keepalives", len(written))
+	}
+	count := ReportsWritten("mouse") - before
+	if count != uint64(len(written)) {
+		t.Errorf("counted %d reports written, want %d", count, len(written))
+	}
+
+	recorder := httptest.NewRecorder()
+	handleMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	want := fmt.Sprintf("hidproxy_reports_written_total{type=\"mouse\"} %d\n", ReportsWritten("mouse"))
+	if !strings.Contains(recorder.Body.String(), want) {
+		t.Errorf("metrics don't have %q:\n%s", want, recorder.Body.String())
+	}
+}
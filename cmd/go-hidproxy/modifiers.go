@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HID usages that set a modifier bit in keyboard reports instead of being
+// sent as keys, at the bits the host expects them
+var Modifiers = DefaultModifiers()
+
+// Keys of the input devices reported as another modifier, as HID usage to
+// the usage of the modifier. Only keys pressed on a device are remapped:
+// sequences and typed text are built with the standard modifiers, so that
+// eg. Ctrl+Alt+Del stays Ctrl+Alt+Del with Ctrl and Meta swapped.
+var ModifierRemap = map[uint16]uint16{}
+
+// Returns the keys held on a device with the modifier remapping applied
+func RemapModifiers(keys []uint16) []uint16 {
+	if len(ModifierRemap) == 0 {
+		return keys
+	}
+	remapped := make([]uint16, len(keys))
+	for i, k := range keys {
+		if usage, ok := ModifierRemap[k]; ok {
+			k = usage
+		}
+		remapped[i] = k
+	}
+	return remapped
+}
+
+func DefaultModifiers() map[uint16]uint8 {
+	return map[uint16]uint8{
+		224: LEFT_CONTROL,
+		225: LEFT_SHIFT,
+		226: LEFT_ALT,
+		227: LEFT_META,
+		228: RIGHT_CONTROL,
+		229: RIGHT_SHIFT,
+		230: RIGHT_ALT,
+		231: RIGHT_META,
+	}
+}
+
+var modifierNames = map[string]uint8{
+	"left-ctrl":   LEFT_CONTROL,
+	"left-shift":  LEFT_SHIFT,
+	"left-alt":    LEFT_ALT,
+	"left-meta":   LEFT_META,
+	"right-ctrl":  RIGHT_CONTROL,
+	"right-shift": RIGHT_SHIFT,
+	"right-alt":   RIGHT_ALT,
+	"right-meta":  RIGHT_META,
+}
+
+// Returns the HID usage of a modifier by name (see modifierNames). Names
+// without a side, eg. shift, are the left modifiers.
+func ModifierUsage(name string) (uint16, bool) {
+	name = strings.ToLower(name)
+	if !strings.HasPrefix(name, "left-") && !strings.HasPrefix(name, "right-") {
+		name = "left-" + name
+	}
+	bit, ok := modifierNames[name]
+	if !ok {
+		return 0, false
+	}
+	for usage, modifier := range DefaultModifiers() {
+		if modifier == bit {
+			return usage, true
+		}
+	}
+	return 0, false
+}
+
+// Common remappings, as evdev key name to modifier
+var ModifierPresets = map[string]map[string]string{
+	"swap-ctrl-meta": {
+		"KEY_LEFTCTRL":  "left-meta",
+		"KEY_LEFTMETA":  "left-ctrl",
+		"KEY_RIGHTCTRL": "right-meta",
+		"KEY_RIGHTMETA": "right-ctrl",
+	},
+	"caps-ctrl": {
+		"KEY_CAPSLOCK": "left-ctrl",
+	},
+}
+
+// Builds the modifier bit layout for hosts that expect the modifiers in
+// another order than the HID standard one, from modifier names to bit
+// positions (0-7), eg. {"left-ctrl": 1, "left-shift": 0, ...}. All eight
+// modifiers must be given, each at a different bit. Returns the bit each
+// standard modifier bit is moved to, nil for the standard layout.
+func ParseModifierBits(bits map[string]int) (map[uint8]uint8, error) {
+	if len(bits) == 0 {
+		return nil, nil
+	}
+	layout := make(map[uint8]uint8, len(modifierNames))
+	used := make(map[int]string, len(bits))
+	for name, bit := range bits {
+		modifier, ok := modifierNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown modifier: %s", name)
+		}
+		if bit < 0 || bit > 7 {
+			return nil, fmt.Errorf("bit for %s must be between 0 and 7, got %d", name, bit)
+		}
+		if other, ok := used[bit]; ok {
+			return nil, fmt.Errorf("%s and %s are both at bit %d", other, name, bit)
+		}
+		used[bit] = name
+		layout[modifier] = 1 << bit
+	}
+	for name := range modifierNames {
+		if _, ok := bits[name]; !ok {
+			return nil, fmt.Errorf("no bit given for %s, all eight modifiers are needed", name)
+		}
+	}
+	return layout, nil
+}
+
+// Builds the modifier remapping of device keys from the given presets (comma
+// separated) and remappings of evdev key names to modifiers, in that order,
+// and the modifier table from the defaults with the modifiers moved to the
+// bits given in the bit layout
+func ParseModifiers(presets string, remap map[string]string, bits map[string]int, keymap *Keymap) (map[uint16]uint16, map[uint16]uint8, error) {
+	remapped := make(map[uint16]uint16)
+	apply := func(remap map[string]string) error {
+		for name, modifier := range remap {
+			code, ok := KeyCode(name)
+			if !ok {
+				return fmt.Errorf("unknown key: %s", name)
+			}
+			usage, ok := keymap.Lookup(code)
+			if !ok {
+				return fmt.Errorf("key %s has no HID usage", name)
+			}
+			if _, ok := modifierNames[modifier]; !ok {
+				return fmt.Errorf("unknown modifier for %s: %s", name, modifier)
+			}
+			remapped[usage], _ = ModifierUsage(modifier)
+		}
+		return nil
+	}
+	for _, preset := range strings.Split(presets, ",") {
+		preset = strings.ToLower(strings.TrimSpace(preset))
+		if preset == "" {
+			continue
+		}
+		remap, ok := ModifierPresets[preset]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown modifier preset: %s", preset)
+		}
+		if err := apply(remap); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := apply(remap); err != nil {
+		return nil, nil, err
+	}
+	layout, err := ParseModifierBits(bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	modifiers := DefaultModifiers()
+	if layout != nil {
+		for usage, bit := range modifiers {
+			modifiers[usage] = layout[bit]
+		}
+	}
+	return remapped, modifiers, nil
+}
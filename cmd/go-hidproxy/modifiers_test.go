@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseModifiersPresets(t *testing.T) {
+	remap, modifiers, err := ParseModifiers(" Swap-Ctrl-Meta, caps-ctrl ", nil, nil, NewKeymap(Scancodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint16]uint16{
+		0xe0: 0xe3, // Left Control to Left GUI
+		0xe3: 0xe0,
+		0xe4: 0xe7, // Right Control to Right GUI
+		0xe7: 0xe4,
+		0x39: 0xe0, // Caps Lock to Left Control
+	}
+	if !reflect.DeepEqual(remap, want) {
+		t.Errorf("got remap %v, want %v", remap, want)
+	}
+	if !reflect.DeepEqual(modifiers, DefaultModifiers()) {
+		t.Errorf("got modifiers %v, want the default ones", modifiers)
+	}
+	if _, _, err := ParseModifiers("swap-ctrl-alt", nil, nil, NewKeymap(Scancodes)); err == nil {
+		t.Errorf("unknown preset accepted")
+	}
+}
+
+func TestRemapModifiersLeavesSequences(t *testing.T) {
+	remap, _, err := ParseModifiers("swap-ctrl-meta", nil, nil, NewKeymap(Scancodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := ModifierRemap
+	defer func() { ModifierRemap = saved }()
+	ModifierRemap = remap
+
+	steps, err := SequenceSteps("ctrl-alt-del")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := BuildKeyboardReport(steps[1]); report[0] != LEFT_CONTROL|LEFT_ALT || report[2] != USAGE_DELETE {
+		t.Errorf("got %v, want Left Control and Left Alt (0x05) with Delete", report)
+	}
+	// Left Control pressed on a device is sent as Left GUI
+	if report := BuildKeyboardReport(RemapModifiers([]uint16{0xe0})); report[0] != LEFT_META {
+		t.Errorf("got %v, want Left GUI for Left Control held on a device", report)
+	}
+}
+
+func TestParseModifiersBitLayout(t *testing.T) {
+	bits := map[string]int{
+		"left-ctrl": 1, "left-shift": 0, "left-alt": 2, "left-meta": 3,
+		"right-ctrl": 4, "right-shift": 5, "right-alt": 6, "right-meta": 7,
+	}
+	_, modifiers, err := ParseModifiers("", nil, bits, NewKeymap(Scancodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := Modifiers
+	defer func() { Modifiers = saved }()
+	Modifiers = modifiers
+	// Left Control and Left Shift swap bits in the modifier byte
+	if report := BuildKeyboardReport([]uint16{0xe0, 0x04}); report[0] != 1<<1 || report[2] != 0x04 {
+		t.Errorf("got %v, want Left Control at bit 1 and A in the first slot", report)
+	}
+	delete(bits, "right-meta")
+	if _, _, err := ParseModifiers("", nil, bits, NewKeymap(Scancodes)); err == nil {
+		t.Errorf("incomplete bit layout accepted")
+	}
+}
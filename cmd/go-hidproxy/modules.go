@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Kernel modules the USB gadget needs before it is set up
+var GADGET_MODULES = []string{"libcomposite"}
+
+// Module for the gadget's HID functions. The kernel loads it when the first
+// hid function directory is created in configfs, so it is only missing
+// before the gadget is set up or if the module isn't available at all.
+const HID_FUNCTION_MODULE = "usb_f_hid"
+
+// Driver for the USB device controller on the Raspberry Pi, needed only if
+// no controller is present yet
+const UDC_MODULE = "dwc2"
+
+// Returns true if the module is loaded or built into the kernel, which both
+// show up in /sys/module
+func ModuleLoaded(name string) bool {
+	_, err := os.Stat("/sys/module/" + strings.Replace(name, "-", "_", -1))
+	return err == nil
+}
+
+// Modules the gadget needs that aren't loaded
+func MissingModules() []string {
+	missing := make([]string, 0)
+	modules := append([]string{}, GADGET_MODULES...)
+	if len(UDCs()) == 0 {
+		modules = append(modules, UDC_MODULE)
+	}
+	for _, module := range modules {
+		if !ModuleLoaded(module) {
+			missing = append(missing, module)
+		}
+	}
+	return missing
+}
+
+// Checks that the kernel modules the gadget needs are loaded and, if
+// modprobe is set, tries to load the missing ones. Returns an error naming
+// the modules still missing.
+func CheckModules(modprobe bool) error {
+	missing := MissingModules()
+	if len(missing) > 0 && modprobe {
+		for _, module := range missing {
+			log.Infof("Loading kernel module %s", module)
+			if output, err := exec.Command("modprobe", module).CombinedOutput(); err != nil {
+				log.Warnf("Failed to load kernel module %s: %s (%s)", module, err.Error(), strings.TrimSpace(string(output)))
+			}
+		}
+		missing = MissingModules()
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("kernel modules not loaded: %s (load them with modprobe or add them to /etc/modules, dwc2 also needs dtoverlay=dwc2 in /boot/config.txt)", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Checks that the HID function module is loaded once the gadget's functions
+// exist under basepath (see HID_FUNCTION_MODULE). Returns nil if there are no
+// functions yet.
+func CheckHidFunctionModule(basepath string) error {
+	functions, err := filepath.Glob(basepath + "/functions/hid.*")
+	if err != nil || len(functions) == 0 || ModuleLoaded(HID_FUNCTION_MODULE) {
+		return nil
+	}
+	return fmt.Errorf("kernel module %s not loaded although %s exists", HID_FUNCTION_MODULE, functions[0])
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckHidFunctionModule(t *testing.T) {
+	basepath := t.TempDir()
+	if err := CheckHidFunctionModule(basepath); err != nil {
+		t.Fatalf("no functions yet: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(basepath, "functions", "hid.usb0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := CheckHidFunctionModule(basepath)
+	if ModuleLoaded(HID_FUNCTION_MODULE) {
+		if err != nil {
+			t.Fatalf("module loaded: %s", err)
+		}
+	} else if err == nil {
+		t.Fatal("functions exist without the module but no error")
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/loov/hrtime"
+	"math"
+	"sync"
+	"time"
+)
+
+// Mouse state shared by all pointing devices. Buttons are tracked per device
+// and merged, movement from all devices is summed, and a single emitter turns
+// the combined state into reports so simultaneous input from several devices
+// doesn't produce interleaved reports with conflicting button states.
+type MouseState struct {
+	sync.Mutex
+	buttons map[string]uint8
+	// Buttons pressed since the last report, so that a click released before
+	// the emitter gets to it still reaches the host
+	clicked uint8
+	dx      int32
+	dy      int32
+	wheel   int32
+	pan     int32
+	pending bool
+	since   time.Duration
+	notify  chan bool
+	// Movement is spread over this many reports when smoothing
+	smoothSteps int32
+	// Reports left in the current smoothed movement
+	smoothLeft int32
+	// X and Y movement is sent in multiples of this, if above 1
+	quantum int32
+	axes    AxisTransform
+	// Device X and Y movement is multiplied by this, if not 0 or 1, keeping
+	// the fractions left over
+	scale  float64
+	scaleX float64
+	scaleY float64
+}
+
+// Swaps and/or inverts the X and Y axes, eg. for rotated trackballs. The axes
+// are swapped first, inversion applies to the axes as reported to the host.
+type AxisTransform struct {
+	InvertX bool
+	InvertY bool
+	SwapXY  bool
+}
+
+func (t AxisTransform) Apply(dx int32, dy int32) (int32, int32) {
+	if t.SwapXY {
+		dx, dy = dy, dx
+	}
+	if t.InvertX {
+		dx = -dx
+	}
+	if t.InvertY {
+		dy = -dy
+	}
+	return dx, dy
+}
+
+func NewMouseState() *MouseState {
+	return &MouseState{
+		buttons: make(map[string]uint8, 0),
+		notify:  make(chan bool, 1),
+	}
+}
+
+func (m *MouseState) changed() {
+	if !m.pending {
+		m.pending = true
+		m.since = hrtime.Now()
+	}
+	select {
+	case m.notify <- true:
+	default:
+	}
+}
+
+func (m *MouseState) SetButtons(device string, buttons uint8) {
+	m.Lock()
+	defer m.Unlock()
+	if m.buttons[device] != buttons {
+		m.clicked |= buttons &^ m.buttons[device]
+		m.buttons[device] = buttons
+		m.changed()
+	}
+}
+
+// Adds movement from a device. X and Y are transformed before they are
+// summed, so smoothing and splitting into reports work on the final axes.
+func (m *MouseState) Move(dx int32, dy int32, wheel int32) {
+	m.MoveAll(dx, dy, wheel, 0)
+}
+
+// Adds horizontal wheel movement, positive to the right
+func (m *MouseState) Pan(pan int32) {
+	m.MoveAll(0, 0, 0, pan)
+}
+
+// Adds movement, wheel and horizontal wheel movement from a device at once,
+// so that the emitter can't send some of it in one report and the rest in
+// the next
+func (m *MouseState) MoveAll(dx int32, dy int32, wheel int32, pan int32) {
+	m.Lock()
+	defer m.Unlock()
+	if m.scale != 0 && m.scale != 1 {
+		dx, dy = scaleDelta(dx, m.scale, &m.scaleX), scaleDelta(dy, m.scale, &m.scaleY)
+	}
+	dx, dy = m.axes.Apply(dx, dy)
+	m.dx += dx
+	m.dy += dy
+	m.wheel += wheel
+	m.pan += pan
+	if m.movable() {
+		m.changed()
+	}
+}
+
+// Movement from the events of one evdev frame, up to the next SYN_REPORT,
+// so that the X, Y and wheel events of a frame go out in one report like
+// from a real mouse
+type MouseFrame struct {
+	dx    int32
+	dy    int32
+	wheel int32
+	pan   int32
+	// Set from a SYN_DROPPED to the next SYN_REPORT, the movement in between
+	// is incomplete
+	dropped bool
+}
+
+func (f *MouseFrame) Move(dx int32, dy int32, wheel int32) {
+	if f.dropped {
+		return
+	}
+	f.dx += dx
+	f.dy += dy
+	f.wheel += wheel
+}
+
+func (f *MouseFrame) Pan(pan int32) {
+	if f.dropped {
+		return
+	}
+	f.pan += pan
+}
+
+// Adds the movement so far to the mouse state, eg. before a button change
+func (f *MouseFrame) Flush(mouse *MouseState) {
+	if f.dx != 0 || f.dy != 0 || f.wheel != 0 || f.pan != 0 {
+		mouse.MoveAll(f.dx, f.dy, f.wheel, f.pan)
+	}
+	f.dx, f.dy, f.wheel, f.pan = 0, 0, 0, 0
+}
+
+// Ends the frame on SYN_REPORT, adding its movement to the mouse state
+// unless events of it were dropped
+func (f *MouseFrame) Sync(mouse *MouseState) {
+	f.Flush(mouse)
+	f.dropped = false
+}
+
+// Forgets the frame's movement on SYN_DROPPED, and ignores the movement up
+// to the next SYN_REPORT, since the events of the frame are only partly
+// there. Button events still apply, as they carry the whole button state.
+func (f *MouseFrame) Drop() {
+	*f = MouseFrame{dropped: true}
+}
+
+// Adds movement in the host's directions, without the axis transform, eg.
+// from keys (see MouseKeys)
+func (m *MouseState) MoveHost(dx int32, dy int32) {
+	m.Lock()
+	defer m.Unlock()
+	m.dx += dx
+	m.dy += dy
+	if m.movable() {
+		m.changed()
+	}
+}
+
+// Returns true if there's enough movement for a report
+func (m *MouseState) movable() bool {
+	q := m.step()
+	return m.wheel != 0 || m.pan != 0 || m.dx >= q || m.dx <= -q || m.dy >= q || m.dy <= -q
+}
+
+func (m *MouseState) step() int32 {
+	if m.quantum > 1 {
+		return m.quantum
+	}
+	return 1
+}
+
+// Sends X and Y movement in multiples of the quantum, keeping the remainder
+// until more movement adds up to another multiple. This cuts down on reports
+// for small movements without losing any movement.
+func (m *MouseState) SetQuantum(quantum int) {
+	m.Lock()
+	defer m.Unlock()
+	m.quantum = int32(quantum)
+}
+
+// Multiplies the X and Y movement of devices by the scale. Fractions of a
+// count are carried over to the next movement, so slow movement scaled down
+// isn't lost.
+func (m *MouseState) SetScale(scale float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.scale = scale
+	m.scaleX, m.scaleY = 0, 0
+}
+
+func scaleDelta(delta int32, scale float64, remainder *float64) int32 {
+	scaled := float64(delta)*scale + *remainder
+	whole := math.Trunc(scaled)
+	*remainder = scaled - whole
+	return int32(math.Max(math.MinInt32, math.Min(math.MaxInt32, whole)))
+}
+
+// Forgets a device, releasing any buttons it was holding
+func (m *MouseState) Remove(device string) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.buttons[device]; ok {
+		delete(m.buttons, device)
+		m.changed()
+	}
+}
+
+func (m *MouseState) Buttons() uint8 {
+	var buttons uint8 = 0
+	for _, b := range m.buttons {
+		buttons |= b
+	}
+	return buttons
+}
+
+func (m *MouseState) SetAxes(axes AxisTransform) {
+	m.Lock()
+	defer m.Unlock()
+	m.axes = axes
+}
+
+// Spreads movement evenly over the given number of reports, emitted over
+// the given duration, instead of moving in one jump. Wheel movement isn't
+// smoothed.
+func (m *MouseState) Smooth(steps int, duration time.Duration) time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	m.smoothSteps = int32(steps)
+	return duration / time.Duration(steps)
+}
+
+// Takes one step of smoothed movement: the movement left divided by the
+// steps left, so that the steps are even, in multiples of q, at least q so
+// that the movement always finishes, and at most max
+func takeSmoothDelta(delta *int32, steps int32, max int32, q int32) int32 {
+	step := *delta / steps
+	limit := max - max%q
+	if step > limit {
+		step = limit
+	}
+	if step < -limit {
+		step = -limit
+	}
+	step -= step % q
+	if step == 0 && *delta >= q {
+		step = q
+	}
+	if step == 0 && *delta <= -q {
+		step = -q
+	}
+	*delta -= step
+	return step
+}
+
+// Buttons currently held across all devices
+func (m *MouseState) HeldButtons() uint8 {
+	m.Lock()
+	defer m.Unlock()
+	return m.Buttons()
+}
+
+// Takes up to one report's worth of movement (max) in multiples of q,
+// leaving the rest for the next report
+func takeDelta(delta *int32, max int32, q int32) int32 {
+	d := *delta
+	limit := max - max%q
+	if d > limit {
+		d = limit
+	}
+	if d < -limit {
+		d = -limit
+	}
+	d -= d % q
+	*delta -= d
+	return d
+}
+
+// Emits reports for the combined mouse state whenever it changes. With a
+// non-zero interval, the state is instead sampled once per interval and at
+// most one report is emitted per tick, like a mouse polled at that rate.
+func (m *MouseState) Emit(output chan InputMessage, policy DropPolicy, interval time.Duration) {
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.Lock()
+			if m.pending {
+				m.emit(output, policy)
+				if m.pending {
+					m.since = hrtime.Now()
+				}
+			}
+			m.Unlock()
+		}
+		return
+	}
+	for range m.notify {
+		m.Lock()
+		for m.pending {
+			m.emit(output, policy)
+		}
+		m.Unlock()
+	}
+}
+
+// Emits one report, carrying over movement that didn't fit in it
+func (m *MouseState) emit(output chan InputMessage, policy DropPolicy) {
+	var dx, dy int32
+	if m.smoothSteps > 0 {
+		// Movement added during a smoothed movement is spread over the
+		// reports left in it
+		if m.smoothLeft <= 0 {
+			m.smoothLeft = m.smoothSteps
+		}
+		dx, dy = takeSmoothDelta(&m.dx, m.smoothLeft, Mouse.MaxDelta(), m.step()), takeSmoothDelta(&m.dy, m.smoothLeft, Mouse.MaxDelta(), m.step())
+		m.smoothLeft -= 1
+		if m.dx == 0 && m.dy == 0 {
+			m.smoothLeft = 0
+		}
+	} else {
+		dx, dy = takeDelta(&m.dx, Mouse.MaxDelta(), m.step()), takeDelta(&m.dy, Mouse.MaxDelta(), m.step())
+	}
+	// Buttons clicked since the last report are sent pressed first and
+	// released in the next report
+	buttons := m.Buttons() | m.clicked
+	m.clicked = 0
+	report := BuildMouseReport(buttons, dx, dy, takeDelta(&m.wheel, 127, 1), takeDelta(&m.pan, 127, 1))
+	SendInput(output, InputMessage{
+		Timestamp: m.since,
+		Message:   report,
+	}, policy)
+	m.pending = m.movable() || buttons != m.Buttons()
+}
+
+// Consecutive wheel events closer together than this count as fast scrolling
+const SCROLL_ACCEL_WINDOW = 100 * time.Millisecond
+
+// Largest multiplier scroll acceleration will reach
+const SCROLL_ACCEL_MAX = 8.0
+
+// Scales wheel movement by how fast the wheel is being turned: each event in
+// a fast sequence in the same direction raises the multiplier by accel, and a
+// pause longer than the window decays it back to 1. Fractions are carried
+// over so slow scrolling isn't lost.
+type ScrollAccelerator struct {
+	accel      float64
+	multiplier float64
+	remainder  float64
+	last       time.Time
+	direction  int32
+}
+
+func NewScrollAccelerator(accel float64) *ScrollAccelerator {
+	return &ScrollAccelerator{
+		accel:      accel,
+		multiplier: 1.0,
+	}
+}
+
+func (s *ScrollAccelerator) Scale(value int32, at time.Time) int32 {
+	if s.accel <= 0 || value == 0 {
+		return value
+	}
+	direction := int32(1)
+	if value < 0 {
+		direction = -1
+	}
+	if direction != s.direction || at.Sub(s.last) > SCROLL_ACCEL_WINDOW {
+		s.multiplier = 1.0
+		s.remainder = 0
+	} else if s.multiplier < SCROLL_ACCEL_MAX {
+		s.multiplier += s.accel
+		if s.multiplier > SCROLL_ACCEL_MAX {
+			s.multiplier = SCROLL_ACCEL_MAX
+		}
+	}
+	s.direction = direction
+	s.last = at
+
+	scaled := float64(value)*s.multiplier + s.remainder
+	whole := int32(scaled)
+	s.remainder = scaled - float64(whole)
+	return whole
+}
+
+// Changes of more than this fraction of an absolute axis' range between two
+// samples are taken as a jump (eg. an air mouse re-entering the sensor's
+// field of view) rather than movement
+const ABS_JUMP_FRACTION = 4
+
+// Relative counts per millimetre of movement on an absolute device that
+// reports its resolution, about that of a 500 CPI mouse
+const ABS_COUNTS_PER_MM = 20
+
+// Relative counts the full range of an absolute axis is scaled to if the
+// device doesn't report its resolution
+const ABS_RANGE_COUNTS = 2000
+
+type absAxis struct {
+	last      int32
+	valid     bool
+	maxJump   int32
+	scale     float64
+	remainder float64
+}
+
+// Sets up an axis from its absinfo, scaling movement by the resolution
+func newAbsAxis(info AbsInfo) *absAxis {
+	axis := &absAxis{scale: 1}
+	if info.Maximum > info.Minimum {
+		axis.maxJump = (info.Maximum - info.Minimum) / ABS_JUMP_FRACTION
+		axis.scale = float64(ABS_RANGE_COUNTS) / float64(info.Maximum-info.Minimum)
+	}
+	if info.Resolution > 0 {
+		axis.scale = float64(ABS_COUNTS_PER_MM) / float64(info.Resolution)
+	}
+	return axis
+}
+
+// Turns the absolute positions reported by a pointing device into relative
+// movement, so it can be proxied as a normal mouse
+type AbsConverter struct {
+	axes map[uint16]*absAxis
+}
+
+func NewAbsConverter(dev *evdev.InputDevice) *AbsConverter {
+	a := &AbsConverter{
+		axes: make(map[uint16]*absAxis, 2),
+	}
+	for _, code := range []uint16{evdev.ABS_X, evdev.ABS_Y} {
+		info, _ := GetAbsInfo(dev, int(code))
+		a.axes[code] = newAbsAxis(info)
+	}
+	return a
+}
+
+// Returns the movement since the previous position on the axis, in relative
+// counts. The first position, and any position after a jump, only sets the
+// reference point.
+func (a *AbsConverter) Delta(code uint16, value int32) (int32, bool) {
+	axis, ok := a.axes[code]
+	if !ok {
+		return 0, false
+	}
+	delta := value - axis.last
+	wasValid := axis.valid
+	axis.last = value
+	axis.valid = true
+	if !wasValid {
+		return 0, false
+	}
+	if axis.maxJump > 0 && (delta > axis.maxJump || delta < -axis.maxJump) {
+		return 0, false
+	}
+	return scaleDelta(delta, axis.scale, &axis.remainder), true
+}
+
+// Forgets the previous position, eg. when the device stops tracking
+func (a *AbsConverter) Reset() {
+	for _, axis := range a.axes {
+		axis.valid = false
+		axis.remainder = 0
+	}
+}
+
+// Turns the positions of an absolute scroll axis (ABS_WHEEL), as reported by
+// some precision trackpads, into wheel ticks. Counts that don't add up to a
+// whole tick are carried over to the next change.
+type AbsWheel struct {
+	last      int32
+	valid     bool
+	perTick   int32
+	maxJump   int32
+	remainder int32
+}
+
+func NewAbsWheel(dev *evdev.InputDevice) *AbsWheel {
+	w := &AbsWheel{perTick: 1}
+	if info, err := GetAbsInfo(dev, evdev.ABS_WHEEL); err == nil {
+		if info.Resolution > 0 {
+			w.perTick = info.Resolution
+		}
+		if info.Maximum > info.Minimum {
+			w.maxJump = (info.Maximum - info.Minimum) / ABS_JUMP_FRACTION
+		}
+	}
+	return w
+}
+
+// Returns the wheel ticks since the previous position. The first position,
+// and any position after a jump, only sets the reference point.
+func (w *AbsWheel) Ticks(value int32) (int32, bool) {
+	delta := value - w.last
+	wasValid := w.valid
+	w.last = value
+	w.valid = true
+	if !wasValid {
+		return 0, false
+	}
+	if w.maxJump > 0 && (delta > w.maxJump || delta < -w.maxJump) {
+		w.remainder = 0
+		return 0, false
+	}
+	w.remainder += delta
+	ticks := w.remainder / w.perTick
+	w.remainder -= ticks * w.perTick
+	return ticks, ticks != 0
+}
+
+// Forgets the previous position, eg. when the finger is lifted
+func (w *AbsWheel) Reset() {
+	w.valid = false
+	w.remainder = 0
+}
+
+// Left and right presses within this window are combined into a middle click
+const MIDDLE_EMULATION_WINDOW = 50 * time.Millisecond
+
+// How long a held back click is kept pressed, long enough for the press to be
+// reported before the release
+const MIDDLE_EMULATION_TAP = 20 * time.Millisecond
+
+// Emulates a middle button by pressing left and right together. The first
+// of the two buttons is held back for a short window; if the other follows
+// within it, both are reported as a middle press until either is released,
+// otherwise the held back button is reported late.
+type MiddleEmulator struct {
+	window     time.Duration
+	prev       uint8
+	pending    uint8
+	pendingAt  time.Time
+	tapped     uint8
+	tappedAt   time.Time
+	active     bool
+	suppressed uint8
+}
+
+func NewMiddleEmulator(window time.Duration) *MiddleEmulator {
+	return &MiddleEmulator{
+		window: window,
+	}
+}
+
+// Updates the emulation with the physical button state
+func (e *MiddleEmulator) Update(buttons uint8, at time.Time) {
+	leftRight := buttons & (BUTTON_LEFT | BUTTON_RIGHT)
+	pressed := leftRight &^ e.prev
+	e.prev = leftRight
+	e.suppressed &= leftRight
+	e.tapped = 0
+	if e.pending != 0 && !at.Before(e.pendingAt.Add(e.window)) {
+		e.pending = 0
+	}
+	switch {
+	case e.active:
+		if leftRight != BUTTON_LEFT|BUTTON_RIGHT {
+			// Don't report the button still held as a press of its own
+			e.active = false
+			e.suppressed = leftRight
+		}
+	case e.pending != 0 && pressed != 0 && leftRight == BUTTON_LEFT|BUTTON_RIGHT:
+		e.pending = 0
+		e.active = true
+	case e.pending != 0 && leftRight&e.pending == 0:
+		// Released before the window ended, report it as a short click
+		e.tapped = e.pending
+		e.tappedAt = at
+		e.pending = 0
+	case e.pending == 0 && e.suppressed == 0 && (pressed == BUTTON_LEFT || pressed == BUTTON_RIGHT) && leftRight == pressed:
+		e.pending = pressed
+		e.pendingAt = at
+	}
+}
+
+// Time at which Expire needs to be called, zero if nothing is held back
+func (e *MiddleEmulator) Deadline() time.Time {
+	if e.tapped != 0 {
+		return e.tappedAt.Add(MIDDLE_EMULATION_TAP)
+	}
+	if e.pending != 0 {
+		return e.pendingAt.Add(e.window)
+	}
+	return time.Time{}
+}
+
+// Stops holding back buttons whose time is up, returns true if the reported
+// buttons changed
+func (e *MiddleEmulator) Expire(at time.Time) bool {
+	deadline := e.Deadline()
+	if deadline.IsZero() || at.Before(deadline) {
+		return false
+	}
+	e.tapped = 0
+	e.pending = 0
+	return true
+}
+
+// Buttons to report for the physical button state
+func (e *MiddleEmulator) Report(buttons uint8) uint8 {
+	reported := buttons &^ (BUTTON_LEFT | BUTTON_RIGHT)
+	if e.active {
+		return reported | BUTTON_MIDDLE
+	}
+	return reported | buttons&(BUTTON_LEFT|BUTTON_RIGHT)&^e.pending&^e.suppressed | e.tapped
+}
+
+// Merges two mouse reports with the same buttons by adding up their
+// movement, as long as it still fits in one report
+func MergeMouseReports(first []byte, second []byte) ([]byte, bool) {
+	buttons, dx, dy, wheel, pan, ok := Mouse.Parse(first)
+	if !ok {
+		return nil, false
+	}
+	buttons2, dx2, dy2, wheel2, pan2, ok := Mouse.Parse(second)
+	if !ok || buttons != buttons2 {
+		return nil, false
+	}
+	dx, dy, wheel, pan = dx+dx2, dy+dy2, wheel+wheel2, pan+pan2
+	max := Mouse.MaxDelta()
+	if dx > max || dx < -max || dy > max || dy < -max || wheel > 127 || wheel < -127 || pan > 127 || pan < -127 {
+		return nil, false
+	}
+	return Mouse.Build(buttons, dx, dy, wheel, pan), true
+}
+
+// Reports moving the pointer one pixel right and back, leaving it where it
+// was. Nothing is sent while buttons are held, since moving then could drag
+// something on the host.
+func MouseJiggle(last []byte) [][]byte {
+	if len(last) > 0 && last[0] != 0 {
+		return nil
+	}
+	return [][]byte{BuildMouseReport(0, 1, 0, 0, 0), BuildMouseReport(0, -1, 0, 0, 0)}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Emits reports for the pending mouse state, like the emitter does when
+// notified, and returns them
+func emitPending(m *MouseState) [][]byte {
+	output := make(chan InputMessage, 16)
+	m.Lock()
+	for m.pending {
+		m.emit(output, DROP_OLDEST)
+	}
+	m.Unlock()
+	close(output)
+	reports := make([][]byte, 0)
+	for msg := range output {
+		reports = append(reports, msg.Message)
+	}
+	return reports
+}
+
+func TestMouseClickBetweenReports(t *testing.T) {
+	m := NewMouseState()
+	m.SetButtons("mouse0", 1)
+	m.SetButtons("mouse0", 0)
+	reports := emitPending(m)
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want a press and a release: %v", len(reports), reports)
+	}
+	if reports[0][0] != 1 || reports[1][0] != 0 {
+		t.Errorf("got buttons %d then %d, want 1 then 0", reports[0][0], reports[1][0])
+	}
+}
+
+func TestMouseButtonsMergedAcrossDevices(t *testing.T) {
+	m := NewMouseState()
+	m.SetButtons("mouse0", 1)
+	m.SetButtons("mouse1", 2)
+	reports := emitPending(m)
+	if len(reports) != 1 || reports[0][0] != 3 {
+		t.Fatalf("got %v, want one report with buttons 3", reports)
+	}
+	m.Remove("mouse0")
+	reports = emitPending(m)
+	if len(reports) != 1 || reports[0][0] != 2 {
+		t.Fatalf("got %v after removing a device, want one report with buttons 2", reports)
+	}
+}
+
+func TestAbsConverterScalesByResolution(t *testing.T) {
+	a := &AbsConverter{axes: map[uint16]*absAxis{
+		0: newAbsAxis(AbsInfo{Minimum: 0, Maximum: 4000, Resolution: 40}),
+		1: newAbsAxis(AbsInfo{Minimum: 0, Maximum: 1000}),
+	}}
+	if _, ok := a.Delta(0, 1000); ok {
+		t.Fatalf("first position gave movement")
+	}
+	// 40 units per mm, 2 mm is 40 counts
+	if delta, ok := a.Delta(0, 1080); !ok || delta != 2*ABS_COUNTS_PER_MM {
+		t.Errorf("got %d, %v, want %d", delta, ok, 2*ABS_COUNTS_PER_MM)
+	}
+	// A jump of more than a quarter of the range only moves the reference
+	if _, ok := a.Delta(0, 3000); ok {
+		t.Errorf("jump gave movement")
+	}
+	// Without a resolution, the range is scaled to ABS_RANGE_COUNTS
+	a.Delta(1, 500)
+	if delta, ok := a.Delta(1, 510); !ok || delta != 10*ABS_RANGE_COUNTS/1000 {
+		t.Errorf("got %d, %v, want %d", delta, ok, 10*ABS_RANGE_COUNTS/1000)
+	}
+}
+
+func TestMouseSmoothingEvenSteps(t *testing.T) {
+	m := NewMouseState()
+	m.Smooth(4, 0)
+	m.MoveHost(100, -10)
+	reports := emitPending(m)
+	if len(reports) != 4 {
+		t.Fatalf("got %d reports, want 4: %v", len(reports), reports)
+	}
+	var totalX, totalY int32
+	for _, report := range reports {
+		_, dx, dy, _, _, _ := Mouse.Parse(report)
+		if dx != 25 {
+			t.Errorf("got a step of %d, want 25: %v", dx, reports)
+		}
+		totalX += dx
+		totalY += dy
+	}
+	if totalX != 100 || totalY != -10 {
+		t.Errorf("got a total of %d, %d, want 100, -10", totalX, totalY)
+	}
+}
+
+func TestMouseLargeMovementClamped(t *testing.T) {
+	tests := []struct {
+		value int32
+		want  []byte
+	}{
+		{200, []byte{127, 73}},
+		{-200, []byte{129, 183}},
+	}
+	for _, test := range tests {
+		m := NewMouseState()
+		m.Move(test.value, 0, 0)
+		reports := emitPending(m)
+		got := make([]byte, 0)
+		for _, report := range reports {
+			got = append(got, report[1])
+		}
+		if string(got) != string(test.want) {
+			t.Errorf("%d: got X bytes %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestMouseScaleCarriesFractions(t *testing.T) {
+	m := NewMouseState()
+	m.SetScale(0.25)
+	var total int32
+	for i := 0; i < 10; i++ {
+		m.Move(1, 0, 0)
+		for _, report := range emitPending(m) {
+			_, dx, _, _, _, _ := Mouse.Parse(report)
+			total += dx
+		}
+	}
+	if total != 2 {
+		t.Errorf("got %d counts from 10 scaled by 0.25, want 2", total)
+	}
+}
+
+func TestScaleDeltaClamped(t *testing.T) {
+	var remainder float64
+	if got := scaleDelta(math.MaxInt32, MOUSE_SCALE_MAX, &remainder); got != math.MaxInt32 {
+		t.Errorf("got %d, want %d", got, int32(math.MaxInt32))
+	}
+	if got := scaleDelta(math.MinInt32, MOUSE_SCALE_MAX, &remainder); got != math.MinInt32 {
+		t.Errorf("got %d, want %d", got, int32(math.MinInt32))
+	}
+}
+
+func TestMouseFrameOneReport(t *testing.T) {
+	m := NewMouseState()
+	frame := &MouseFrame{}
+	frame.Move(5, 0, 0)
+	frame.Move(0, 3, 0)
+	frame.Move(0, 0, 1)
+	frame.Pan(-1)
+	if reports := emitPending(m); len(reports) != 0 {
+		t.Fatalf("got %v before the sync", reports)
+	}
+	frame.Sync(m)
+	reports := emitPending(m)
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want one for the frame: %v", len(reports), reports)
+	}
+	_, dx, dy, wheel, pan, _ := Mouse.Parse(reports[0])
+	if dx != 5 || dy != 3 || wheel != 1 || pan != -1 {
+		t.Errorf("got %d, %d, wheel %d, pan %d, want 5, 3, wheel 1, pan -1", dx, dy, wheel, pan)
+	}
+}
+
+func TestMouseFrameDropped(t *testing.T) {
+	m := NewMouseState()
+	frame := &MouseFrame{}
+	frame.Move(5, 0, 0)
+	frame.Drop()
+	// The rest of the dropped frame
+	frame.Move(7, 0, 0)
+	frame.Pan(1)
+	frame.Sync(m)
+	if reports := emitPending(m); len(reports) != 0 {
+		t.Fatalf("got %v from a dropped frame", reports)
+	}
+
+	frame.Move(2, 0, 0)
+	frame.Sync(m)
+	reports := emitPending(m)
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports after the dropped frame, want 1: %v", len(reports), reports)
+	}
+	if _, dx, _, _, _, _ := Mouse.Parse(reports[0]); dx != 2 {
+		t.Errorf("got %d, want only the next frame's 2", dx)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+// Moving the mouse with keys held down (mouse keys), for accessibility
+
+import (
+	"sync"
+	"time"
+)
+
+// How often held movement keys move the mouse
+const MOUSE_KEYS_INTERVAL = 20 * time.Millisecond
+
+// Moves the mouse while movement keys (see MouseAction) are held, starting at
+// speed counts per MOUSE_KEYS_INTERVAL and speeding up by accel per interval
+// up to max. The speed starts over once all movement keys are released.
+type MouseKeys struct {
+	sync.Mutex
+	mouse *MouseState
+	speed float64
+	accel float64
+	max   float64
+	// Direction of each held key
+	held map[uint16][2]int32
+	// Current speed and the movement left over from fractional speeds
+	current float64
+	restX   float64
+	restY   float64
+	running bool
+}
+
+func NewMouseKeys(mouse *MouseState, speed int, accel float64, max int) *MouseKeys {
+	return &MouseKeys{
+		mouse: mouse,
+		speed: float64(speed),
+		accel: accel,
+		max:   float64(max),
+		held:  make(map[uint16][2]int32, 0),
+	}
+}
+
+// Starts or stops moving in the direction of the action for a key event
+// (value 0 release, 1 press, 2 repeat)
+func (k *MouseKeys) Key(code uint16, action MouseAction, value int32) {
+	k.Lock()
+	defer k.Unlock()
+	if value == 0 {
+		delete(k.held, code)
+		return
+	}
+	k.held[code] = [2]int32{action.MoveX, action.MoveY}
+	if !k.running {
+		k.running = true
+		k.current = k.speed
+		k.restX, k.restY = 0, 0
+		go k.run()
+	}
+}
+
+// Moves the mouse every interval until no movement keys are held
+func (k *MouseKeys) run() {
+	ticker := time.NewTicker(MOUSE_KEYS_INTERVAL)
+	defer ticker.Stop()
+	for k.move() {
+		<-ticker.C
+	}
+}
+
+// Moves the mouse by the current speed in the direction of the held keys,
+// returns false (and stops) once none are held
+func (k *MouseKeys) move() bool {
+	k.Lock()
+	defer k.Unlock()
+	if len(k.held) == 0 {
+		k.running = false
+		return false
+	}
+	var dirX, dirY int32
+	for _, dir := range k.held {
+		dirX += dir[0]
+		dirY += dir[1]
+	}
+	x := float64(dirX)*k.current + k.restX
+	y := float64(dirY)*k.current + k.restY
+	dx, dy := int32(x), int32(y)
+	k.restX, k.restY = x-float64(dx), y-float64(dy)
+	if dx != 0 || dy != 0 {
+		k.mouse.MoveHost(dx, dy)
+	}
+	if k.current += k.accel; k.current > k.max {
+		k.current = k.max
+	}
+	return true
+}
+
+// Releases all movement keys when the device's handler exits. The movement
+// stops within an interval.
+func (k *MouseKeys) Stop() {
+	k.Lock()
+	defer k.Unlock()
+	k.held = make(map[uint16][2]int32, 0)
+}
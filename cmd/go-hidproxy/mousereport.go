@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Mouse report formats
+const (
+	// Buttons, X, Y, wheel and horizontal wheel in a byte each, boot
+	// protocol compatible
+	MOUSE_FORMAT_BOOT = "boot"
+	// Buttons, X and Y packed into 12 bits each (3 bytes), wheel and
+	// horizontal wheel, for a larger range per report. Not boot protocol
+	// compatible.
+	MOUSE_FORMAT_12BIT = "12bit"
+)
+
+// Layout of the mouse report: a byte of buttons, the X and Y deltas in
+// DeltaBits bits each, little endian and packed without padding, a byte of
+// wheel movement and a byte of horizontal wheel movement (AC Pan)
+type MouseLayout struct {
+	DeltaBits uint8
+}
+
+var Mouse = MouseLayout{DeltaBits: 8}
+
+func ParseMouseLayout(format string) (MouseLayout, error) {
+	switch format {
+	case MOUSE_FORMAT_BOOT, "":
+		return MouseLayout{DeltaBits: 8}, nil
+	case MOUSE_FORMAT_12BIT:
+		return MouseLayout{DeltaBits: 12}, nil
+	}
+	return MouseLayout{}, fmt.Errorf("unknown mouse report format: %s (expected %s or %s)", format, MOUSE_FORMAT_BOOT, MOUSE_FORMAT_12BIT)
+}
+
+// Largest X or Y delta in a report, the smallest is its negative
+func (l MouseLayout) MaxDelta() int32 {
+	return 1<<(l.DeltaBits-1) - 1
+}
+
+// Returns true if reports can be read by hosts that switched the mouse to the
+// boot protocol (see KeyboardLayout.BootCompatible)
+func (l MouseLayout) BootCompatible() bool {
+	return l.DeltaBits == 8
+}
+
+// Length of the report
+func (l MouseLayout) ReportLength() int {
+	return 1 + int(l.DeltaBits)*2/8 + 2
+}
+
+// Generates the report descriptor for the layout
+func (l MouseLayout) Descriptor() []byte {
+	d := NewDescriptor().
+		UsagePage(USAGE_PAGE_GENERIC_DESKTOP).
+		Usage(0x02). // Mouse
+		Collection(COLLECTION_APPLICATION).
+		Usage(0x01). // Pointer
+		Collection(COLLECTION_PHYSICAL).
+		UsagePage(USAGE_PAGE_BUTTON).
+		UsageMinimum(1).
+		UsageMaximum(5).
+		LogicalMinimum(0).
+		LogicalMaximum(1).
+		ReportCount(5).
+		ReportSize(1).
+		Input(HID_DATA | HID_VARIABLE | HID_ABSOLUTE).
+		ReportCount(1).
+		ReportSize(3).
+		Input(HID_CONSTANT). // padding
+		UsagePage(USAGE_PAGE_GENERIC_DESKTOP)
+	if l.DeltaBits == 8 {
+		d.
+			Usage(0x30). // X
+			Usage(0x31). // Y
+			Usage(0x38). // Wheel
+			LogicalMinimum(-127).
+			LogicalMaximum(127).
+			ReportSize(8).
+			ReportCount(3).
+			Input(HID_DATA | HID_VARIABLE | HID_RELATIVE)
+	} else {
+		d.
+			Usage(0x30). // X
+			Usage(0x31). // Y
+			LogicalMinimum(-l.MaxDelta()).
+			LogicalMaximum(l.MaxDelta()).
+			ReportSize(l.DeltaBits).
+			ReportCount(2).
+			Input(HID_DATA | HID_VARIABLE | HID_RELATIVE).
+			Usage(0x38). // Wheel
+			LogicalMinimum(-127).
+			LogicalMaximum(127).
+			ReportSize(8).
+			ReportCount(1).
+			Input(HID_DATA | HID_VARIABLE | HID_RELATIVE)
+	}
+	return d.
+		UsagePage(USAGE_PAGE_CONSUMER).
+		Usage(0x0238). // AC Pan
+		LogicalMinimum(-127).
+		LogicalMaximum(127).
+		ReportSize(8).
+		ReportCount(1).
+		Input(HID_DATA | HID_VARIABLE | HID_RELATIVE).
+		EndCollection().
+		EndCollection().
+		Bytes()
+}
+
+// Builds a report. The deltas must already be within MaxDelta (and the
+// wheels within 127), larger values are truncated to their low bits.
+func (l MouseLayout) Build(buttons uint8, dx int32, dy int32, wheel int32, pan int32) []uint8 {
+	if l.DeltaBits == 8 {
+		return []uint8{buttons, uint8(dx), uint8(dy), uint8(wheel), uint8(pan)}
+	}
+	mask := uint32(1)<<l.DeltaBits - 1
+	packed := uint32(dx)&mask | (uint32(dy)&mask)<<l.DeltaBits
+	report := []uint8{buttons}
+	for i := 0; i < int(l.DeltaBits)*2/8; i++ {
+		report = append(report, uint8(packed>>(8*i)))
+	}
+	return append(report, uint8(wheel), uint8(pan))
+}
+
+// Unpacks a report built with Build, returns false if it's not a report of
+// this layout
+func (l MouseLayout) Parse(report []uint8) (uint8, int32, int32, int32, int32, bool) {
+	if len(report) != l.ReportLength() {
+		return 0, 0, 0, 0, 0, false
+	}
+	wheel, pan := int32(int8(report[len(report)-2])), int32(int8(report[len(report)-1]))
+	if l.DeltaBits == 8 {
+		return report[0], int32(int8(report[1])), int32(int8(report[2])), wheel, pan, true
+	}
+	var packed uint32
+	for i, b := range report[1 : len(report)-2] {
+		packed |= uint32(b) << (8 * i)
+	}
+	// Shift each field up to the top of the word and back down to sign extend it
+	shift := 32 - l.DeltaBits
+	dx := int32(packed<<shift) >> shift
+	dy := int32(packed>>l.DeltaBits<<shift) >> shift
+	return report[0], dx, dy, wheel, pan, true
+}
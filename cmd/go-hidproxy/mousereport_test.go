@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMouseLayoutRoundTrip(t *testing.T) {
+	for _, format := range []string{MOUSE_FORMAT_BOOT, MOUSE_FORMAT_12BIT} {
+		layout, err := ParseMouseLayout(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		max := layout.MaxDelta()
+		tests := []struct {
+			buttons            uint8
+			dx, dy, wheel, pan int32
+		}{
+			{0, 0, 0, 0, 0},
+			{BUTTON_LEFT, max, max, 0, 0},
+			{BUTTON_RIGHT, -max, -max, 0, 0},
+			{0, max, -max, 0, 0},
+			{0, -max, max, 0, 0},
+			{0, -1, -1, -1, -1},
+			{0, -1, 1, 0, 0},
+			{0, 1, -1, 0, 0},
+			{BUTTON_MIDDLE | BUTTON_SIDE | BUTTON_EXTRA, 0, 0, 127, 127},
+			{0, 0, 0, -127, -127},
+			{0, 0, 0, 127, -127},
+		}
+		for _, test := range tests {
+			report := layout.Build(test.buttons, test.dx, test.dy, test.wheel, test.pan)
+			if len(report) != layout.ReportLength() {
+				t.Errorf("%s: report % x has length %d, want %d", format, report, len(report), layout.ReportLength())
+			}
+			buttons, dx, dy, wheel, pan, ok := layout.Parse(report)
+			if !ok || buttons != test.buttons || dx != test.dx || dy != test.dy || wheel != test.wheel || pan != test.pan {
+				t.Errorf("%s: % x parsed as %#x %d %d %d %d (%v), want %#x %d %d %d %d", format, report, buttons, dx, dy, wheel, pan, ok, test.buttons, test.dx, test.dy, test.wheel, test.pan)
+			}
+		}
+	}
+}
+
+func TestMouseLayoutMaxDelta(t *testing.T) {
+	for format, want := range map[string]int32{MOUSE_FORMAT_BOOT: 127, MOUSE_FORMAT_12BIT: 2047} {
+		layout, _ := ParseMouseLayout(format)
+		if got := layout.MaxDelta(); got != want {
+			t.Errorf("%s: got %d, want %d", format, got, want)
+		}
+	}
+}
+
+func TestMouseLayout12BitPacking(t *testing.T) {
+	layout, _ := ParseMouseLayout(MOUSE_FORMAT_12BIT)
+	tests := []struct {
+		dx, dy int32
+		want   []uint8
+	}{
+		{-1, -1, []uint8{0, 0xff, 0xff, 0xff, 0, 0}},
+		{-1, 0, []uint8{0, 0xff, 0x0f, 0x00, 0, 0}},
+		{0, -1, []uint8{0, 0x00, 0xf0, 0xff, 0, 0}},
+		{2047, -2047, []uint8{0, 0xff, 0x17, 0x80, 0, 0}},
+	}
+	for _, test := range tests {
+		if got := layout.Build(0, test.dx, test.dy, 0, 0); !bytes.Equal(got, test.want) {
+			t.Errorf("%d, %d: got % x, want % x", test.dx, test.dy, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+// Pausing report forwarding from a control FIFO, for shell scripts
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/loov/hrtime"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// Non-zero while reports are not forwarded to the host
+var paused int32
+
+func SetPaused(pause bool) {
+	var value int32 = 0
+	if pause {
+		value = 1
+	}
+	atomic.StoreInt32(&paused, value)
+}
+
+func IsPaused() bool {
+	return atomic.LoadInt32(&paused) != 0
+}
+
+// Non-zero for report types not forwarded to the host
+var disabledTypes = map[string]*int32{
+	"keyboard": new(int32),
+	"mouse":    new(int32),
+	"system":   new(int32),
+	"consumer": new(int32),
+}
+
+// Report types that can be enabled and disabled, in a stable order
+func ReportTypes() []string {
+	return []string{"keyboard", "mouse", "system", "consumer"}
+}
+
+// Enables or disables forwarding reports of the type to the host
+func SetEnabled(reportType string, enabled bool) error {
+	disabled, ok := disabledTypes[reportType]
+	if !ok {
+		return fmt.Errorf("unknown report type: %s (expected %s)", reportType, strings.Join(ReportTypes(), ", "))
+	}
+	var value int32 = 1
+	if enabled {
+		value = 0
+	}
+	atomic.StoreInt32(disabled, value)
+	return nil
+}
+
+// Returns false if reports of the type are disabled. Writers without a type
+// are always enabled.
+func IsEnabled(reportType string) bool {
+	disabled, ok := disabledTypes[reportType]
+	return !ok || atomic.LoadInt32(disabled) == 0
+}
+
+// Report writers that can be told to release everything held on the host
+type ReportQueues struct {
+	Keyboard chan InputMessage
+	Mouse    chan InputMessage
+	System   chan InputMessage
+	Consumer chan InputMessage
+}
+
+// Queues empty reports to all writers, releasing every key and button on the
+// host. They are written even while paused. Devices keep their own state, so
+// keys still physically held are pressed again with the next report after
+// resuming.
+func (q ReportQueues) ReleaseAll() {
+	release := func(input chan InputMessage, report []byte) {
+		if input == nil {
+			return
+		}
+		input <- InputMessage{
+			Timestamp: hrtime.Now(),
+			Message:   report,
+			Forced:    true,
+		}
+	}
+	release(q.Keyboard, BuildKeyboardReport(nil))
+	release(q.Mouse, BuildMouseReport(0, 0, 0, 0, 0))
+	release(q.System, BuildSystemControlReport(0))
+	release(q.Consumer, BuildConsumerControlReport(0))
+}
+
+// Enables or disables reports of the type. Disabling releases the keys or
+// buttons of that type held on the host; like after resuming, keys still
+// physically held are pressed again with the next report after enabling.
+func (q ReportQueues) SetEnabled(reportType string, enabled bool) error {
+	changed := IsEnabled(reportType) != enabled
+	if err := SetEnabled(reportType, enabled); err != nil || !changed {
+		return err
+	}
+	if enabled {
+		log.Infof("Enabled forwarding %s reports to the host", reportType)
+		return nil
+	}
+	release := ReportQueues{}
+	switch reportType {
+	case "keyboard":
+		release.Keyboard = q.Keyboard
+	case "mouse":
+		release.Mouse = q.Mouse
+	case "system":
+		release.System = q.System
+	case "consumer":
+		release.Consumer = q.Consumer
+	}
+	release.ReleaseAll()
+	log.Infof("Disabled forwarding %s reports to the host", reportType)
+	return nil
+}
+
+// Queues of the running proxy, for commands from key rules
+var Queues ReportQueues
+
+// Commands understood by ReportQueues.Command
+var controlCommands = []string{"pause", "resume", "toggle-pause", "release-all"}
+
+func IsControlCommand(command string) bool {
+	for _, c := range controlCommands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs a pause, resume, toggle-pause or release-all command
+func (q ReportQueues) Command(command string) error {
+	if command == "toggle-pause" {
+		if IsPaused() {
+			command = "resume"
+		} else {
+			command = "pause"
+		}
+	}
+	switch command {
+	case "pause":
+		if !IsPaused() {
+			SetPaused(true)
+			q.ReleaseAll()
+			log.Info("Paused forwarding reports to the host")
+		}
+	case "resume":
+		if IsPaused() {
+			SetPaused(false)
+			log.Info("Resumed forwarding reports to the host")
+		}
+	case "release-all":
+		q.ReleaseAll()
+		log.Info("Released all keys and buttons on the host")
+	default:
+		return fmt.Errorf("unknown command: %s (expected %s)", command, strings.Join(controlCommands, ", "))
+	}
+	return nil
+}
+
+// Reads commands, one per line, from a FIFO (created if it doesn't exist).
+// The FIFO is reopened whenever the writing side closes it, so every
+// `echo pause > fifo` is picked up.
+func (q ReportQueues) WatchFifo(path string) {
+	if err := syscall.Mkfifo(path, 0600); err != nil && !os.IsExist(err) {
+		log.Errorf("Failed to create control FIFO %s: %s", path, err.Error())
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Errorf("Failed to check control FIFO %s: %s", path, err.Error())
+		return
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		log.Errorf("Control FIFO %s exists but is not a FIFO", path)
+		return
+	}
+	log.Infof("Reading commands from control FIFO %s", path)
+	for {
+		fifo, err := os.Open(path)
+		if err != nil {
+			log.Errorf("Failed to open control FIFO %s: %s", path, err.Error())
+			return
+		}
+		scanner := bufio.NewScanner(fifo)
+		for scanner.Scan() {
+			command := strings.TrimSpace(scanner.Text())
+			if command == "" {
+				continue
+			}
+			if err := q.Command(command); err != nil {
+				log.Warnf("Control FIFO: %s", err.Error())
+			}
+		}
+		fifo.Close()
+	}
+}
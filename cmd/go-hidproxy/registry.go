@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEVICE_GRABBING = "grabbing"
+	DEVICE_GRABBED  = "grabbed"
+	// Found but not handled, eg. gamepads
+	DEVICE_NOT_GRABBED = "not-grabbed"
+)
+
+// Policies for devices over the device limit
+const (
+	DEVICE_LIMIT_REJECT = "reject-new"
+	DEVICE_LIMIT_EVICT  = "evict-oldest-idle"
+)
+
+// Metadata about a device handed to an input handler
+type DeviceInfo struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Identity string `json:"identity"`
+	ById     string `json:"byId,omitempty"`
+	Type     string `json:"type"`
+	Address  string `json:"address,omitempty"`
+	// Shared by the event nodes of the same physical device
+	Group string `json:"group,omitempty"`
+	// For keyboards, what the node is for (keys, consumer or system)
+	Role         string     `json:"role,omitempty"`
+	State        string     `json:"state"`
+	Since        time.Time  `json:"since"`
+	Events       uint64     `json:"events"`
+	LastActivity *time.Time `json:"lastActivity,omitempty"`
+	Held         HeldState  `json:"held"`
+	// Events the handler ignored, by type and code
+	Unhandled map[string]uint64 `json:"unhandled,omitempty"`
+
+	events       uint64
+	lastActivity int64
+}
+
+// Records an input event from the device
+func (d *DeviceInfo) Activity() {
+	atomic.AddUint64(&d.events, 1)
+	atomic.StoreInt64(&d.lastActivity, time.Now().UnixNano())
+}
+
+// Keys (as HID usages) and mouse buttons a device is holding down
+type HeldState struct {
+	Keys    []uint16 `json:"keys"`
+	Buttons uint8    `json:"buttons"`
+}
+
+type DeviceRegistry struct {
+	sync.Mutex
+	devices map[string]*DeviceInfo
+	// Devices found but not handled, listed only in snapshots
+	seen map[string]*DeviceInfo
+}
+
+// All devices currently handled by the proxy, keyed by device node
+var Devices = &DeviceRegistry{
+	devices: make(map[string]*DeviceInfo, 0),
+	seen:    make(map[string]*DeviceInfo, 0),
+}
+
+// Bus, vendor and product of the device, formatted like in udev's modalias
+func DeviceIdentity(dev *evdev.InputDevice) string {
+	return fmt.Sprintf("%04x:%04x:%04x", dev.Bustype, dev.Vendor, dev.Product)
+}
+
+// Unique identifier of the device, which for Bluetooth devices is the address
+func DeviceUniq(devnode string) string {
+	uniq, err := ioutil.ReadFile(filepath.Join("/sys/class/input", filepath.Base(devnode), "device/uniq"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(uniq))
+}
+
+const DEVICE_BY_ID_PATH = "/dev/input/by-id"
+
+// Stable /dev/input/by-id name of the device node, empty if it has none (eg.
+// Bluetooth devices, which udev doesn't create by-id links for)
+func DeviceById(devnode string) string {
+	links, _ := filepath.Glob(DEVICE_BY_ID_PATH + "/*")
+	for _, link := range links {
+		if target, err := filepath.EvalSymlinks(link); err == nil && target == devnode {
+			return link
+		}
+	}
+	return ""
+}
+
+// Opens the given devices (device nodes or symlinks to them) instead of
+// scanning /dev/input. Devices that aren't there (eg. disconnected) are
+// skipped, and picked up again once they reappear.
+func OpenDevices(specs []string) []*evdev.InputDevice {
+	devices := make([]*evdev.InputDevice, 0, len(specs))
+	for _, spec := range specs {
+		devnode, err := filepath.EvalSymlinks(spec)
+		if err != nil {
+			continue
+		}
+		dev, err := evdev.Open(devnode)
+		if err != nil {
+			log.Debugf("Failed to open %s: %s", spec, err.Error())
+			continue
+		}
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// Returns true if the device node matches a device given in the
+// configuration, either as a device node or as a symlink to one (eg. in
+// /dev/input/by-id), which is resolved at the time of matching
+func MatchDevice(spec string, devnode string) bool {
+	if spec == devnode {
+		return true
+	}
+	target, err := filepath.EvalSymlinks(spec)
+	return err == nil && target == devnode
+}
+
+// Name to log the device by, including its stable name if it has one
+func DeviceLogName(dev *evdev.InputDevice) string {
+	if byId := DeviceById(dev.Fn); byId != "" {
+		return fmt.Sprintf("%s (%s, %s)", dev.Name, dev.Fn, filepath.Base(byId))
+	}
+	return fmt.Sprintf("%s (%s)", dev.Name, dev.Fn)
+}
+
+func newDeviceInfo(dev *evdev.InputDevice, deviceType string) *DeviceInfo {
+	info := &DeviceInfo{
+		Name:     dev.Name,
+		Path:     dev.Fn,
+		Identity: DeviceIdentity(dev),
+		ById:     DeviceById(dev.Fn),
+		Type:     deviceType,
+		Address:  DeviceUniq(dev.Fn),
+		Group:    DeviceGroupKey(dev),
+		State:    DEVICE_GRABBING,
+		Since:    time.Now(),
+	}
+	if deviceType == string(DEVICE_KEYBOARD) {
+		info.Role = string(ClassifyKeyboardRole(dev))
+	}
+	return info
+}
+
+func (r *DeviceRegistry) Add(dev *evdev.InputDevice, deviceType string) *DeviceInfo {
+	info := newDeviceInfo(dev, deviceType)
+	r.Lock()
+	r.devices[dev.Fn] = info
+	delete(r.seen, dev.Fn)
+	r.Unlock()
+	return info
+}
+
+// Records a device the proxy found but doesn't handle (eg. a gamepad), so
+// that snapshots list it with its type
+func (r *DeviceRegistry) Seen(dev *evdev.InputDevice, deviceType string) {
+	r.Lock()
+	_, ok := r.seen[dev.Fn]
+	r.Unlock()
+	if ok {
+		return
+	}
+	info := newDeviceInfo(dev, deviceType)
+	info.State = DEVICE_NOT_GRABBED
+	r.Lock()
+	r.seen[dev.Fn] = info
+	r.Unlock()
+}
+
+// Forgets the devices recorded with Seen that aren't in present
+func (r *DeviceRegistry) PruneSeen(present map[string]bool) {
+	r.Lock()
+	defer r.Unlock()
+	for path := range r.seen {
+		if !present[path] {
+			delete(r.seen, path)
+		}
+	}
+}
+
+// Number of devices handled
+func (r *DeviceRegistry) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.devices)
+}
+
+func (r *DeviceRegistry) Get(path string) *DeviceInfo {
+	r.Lock()
+	defer r.Unlock()
+	return r.devices[path]
+}
+
+func (r *DeviceRegistry) SetState(path string, state string) {
+	r.Lock()
+	defer r.Unlock()
+	if info, ok := r.devices[path]; ok {
+		info.State = state
+		info.Since = time.Now()
+	}
+}
+
+// Records the keys and buttons the device is holding down, returns true if
+// they changed
+func (r *DeviceRegistry) SetHeld(path string, keys []uint16, buttons uint8) bool {
+	r.Lock()
+	defer r.Unlock()
+	info, ok := r.devices[path]
+	if !ok {
+		return false
+	}
+	changed := info.Held.Buttons != buttons || len(info.Held.Keys) != len(keys)
+	for i := 0; !changed && i < len(keys); i++ {
+		changed = info.Held.Keys[i] != keys[i]
+	}
+	if changed {
+		info.Held = HeldState{
+			Keys:    append(make([]uint16, 0, len(keys)), keys...),
+			Buttons: buttons,
+		}
+	}
+	return changed
+}
+
+func (r *DeviceRegistry) CountUnhandled(path string, name string) {
+	r.Lock()
+	defer r.Unlock()
+	info, ok := r.devices[path]
+	if !ok {
+		return
+	}
+	if info.Unhandled == nil {
+		info.Unhandled = make(map[string]uint64, 0)
+	}
+	info.Unhandled[name] += 1
+}
+
+// Device that has gone longest without input (counting from when it was
+// added if it has had none), nil if there are no devices
+func (r *DeviceRegistry) OldestIdle() *DeviceInfo {
+	r.Lock()
+	defer r.Unlock()
+	var oldest *DeviceInfo
+	var oldestActive int64
+	for _, info := range r.devices {
+		active := atomic.LoadInt64(&info.lastActivity)
+		if active == 0 {
+			active = info.Since.UnixNano()
+		}
+		if oldest == nil || active < oldestActive {
+			oldest, oldestActive = info, active
+		}
+	}
+	return oldest
+}
+
+// Number of devices in the given state
+func (r *DeviceRegistry) CountState(state string) int {
+	r.Lock()
+	defer r.Unlock()
+	count := 0
+	for _, info := range r.devices {
+		if info.State == state {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (r *DeviceRegistry) Remove(path string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.devices, path)
+}
+
+// Copies the device information, which the caller must hold the registry
+// lock for. The counters updated by Activity are read atomically.
+func (info *DeviceInfo) snapshot() DeviceInfo {
+	device := DeviceInfo{
+		Name:     info.Name,
+		Path:     info.Path,
+		Identity: info.Identity,
+		ById:     info.ById,
+		Type:     info.Type,
+		Address:  info.Address,
+		Group:    info.Group,
+		Role:     info.Role,
+		State:    info.State,
+		Since:    info.Since,
+		Events:   atomic.LoadUint64(&info.events),
+		Held:     info.Held,
+	}
+	if last := atomic.LoadInt64(&info.lastActivity); last > 0 {
+		lastActivity := time.Unix(0, last)
+		device.LastActivity = &lastActivity
+	}
+	if info.Unhandled != nil {
+		device.Unhandled = make(map[string]uint64, len(info.Unhandled))
+		for name, count := range info.Unhandled {
+			device.Unhandled[name] = count
+		}
+	}
+	return device
+}
+
+// Returns a copy of the current device information, including the devices
+// found but not handled, sorted by device node
+func (r *DeviceRegistry) Snapshot() []DeviceInfo {
+	r.Lock()
+	defer r.Unlock()
+	snapshot := make([]DeviceInfo, 0, len(r.devices)+len(r.seen))
+	for _, info := range r.devices {
+		snapshot = append(snapshot, info.snapshot())
+	}
+	for _, info := range r.seen {
+		snapshot = append(snapshot, info.snapshot())
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Path < snapshot[j].Path
+	})
+	return snapshot
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	evdev "github.com/gvalkov/golang-evdev"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistrySnapshotWhileActive(t *testing.T) {
+	r := &DeviceRegistry{
+		devices: make(map[string]*DeviceInfo, 0),
+		seen:    make(map[string]*DeviceInfo, 0),
+	}
+	info := r.Add(&evdev.InputDevice{Fn: "/dev/input/event90", Name: "test"}, string(DEVICE_KEYBOARD))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			info.Activity()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		r.Snapshot()
+	}
+	wg.Wait()
+	snapshot := r.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].Events != 1000 || snapshot[0].LastActivity == nil {
+		t.Fatalf("got %+v, want one device with 1000 events and a last activity", snapshot)
+	}
+}
+
+func TestRegistryListsSeenDevices(t *testing.T) {
+	r := &DeviceRegistry{
+		devices: make(map[string]*DeviceInfo, 0),
+		seen:    make(map[string]*DeviceInfo, 0),
+	}
+	r.Seen(&evdev.InputDevice{Fn: "/dev/input/event91", Name: "pad"}, string(DEVICE_GAMEPAD))
+	snapshot := r.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].Type != "gamepad" || snapshot[0].State != DEVICE_NOT_GRABBED {
+		t.Fatalf("got %+v, want the gamepad listed as not grabbed", snapshot)
+	}
+	if r.Len() != 0 {
+		t.Errorf("got %d handled devices, want 0", r.Len())
+	}
+	// Never active, so there's no last activity in the JSON
+	data, err := json.Marshal(snapshot[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "lastActivity") {
+		t.Errorf("got %s, want no lastActivity", data)
+	}
+	r.PruneSeen(map[string]bool{})
+	if len(r.Snapshot()) != 0 {
+		t.Errorf("seen device not pruned")
+	}
+}
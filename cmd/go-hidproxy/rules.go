@@ -0,0 +1,173 @@
+package main
+
+// Declarative key rules from the configuration file, eg. a Fn layer:
+//
+//	"rules": [
+//	  {"held": ["KEY_FN"], "key": "KEY_UP", "action": "remap", "to": "KEY_VOLUMEUP"},
+//	  {"device": "0005:04e8:7021", "key": "KEY_CAPSLOCK", "action": "drop"}
+//	]
+//
+// A rule matches a key event if the event is for its key, all keys in held
+// are held down on the same device and, if given, the device matches by
+// identity (bus:vendor:product) or name. Rules are evaluated in the order
+// they are given and the first match wins; keys no rule matches are
+// processed as usual. Actions:
+//
+//   - remap: the key is processed as the key in to, so it goes through the
+//     key table, mouse actions and system control keys like that key would
+//   - drop: the key is not sent
+//   - sequence: a press sends the sequence in to (eg. ctrl-alt-del), the
+//     key itself is not sent
+//   - command: a press runs the proxy command in to (pause, resume,
+//     toggle-pause or release-all, like on the control FIFO). The key itself
+//     is only sent if forward is set, eg. to keep Compose working on the
+//     host while also using it to pause the proxy.
+//
+// The rule is picked when the key is pressed and applies until the key is
+// released, so releasing the held keys first doesn't leave the remapped key
+// stuck.
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	"strings"
+)
+
+const (
+	RULE_REMAP    = "remap"
+	RULE_DROP     = "drop"
+	RULE_SEQUENCE = "sequence"
+	RULE_COMMAND  = "command"
+)
+
+type RuleConfig struct {
+	Device string   `json:"device,omitempty"`
+	Held   []string `json:"held,omitempty"`
+	Key    string   `json:"key"`
+	Action string   `json:"action"`
+	To     string   `json:"to,omitempty"`
+	// For command, also send the key
+	Forward bool `json:"forward,omitempty"`
+}
+
+type Rule struct {
+	Device string
+	Held   []uint16
+	Key    uint16
+	Action string
+	// Key code for remap
+	To uint16
+	// Sequence name for sequence
+	Sequence string
+	// Command for command, and whether the key is sent too
+	Command string
+	Forward bool
+}
+
+// Parses and validates the rules, keeping their order
+func ParseRules(rules []RuleConfig) ([]Rule, error) {
+	parsed := make([]Rule, 0, len(rules))
+	for i, config := range rules {
+		rule := Rule{Device: config.Device, Action: config.Action}
+		code, ok := KeyCode(config.Key)
+		if !ok {
+			return nil, fmt.Errorf("rule %d: unknown key: %s", i+1, config.Key)
+		}
+		rule.Key = code
+		for _, name := range config.Held {
+			code, ok := KeyCode(name)
+			if !ok {
+				return nil, fmt.Errorf("rule %d: unknown held key: %s", i+1, name)
+			}
+			rule.Held = append(rule.Held, code)
+		}
+		switch config.Action {
+		case RULE_REMAP:
+			code, ok := KeyCode(config.To)
+			if !ok {
+				return nil, fmt.Errorf("rule %d: unknown key to remap to: %s", i+1, config.To)
+			}
+			rule.To = code
+		case RULE_DROP:
+		case RULE_SEQUENCE:
+			if _, err := SequenceSteps(config.To); err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err.Error())
+			}
+			rule.Sequence = config.To
+		case RULE_COMMAND:
+			if !IsControlCommand(config.To) {
+				return nil, fmt.Errorf("rule %d: unknown command: %s (expected %s)", i+1, config.To, strings.Join(controlCommands, ", "))
+			}
+			rule.Command = config.To
+			rule.Forward = config.Forward
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action: %s (expected %s, %s, %s or %s)", i+1, config.Action, RULE_REMAP, RULE_DROP, RULE_SEQUENCE, RULE_COMMAND)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// Evaluates the rules for the key events of one device
+type RuleEngine struct {
+	rules []Rule
+	// Keys physically held down on the device, by evdev key code
+	pressed map[uint16]bool
+	// Rule picked for each held key when it was pressed, nil for none
+	active map[uint16]*Rule
+}
+
+// Rule engine with the rules that apply to the device
+func NewRuleEngine(rules []Rule, dev *evdev.InputDevice) *RuleEngine {
+	engine := &RuleEngine{
+		rules:   make([]Rule, 0),
+		pressed: make(map[uint16]bool, 0),
+		active:  make(map[uint16]*Rule, 0),
+	}
+	for _, rule := range rules {
+		if rule.Device == "" || rule.Device == DeviceIdentity(dev) || rule.Device == dev.Name {
+			engine.rules = append(engine.rules, rule)
+		}
+	}
+	return engine
+}
+
+func (e *RuleEngine) matches(rule *Rule, code uint16) bool {
+	if rule.Key != code {
+		return false
+	}
+	for _, held := range rule.Held {
+		if !e.pressed[held] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the rule for a key event (value 0 release, 1 press, 2 repeat), if
+// any. Every key event on the device has to go through here, so that the
+// held keys are known.
+func (e *RuleEngine) Apply(code uint16, value int32) *Rule {
+	if len(e.rules) == 0 {
+		return nil
+	}
+	switch value {
+	case 1:
+		var matched *Rule
+		for i := range e.rules {
+			if e.matches(&e.rules[i], code) {
+				matched = &e.rules[i]
+				break
+			}
+		}
+		e.pressed[code] = true
+		e.active[code] = matched
+		return matched
+	case 0:
+		matched := e.active[code]
+		delete(e.pressed, code)
+		delete(e.active, code)
+		return matched
+	}
+	return e.active[code]
+}
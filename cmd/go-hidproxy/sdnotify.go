@@ -0,0 +1,81 @@
+package main
+
+// Minimal sd_notify(3) implementation for running as a Type=notify service
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Last time (in Unix nanoseconds) a report was written to a HID gadget device
+var lastReportWritten int64
+
+func MarkReportWritten() {
+	atomic.StoreInt64(&lastReportWritten, time.Now().UnixNano())
+}
+
+func SdNotify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	socketAddr := &net.UnixAddr{
+		Name: socketPath,
+		Net:  "unixgram",
+	}
+	// Abstract namespace sockets are passed with a leading @
+	if socketPath[0] == '@' {
+		socketAddr.Name = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix(socketAddr.Net, nil, socketAddr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the watchdog interval requested by systemd (WatchdogSec=), or zero
+// if the watchdog is not enabled for this process.
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Pings the systemd watchdog at half the requested interval for as long as
+// report processing is healthy. If reports are queued but nothing has been
+// written for a full interval, the writers are considered stalled and pings
+// stop, so systemd restarts the service.
+func SdWatchdog(interval time.Duration, queues ...chan InputMessage) {
+	log.Infof("Starting systemd watchdog, interval %s", interval)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		pending := 0
+		for _, queue := range queues {
+			pending += len(queue)
+		}
+		lastWrite := time.Unix(0, atomic.LoadInt64(&lastReportWritten))
+		if pending > 0 && time.Since(lastWrite) > interval {
+			log.Errorf("Report processing stalled: %d reports pending, last write %s ago", pending, time.Since(lastWrite))
+			continue
+		}
+		if _, err := SdNotify("WATCHDOG=1"); err != nil {
+			log.Warnf("Failed to notify systemd watchdog: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+// Attention sequences (Ctrl+Alt+Del, magic SysRq) sent on demand
+
+import (
+	"fmt"
+	"github.com/loov/hrtime"
+	"strings"
+	"time"
+)
+
+// Time each step of a sequence is held so that the host registers it
+const SEQUENCE_STEP_DELAY = 20 * time.Millisecond
+
+const (
+	USAGE_DELETE       = 76
+	USAGE_SYSRQ        = 70
+	USAGE_LEFT_CONTROL = 224
+	USAGE_LEFT_ALT     = 226
+)
+
+// Returns the keys held in each step of the named sequence. Every sequence
+// presses its modifiers first, then the whole chord in a single report, and
+// ends with all keys released so no modifier is left stuck on the host.
+func SequenceSteps(name string) ([][]uint16, error) {
+	if name == "ctrl-alt-del" {
+		return [][]uint16{
+			{USAGE_LEFT_CONTROL, USAGE_LEFT_ALT},
+			{USAGE_LEFT_CONTROL, USAGE_LEFT_ALT, USAGE_DELETE},
+			{USAGE_LEFT_CONTROL, USAGE_LEFT_ALT},
+			{},
+		}, nil
+	}
+	if strings.HasPrefix(name, "sysrq-") && len(name) == len("sysrq-")+1 {
+		var key uint16
+		c := name[len(name)-1]
+		switch {
+		case c >= 'a' && c <= 'z':
+			key = 4 + uint16(c-'a')
+		case c >= '1' && c <= '9':
+			key = 30 + uint16(c-'1')
+		case c == '0':
+			key = 39
+		default:
+			return nil, fmt.Errorf("invalid SysRq command: %c", c)
+		}
+		return [][]uint16{
+			{USAGE_LEFT_ALT},
+			{USAGE_LEFT_ALT, USAGE_SYSRQ},
+			{USAGE_LEFT_ALT, USAGE_SYSRQ, key},
+			{USAGE_LEFT_ALT, USAGE_SYSRQ},
+			{},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown sequence: %s (expected ctrl-alt-del or sysrq-<key>)", name)
+}
+
+// Sends the named sequence to the keyboard writer. Reports are sent blocking
+// rather than with a drop policy, as losing the release would leave keys held.
+func SendSequence(input chan<- InputMessage, name string) error {
+	steps, err := SequenceSteps(name)
+	if err != nil {
+		return err
+	}
+	sendSteps(input, steps)
+	return nil
+}
+
+// Sends a report for each step, holding each for SEQUENCE_STEP_DELAY
+func sendSteps(input chan<- InputMessage, steps [][]uint16) {
+	for i, keys := range steps {
+		if i > 0 {
+			time.Sleep(SEQUENCE_STEP_DELAY)
+		}
+		input <- InputMessage{
+			Timestamp: hrtime.Now(),
+			Message:   BuildKeyboardReport(keys),
+		}
+	}
+}
+
+// Key chord (as HID usages) that triggers a sequence
+type Hotkey struct {
+	Keys     []uint16
+	Sequence string
+}
+
+// Parses hotkeys given as evdev key names joined with +, eg.
+// "KEY_RIGHTCTRL+KEY_RIGHTALT+KEY_END": "ctrl-alt-del"
+func ParseHotkeys(hotkeys map[string]string, keymap *Keymap) ([]Hotkey, error) {
+	parsed := make([]Hotkey, 0)
+	for chord, sequence := range hotkeys {
+		if _, err := SequenceSteps(sequence); err != nil {
+			return nil, err
+		}
+		hotkey := Hotkey{Sequence: sequence}
+		for _, name := range strings.Split(chord, "+") {
+			code, ok := KeyCode(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown key in hotkey %s: %s", chord, name)
+			}
+			usage, ok := keymap.Lookup(code)
+			if !ok {
+				return nil, fmt.Errorf("key %s in hotkey %s has no HID usage", name, chord)
+			}
+			hotkey.Keys = append(hotkey.Keys, usage)
+		}
+		parsed = append(parsed, hotkey)
+	}
+	return parsed, nil
+}
+
+// Returns the hotkey whose chord is exactly the set of keys held down
+func MatchHotkey(hotkeys []Hotkey, keysDown []uint16) *Hotkey {
+	for i, hotkey := range hotkeys {
+		if len(hotkey.Keys) != len(keysDown) {
+			continue
+		}
+		matched := true
+		for _, k := range hotkey.Keys {
+			found := false
+			for _, d := range keysDown {
+				if d == k {
+					found = true
+					break
+				}
+			}
+			if !found {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return &hotkeys[i]
+		}
+	}
+	return nil
+}
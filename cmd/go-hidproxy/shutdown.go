@@ -0,0 +1,66 @@
+package main
+
+// Stopping the proxy on SIGINT or SIGTERM without leaving devices grabbed or
+// keys held on the host
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// How long to wait on shutdown for the device handlers to release their
+// devices, and then for the writers to release the keys held on the host
+const SHUTDOWN_TIMEOUT = 3 * time.Second
+
+// Tells every device handler to stop and waits up to timeout for all of them
+// to release their devices. The wait group counts the handlers plus one for
+// the main loop, which is done once it calls this. Returns false on timeout.
+func StopHandlers(wg *sync.WaitGroup, output map[InputDevice]chan error, stop map[InputDevice]chan bool, timeout time.Duration) bool {
+	for id, eventOutput := range output {
+		select {
+		case stop[id] <- true:
+		default:
+		}
+		go func(id InputDevice, eventOutput chan error) {
+			<-eventOutput
+			Devices.Remove(id.Device)
+			wg.Done()
+		}(id, eventOutput)
+	}
+	wg.Done()
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Queues empty reports to all writers (see ReleaseAll) and waits up to
+// timeout for them to be written. Returns false on timeout.
+func (q ReportQueues) Flush(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		q.ReleaseAll()
+		for len(q.Keyboard) > 0 || len(q.Mouse) > 0 || len(q.System) > 0 || len(q.Consumer) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// The writers have taken the reports, let them finish writing
+		time.Sleep(SEQUENCE_STEP_DELAY)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		log.Warnf("Writers didn't empty their queues in %s, keys may remain held on the host", timeout)
+		return false
+	}
+}
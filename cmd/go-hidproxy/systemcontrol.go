@@ -0,0 +1,68 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Generic Desktop usages of the System Control collection
+const (
+	USAGE_SYSTEM_POWER_DOWN = 0x81
+	USAGE_SYSTEM_SLEEP      = 0x82
+	USAGE_SYSTEM_WAKE_UP    = 0x83
+)
+
+// Keys sent as System Control reports instead of keyboard reports, which
+// hosts ignore for these keys
+var SystemControlKeys = map[uint16]uint8{
+	116: USAGE_SYSTEM_POWER_DOWN, // KEY_POWER
+	142: USAGE_SYSTEM_SLEEP,      // KEY_SLEEP
+	143: USAGE_SYSTEM_WAKE_UP,    // KEY_WAKEUP
+}
+
+// One byte report holding the index of the pressed control (1-3), 0 for none
+func SystemControlReportDescriptor() []byte {
+	return NewDescriptor().
+		UsagePage(USAGE_PAGE_GENERIC_DESKTOP).
+		Usage(0x80). // System Control
+		Collection(COLLECTION_APPLICATION).
+		UsageMinimum(USAGE_SYSTEM_POWER_DOWN).
+		UsageMaximum(USAGE_SYSTEM_WAKE_UP).
+		LogicalMinimum(1).
+		LogicalMaximum(3).
+		ReportSize(2).
+		ReportCount(1).
+		Input(HID_DATA | HID_ARRAY | HID_ABSOLUTE).
+		ReportSize(6).
+		Input(HID_CONSTANT | HID_VARIABLE). // padding
+		EndCollection().
+		Bytes()
+}
+
+func BuildSystemControlReport(usage uint8) []uint8 {
+	if usage == 0 {
+		return []uint8{0}
+	}
+	return []uint8{usage - USAGE_SYSTEM_POWER_DOWN + 1}
+}
+
+// Length of the system control report, as built by BuildSystemControlReport
+func SystemControlReportLength() int {
+	return len(BuildSystemControlReport(0))
+}
+
+func SendSystemControlReports(path string, input <-chan InputMessage, ready chan<- bool, reportLength int) error {
+	log.Infof("Opening system control %s for writing...", path)
+	file, err := OpenHidOutput(path)
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+	defer file.Close()
+	ready <- true
+
+	err = WriteReports(file, path, input, Latencies["system"], Throughputs["system"], WriterOptions{Type: "system", LatencyEvery: 10, ReportLength: reportLength})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+// Mirrors the reports written to the outputs to capture files or network
+// listeners, alongside live operation
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Reports queued per sink before they are dropped, so that a slow sink never
+// holds up the writes to the host
+const SINK_QUEUE_LENGTH = 256
+
+// A report as written to a sink, one JSON object per line:
+//
+//	{"time":"2021-05-01T12:00:00.000000001Z","output":"/dev/hidg0","report":"0000040000000000"}
+type ReportRecord struct {
+	Time   time.Time `json:"time"`
+	Output string    `json:"output"`
+	Report string    `json:"report"`
+}
+
+// Destination for copies of the reports written to the outputs
+type ReportSink struct {
+	name    string
+	writer  io.WriteCloser
+	queue   chan ReportRecord
+	dropped uint64
+}
+
+// Sinks every written report is copied to
+var ReportSinks = make([]*ReportSink, 0)
+
+// Opens a sink: tcp://host:port or udp://host:port to send the records to a
+// network listener, or a file name (optionally as file:name) to append them to
+func OpenSink(spec string) (*ReportSink, error) {
+	var writer io.WriteCloser
+	var err error
+	switch {
+	case strings.HasPrefix(spec, "tcp://"), strings.HasPrefix(spec, "udp://"):
+		writer, err = net.Dial(spec[:3], spec[len("tcp://"):])
+	default:
+		writer, err = os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sink := &ReportSink{
+		name:   spec,
+		writer: writer,
+		queue:  make(chan ReportRecord, SINK_QUEUE_LENGTH),
+	}
+	go sink.run()
+	log.Infof("Copying reports to %s", spec)
+	return sink, nil
+}
+
+func (s *ReportSink) run() {
+	encoder := json.NewEncoder(s.writer)
+	failed := false
+	for record := range s.queue {
+		if err := encoder.Encode(record); err != nil {
+			if !failed {
+				log.Warnf("Failed to write report to %s: %s", s.name, err.Error())
+				failed = true
+			}
+			continue
+		}
+		failed = false
+	}
+	s.writer.Close()
+}
+
+// Queues a copy of the report, dropping it if the sink is backed up
+func (s *ReportSink) Send(output string, report []byte) {
+	select {
+	case s.queue <- ReportRecord{Time: time.Now(), Output: output, Report: hex.EncodeToString(report)}:
+	default:
+		if atomic.AddUint64(&s.dropped, 1)%SINK_QUEUE_LENGTH == 1 {
+			log.Warnf("Sink %s is not keeping up, dropped %d reports so far", s.name, atomic.LoadUint64(&s.dropped))
+		}
+	}
+}
+
+// Writes to the output and copies what was written to the sinks
+type teeWriter struct {
+	output io.Writer
+	name   string
+	sinks  []*ReportSink
+}
+
+// Wraps the output so every report written to it is also sent to the sinks
+func Tee(output io.Writer, name string, sinks []*ReportSink) io.Writer {
+	if len(sinks) == 0 {
+		return output
+	}
+	return &teeWriter{output: output, name: name, sinks: sinks}
+}
+
+func (t *teeWriter) Write(report []byte) (int, error) {
+	n, err := t.output.Write(report)
+	if err != nil {
+		return n, err
+	}
+	for _, sink := range t.sinks {
+		sink.Send(t.name, report)
+	}
+	return n, nil
+}
+
+// Opens all sinks given in the configuration
+func OpenSinks(specs []string) ([]*ReportSink, error) {
+	sinks := make([]*ReportSink, 0, len(specs))
+	for _, spec := range specs {
+		sink, err := OpenSink(spec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %s", spec, err.Error())
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
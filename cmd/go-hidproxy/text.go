@@ -0,0 +1,122 @@
+package main
+
+// Typing text on the host, for the control API and -type-file
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+const USAGE_LEFT_SHIFT = 225
+
+// A key on the US layout and whether it needs Shift
+type typedKey struct {
+	Usage uint16
+	Shift bool
+}
+
+// Keys producing the printable ASCII characters, tab and newline on a host
+// with the US layout
+var usKeys = func() map[rune]typedKey {
+	keys := map[rune]typedKey{
+		' ':  {44, false},
+		'\n': {40, false}, // Enter
+		'\t': {43, false},
+		'0':  {39, false},
+		')':  {39, true},
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		keys[c] = typedKey{4 + uint16(c-'a'), false}
+		keys[c-'a'+'A'] = typedKey{4 + uint16(c-'a'), true}
+	}
+	for i, shifted := range "!@#$%^&*(" {
+		keys['1'+rune(i)] = typedKey{30 + uint16(i), false}
+		keys[shifted] = typedKey{30 + uint16(i), true}
+	}
+	for usage, pair := range map[uint16]string{
+		45: "-_", 46: "=+", 47: "[{", 48: "]}", 49: "\\|",
+		51: ";:", 52: "'\"", 53: "`~", 54: ",<", 55: ".>", 56: "/?",
+	} {
+		keys[rune(pair[0])] = typedKey{usage, false}
+		keys[rune(pair[1])] = typedKey{usage, true}
+	}
+	return keys
+}()
+
+// Returns the keys held in each step of typing the text on a host with the
+// US layout. Shifted characters press Shift first and release it last, so the
+// host sees Shift held for the whole keystroke. Every character ends with all
+// keys released, so repeated characters register as separate presses. Fails
+// on characters the layout can't type, without typing anything.
+func TypeSteps(text string) ([][]uint16, error) {
+	steps := make([][]uint16, 0, len(text)*2)
+	for _, c := range text {
+		key, ok := usKeys[c]
+		if !ok {
+			return nil, fmt.Errorf("can't type %q on the US layout", c)
+		}
+		if key.Shift {
+			steps = append(steps,
+				[]uint16{USAGE_LEFT_SHIFT},
+				[]uint16{USAGE_LEFT_SHIFT, key.Usage},
+				[]uint16{USAGE_LEFT_SHIFT},
+				[]uint16{},
+			)
+		} else {
+			steps = append(steps, []uint16{key.Usage}, []uint16{})
+		}
+	}
+	return steps, nil
+}
+
+// Types the text on the host through the keyboard writer
+func SendText(input chan<- InputMessage, text string) error {
+	steps, err := TypeSteps(text)
+	if err != nil {
+		return err
+	}
+	sendSteps(input, steps)
+	return nil
+}
+
+// Types a text file on the host, reading it as it goes so that files of any
+// length can be typed. Characters the US layout can't type are skipped with a
+// warning, carriage returns are ignored so that files with DOS line endings
+// work. The delay is added after each character.
+func TypeFile(input chan<- InputMessage, path string, delay time.Duration) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	log.Infof("Typing %s", path)
+	reader := bufio.NewReader(file)
+	line, column := 1, 0
+	for {
+		c, _, err := reader.ReadRune()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		column += 1
+		if c == '\r' {
+			continue
+		}
+		steps, err := TypeSteps(string(c))
+		if err != nil {
+			log.Warnf("Skipping character at line %d, column %d of %s: %s", line, column, path, err.Error())
+			continue
+		}
+		sendSteps(input, steps)
+		time.Sleep(delay)
+		if c == '\n' {
+			line, column = line+1, 0
+		}
+	}
+}
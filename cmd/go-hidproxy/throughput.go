@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Period the write rate is computed over
+const THROUGHPUT_PERIOD = 5 * time.Second
+
+// Write throughput of reports and the depth of the writer's input queue,
+// sampled on every write over a window of the most recent writes. A queue
+// that stays deep means the host isn't taking reports as fast as they come
+// in, which shows up as lag.
+type ThroughputStats struct {
+	sync.Mutex
+	times    []time.Time
+	depths   []int
+	next     int
+	count    uint64
+	capacity int
+}
+
+type ThroughputSummary struct {
+	Count uint64 `json:"count"`
+	// Reports written per second over the last THROUGHPUT_PERIOD
+	Rate float64 `json:"rate"`
+	// Queue depth at the last write, and the mean and maximum over the window
+	Depth     int     `json:"depth"`
+	MeanDepth float64 `json:"meanDepth"`
+	MaxDepth  int     `json:"maxDepth"`
+	Capacity  int     `json:"capacity"`
+}
+
+// Throughput statistics per report type
+var Throughputs = map[string]*ThroughputStats{
+	"keyboard": NewThroughputStats(LATENCY_WINDOW),
+	"mouse":    NewThroughputStats(LATENCY_WINDOW),
+	"system":   NewThroughputStats(LATENCY_WINDOW),
+	"consumer": NewThroughputStats(LATENCY_WINDOW),
+}
+
+func NewThroughputStats(window int) *ThroughputStats {
+	return &ThroughputStats{
+		times:  make([]time.Time, 0, window),
+		depths: make([]int, 0, window),
+	}
+}
+
+// Records a write, with the number of reports still queued behind it and the
+// size of the queue
+func (s *ThroughputStats) Observe(depth int, capacity int) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if len(s.times) < cap(s.times) {
+		s.times = append(s.times, now)
+		s.depths = append(s.depths, depth)
+	} else {
+		s.times[s.next] = now
+		s.depths[s.next] = depth
+		s.next = (s.next + 1) % len(s.times)
+	}
+	s.count += 1
+	s.capacity = capacity
+}
+
+func (s *ThroughputStats) Summary() ThroughputSummary {
+	s.Lock()
+	defer s.Unlock()
+	summary := ThroughputSummary{Count: s.count, Capacity: s.capacity}
+	if len(s.times) == 0 {
+		return summary
+	}
+	last := (s.next + len(s.times) - 1) % len(s.times)
+	summary.Depth = s.depths[last]
+	total := 0
+	for _, depth := range s.depths {
+		total += depth
+		if depth > summary.MaxDepth {
+			summary.MaxDepth = depth
+		}
+	}
+	summary.MeanDepth = float64(total) / float64(len(s.depths))
+
+	// If the whole window was written within the period, the rate is over
+	// the window instead
+	now := time.Now()
+	recent := 0
+	oldest := now
+	for _, t := range s.times {
+		if now.Sub(t) <= THROUGHPUT_PERIOD {
+			recent += 1
+			if t.Before(oldest) {
+				oldest = t
+			}
+		}
+	}
+	period := THROUGHPUT_PERIOD
+	if recent == len(s.times) && len(s.times) == cap(s.times) {
+		period = now.Sub(oldest)
+	}
+	if period > 0 {
+		summary.Rate = float64(recent) / period.Seconds()
+	}
+	return summary
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const CONFIGFS_GADGET_PATH = "/sys/kernel/config/usb_gadget"
+
+// Polls cond until it returns true or the timeout expires, logging what is
+// being waited for if it isn't ready right away
+func WaitFor(what string, timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		if cond() {
+			if logged {
+				log.Infof("Done waiting for %s", what)
+			}
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Warnf("Gave up waiting for %s after %s", what, timeout)
+			return false
+		}
+		if !logged {
+			log.Infof("Waiting up to %s for %s...", timeout, what)
+			logged = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func pathsExist(paths ...string) func() bool {
+	return func() bool {
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Names of the USB device controllers available for gadgets
+func UDCs() []string {
+	udcs := make([]string, 0)
+	matches, _ := filepath.Glob("/sys/class/udc/*")
+	for _, match := range matches {
+		udcs = append(udcs, filepath.Base(match))
+	}
+	return udcs
+}
+
+// Picks the UDC to bind the gadget to: the given one, which must exist, or
+// the only one there is. With several UDCs one has to be given, since a
+// gadget can only be bound to one of them.
+func SelectUDC(name string) (string, error) {
+	udcs := UDCs()
+	if name != "" {
+		for _, udc := range udcs {
+			if udc == name {
+				return udc, nil
+			}
+		}
+		return "", fmt.Errorf("USB device controller %s not found (available: %s)", name, strings.Join(udcs, ", "))
+	}
+	switch len(udcs) {
+	case 0:
+		return "", fmt.Errorf("no USB device controllers in /sys/class/udc")
+	case 1:
+		return udcs[0], nil
+	}
+	return "", fmt.Errorf("several USB device controllers found (%s), choose one with -udc", strings.Join(udcs, ", "))
+}
+
+// Zero while the gadget is left unbound by -bind-on-demand, when writes to
+// the HID devices would fail
+var gadgetBound int32 = 1
+
+func IsGadgetBound() bool {
+	return atomic.LoadInt32(&gadgetBound) != 0
+}
+
+// Number of times the gadget has been unbound, see UnboundSince
+var gadgetUnbinds int32 = 0
+
+func GadgetUnbinds() int32 {
+	return atomic.LoadInt32(&gadgetUnbinds)
+}
+
+// Returns true if the gadget is unbound or has been unbound since
+// GadgetUnbinds returned unbinds. Writes that were in flight then fail, which
+// is expected rather than fatal.
+func UnboundSince(unbinds int32) bool {
+	return !IsGadgetBound() || GadgetUnbinds() != unbinds
+}
+
+// Binds the gadget to the UDC picked by SelectUDC, unless it already is
+func BindGadget(gadgetPath string, gadget GadgetConfig) error {
+	udc, err := SelectUDC(gadget.UDC)
+	if err != nil {
+		return err
+	}
+	udcFile := filepath.Join(gadgetPath, gadget.Name, "UDC")
+	if content, err := ioutil.ReadFile(udcFile); err == nil && strings.TrimSpace(string(content)) != udc {
+		log.Infof("Binding gadget %s to %s", gadget.Name, udc)
+		if err := ioutil.WriteFile(udcFile, []byte(udc), os.FileMode(0644)); err != nil {
+			return fmt.Errorf("failed to bind gadget to %s via %s: %s", udc, udcFile, err.Error())
+		}
+	}
+	atomic.StoreInt32(&gadgetBound, 1)
+	return nil
+}
+
+// Unbinds the gadget from its UDC, if it is bound. Report writers stop
+// writing first, as writes fail while the gadget is unbound; writes already
+// in flight fail without stopping the writers (see UnboundSince).
+func UnbindGadget(gadgetPath string, gadgetName string) error {
+	atomic.StoreInt32(&gadgetBound, 0)
+	atomic.AddInt32(&gadgetUnbinds, 1)
+	udcFile := filepath.Join(gadgetPath, gadgetName, "UDC")
+	if udc, err := ioutil.ReadFile(udcFile); err == nil && strings.TrimSpace(string(udc)) != "" {
+		log.Infof("Unbinding gadget %s from %s", gadgetName, strings.TrimSpace(string(udc)))
+		if err := ioutil.WriteFile(udcFile, []byte("\n"), os.FileMode(0644)); err != nil {
+			return fmt.Errorf("failed to unbind gadget: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// UDC states (from the kernel's usb_state_string) worth explaining
+const (
+	UDC_STATE_NOT_ATTACHED = "not attached"
+	UDC_STATE_CONFIGURED   = "configured"
+	UDC_STATE_SUSPENDED    = "suspended"
+)
+
+// How often WatchUDCState checks the state of the UDC
+const UDC_STATE_POLL_INTERVAL = 5 * time.Second
+
+// USB device controller the gadget is bound to, empty if it isn't bound
+func BoundUDC(gadgetPath string, gadgetName string) string {
+	udc, err := ioutil.ReadFile(filepath.Join(gadgetPath, gadgetName, "UDC"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(udc))
+}
+
+// State of the USB device controller as seen from the bus, eg. "configured"
+// once the host has enumerated the gadget, or "not attached" without a host
+func UDCState(udc string) (string, error) {
+	state, err := ioutil.ReadFile(filepath.Join("/sys/class/udc", udc, "state"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(state)), nil
+}
+
+// What the UDC state means for the user, empty if there's nothing to add
+func DescribeUDCState(state string) string {
+	switch state {
+	case UDC_STATE_NOT_ATTACHED:
+		return "no USB host connected: check that the cable is plugged into the data port (not the power-only port) and isn't a charge-only cable"
+	case UDC_STATE_CONFIGURED:
+		return "the host has enumerated the gadget"
+	case UDC_STATE_SUSPENDED:
+		return "the host has suspended the bus, eg. it's asleep"
+	}
+	return ""
+}
+
+type UDCStatus struct {
+	UDC   string `json:"udc"`
+	State string `json:"state"`
+}
+
+var udcStatus = struct {
+	sync.Mutex
+	UDCStatus
+}{}
+
+// UDC the gadget was last seen bound to and its state, as tracked by
+// WatchUDCState
+func CurrentUDCStatus() UDCStatus {
+	udcStatus.Lock()
+	defer udcStatus.Unlock()
+	return udcStatus.UDCStatus
+}
+
+// Logs the UDC the gadget is bound to and its state, and again whenever
+// either changes, so it's clear whether the host has enumerated the gadget
+func WatchUDCState(gadgetPath string, gadgetName string) {
+	var last UDCStatus
+	first := true
+	for {
+		status := UDCStatus{UDC: BoundUDC(gadgetPath, gadgetName)}
+		if status.UDC != "" {
+			state, err := UDCState(status.UDC)
+			if err != nil {
+				log.Debugf("Failed to read the state of %s: %s", status.UDC, err.Error())
+			}
+			status.State = state
+		}
+		if first || status != last {
+			switch {
+			case status.UDC == "" && !IsGadgetBound():
+				log.Infof("Gadget %s is not bound to a USB device controller until a device is grabbed", gadgetName)
+			case status.UDC == "":
+				log.Warnf("Gadget %s is not bound to a USB device controller", gadgetName)
+			case status.State == UDC_STATE_NOT_ATTACHED:
+				log.Warnf("USB device controller %s: %s (%s)", status.UDC, status.State, DescribeUDCState(status.State))
+			case DescribeUDCState(status.State) != "":
+				log.Infof("USB device controller %s: %s (%s)", status.UDC, status.State, DescribeUDCState(status.State))
+			default:
+				log.Infof("USB device controller %s: %s", status.UDC, status.State)
+			}
+			udcStatus.Lock()
+			udcStatus.UDCStatus = status
+			udcStatus.Unlock()
+			last, first = status, false
+		}
+		time.Sleep(UDC_STATE_POLL_INTERVAL)
+	}
+}
+
+// Finds the /dev/hidgN device node of a HID function of the gadget by its
+// device number, since the numbering of the nodes follows the order the
+// functions were bound in rather than their names, and checks that the
+// function's report length is what will be written to it. Returns the
+// fallback if the gadget isn't in configfs (eg. set up by other means).
+func HidDeviceFor(gadgetPath string, gadgetName string, function string, reportLength int, fallback string) (string, error) {
+	functionPath := filepath.Join(gadgetPath, gadgetName, "functions", function)
+	devNumber, err := ioutil.ReadFile(filepath.Join(functionPath, "dev"))
+	if err != nil {
+		log.Debugf("Can't read device number of %s, using %s: %s", function, fallback, err.Error())
+		return fallback, nil
+	}
+	length, err := ioutil.ReadFile(filepath.Join(functionPath, "report_length"))
+	if err == nil && strings.TrimSpace(string(length)) != strconv.Itoa(reportLength) {
+		return "", fmt.Errorf("%s has report length %s, expected %d (gadget set up for another configuration?)", function, strings.TrimSpace(string(length)), reportLength)
+	}
+	var major, minor uint32
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(devNumber)), "%d:%d", &major, &minor); err != nil {
+		return "", fmt.Errorf("invalid device number for %s: %s", function, devNumber)
+	}
+	nodes, _ := filepath.Glob("/dev/hidg*")
+	for _, node := range nodes {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(node, &stat); err != nil {
+			continue
+		}
+		if nodeMajor, nodeMinor := devMajorMinor(uint64(stat.Rdev)); nodeMajor == major && nodeMinor == minor {
+			if node != fallback {
+				log.Warnf("HID function %s is %s, not %s", function, node, fallback)
+			}
+			return node, nil
+		}
+	}
+	return "", fmt.Errorf("no device node for %s (%d:%d)", function, major, minor)
+}
+
+// Report length the HID function was set up with, or the fallback if the
+// gadget isn't in configfs
+func ReportLengthFor(gadgetPath string, gadgetName string, function string, fallback int) int {
+	contents, err := ioutil.ReadFile(filepath.Join(gadgetPath, gadgetName, "functions", function, "report_length"))
+	if err != nil {
+		return fallback
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return fallback
+	}
+	return length
+}
+
+// Opens a HID gadget device node for writing reports and locks it, so that a
+// second instance of the proxy (or anything else taking the same lock) can't
+// interleave its reports with ours. The lock is released when the file is
+// closed or the process exits.
+func OpenHidOutput(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Warnf("Error opening %s, are you running as root?", path)
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, &HidInUseError{Path: path}
+		}
+		return nil, fmt.Errorf("failed to lock %s: %s", path, err.Error())
+	}
+	return file, nil
+}
+
+// Error from OpenHidOutput when another process holds the lock on the device
+type HidInUseError struct {
+	Path string
+}
+
+func (e *HidInUseError) Error() string {
+	return fmt.Sprintf("%s is in use by another process: %s (is another instance of the proxy running?)", e.Path, describeHolders(e.Path))
+}
+
+// Returns the pid of the instance of the proxy holding the device, or 0 if
+// it is held by something else
+func (e *HidInUseError) ProxyPid() int {
+	self := proxyProcessName()
+	for _, pid := range DeviceHolders(e.Path) {
+		if ProcessName(pid) == self {
+			return pid
+		}
+	}
+	return 0
+}
+
+// Splits a Linux device number into its major and minor numbers
+func devMajorMinor(dev uint64) (uint32, uint32) {
+	major := uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor := uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return major, minor
+}
+
+// Unbinds the gadget from its UDC and removes it from configfs. Configfs
+// requires this to be done in reverse order of creation: function links in
+// the configurations first, then the strings, configurations and functions,
+// and finally the gadget itself.
+func TeardownUSBGadget(gadgetPath string, gadget GadgetConfig) error {
+	basepath := gadgetPath + "/" + gadget.Name
+	if !pathsExist(basepath)() {
+		return fmt.Errorf("no gadget %s in %s", gadget.Name, gadgetPath)
+	}
+	if err := UnbindGadget(gadgetPath, gadget.Name); err != nil {
+		return err
+	}
+	remove := func(pattern string, links bool) error {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			info, err := os.Lstat(path)
+			if err != nil {
+				continue
+			}
+			isLink := info.Mode()&os.ModeSymlink != 0
+			if isLink != links || (!isLink && !info.IsDir()) {
+				continue
+			}
+			log.Debugf("Removing %s", path)
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	steps := []struct {
+		pattern string
+		links   bool
+	}{
+		{basepath + "/configs/*/*", true},
+		{basepath + "/os_desc/*", true},
+		{basepath + "/configs/*/strings/*", false},
+		{basepath + "/configs/*", false},
+		{basepath + "/functions/*", false},
+		{basepath + "/strings/*", false},
+		{basepath, false},
+	}
+	for _, step := range steps {
+		if err := remove(step.pattern, step.links); err != nil {
+			return fmt.Errorf("failed to remove gadget: %s", err.Error())
+		}
+	}
+	log.Infof("Removed gadget %s", gadget.Name)
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+// Loopback output: replays the reports as input events on a local uinput
+// device instead of sending them to a USB host, for testing the translation
+// with evtest on a normal machine
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	OUTPUT_GADGET = "gadget"
+	OUTPUT_UINPUT = "uinput"
+)
+
+const (
+	UI_DEV_CREATE  = 0x5501     // _IO('U', 1)
+	UI_DEV_DESTROY = 0x5502     // _IO('U', 2)
+	UI_SET_EVBIT   = 0x40045564 // _IOW('U', 100, int)
+	UI_SET_KEYBIT  = 0x40045565 // _IOW('U', 101, int)
+	UI_SET_RELBIT  = 0x40045566 // _IOW('U', 102, int)
+)
+
+const (
+	UINPUT_DEVICE_NAME = "go-hidproxy loopback"
+	BUS_VIRTUAL        = 0x06
+)
+
+// struct uinput_user_dev
+type uinputUserDev struct {
+	Name         [80]byte
+	Bustype      uint16
+	Vendor       uint16
+	Product      uint16
+	Version      uint16
+	FfEffectsMax uint32
+	Absmax       [64]int32
+	Absmin       [64]int32
+	Absfuzz      [64]int32
+	Absflat      [64]int32
+}
+
+// struct input_event, the kernel fills in the time
+type uinputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// Virtual input device shared by the keyboard, mouse, system control and
+// consumer control outputs. Each output turns its reports back into key and relative events,
+// sending only what changed since its previous report.
+type UinputDevice struct {
+	sync.Mutex
+	file *os.File
+}
+
+func ioctlInt(file *os.File, request uintptr, value int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(value)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func NewUinputDevice() (*UinputDevice, error) {
+	file, err := os.OpenFile("/dev/uinput", os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	setup := func() error {
+		for _, ev := range []int{evdev.EV_KEY, evdev.EV_REL, evdev.EV_SYN} {
+			if err := ioctlInt(file, UI_SET_EVBIT, ev); err != nil {
+				return err
+			}
+		}
+		for code := 1; code < 256; code++ {
+			if err := ioctlInt(file, UI_SET_KEYBIT, code); err != nil {
+				return err
+			}
+		}
+		for code := evdev.BTN_LEFT; code <= evdev.BTN_TASK; code++ {
+			if err := ioctlInt(file, UI_SET_KEYBIT, code); err != nil {
+				return err
+			}
+		}
+		for _, rel := range []int{evdev.REL_X, evdev.REL_Y, evdev.REL_WHEEL, evdev.REL_HWHEEL} {
+			if err := ioctlInt(file, UI_SET_RELBIT, rel); err != nil {
+				return err
+			}
+		}
+		dev := uinputUserDev{
+			Bustype: BUS_VIRTUAL,
+			Vendor:  0x1d6b,
+			Product: 0x0104,
+			Version: 1,
+		}
+		copy(dev.Name[:], UINPUT_DEVICE_NAME)
+		if _, err := file.Write((*[unsafe.Sizeof(dev)]byte)(unsafe.Pointer(&dev))[:]); err != nil {
+			return err
+		}
+		return ioctlInt(file, UI_DEV_CREATE, 0)
+	}
+	if err := setup(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create uinput device: %s", err.Error())
+	}
+	log.Infof("Created uinput device: %s", UINPUT_DEVICE_NAME)
+	return &UinputDevice{file: file}, nil
+}
+
+// Writes the events followed by a SYN_REPORT
+func (u *UinputDevice) send(events []uinputEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	events = append(events, uinputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT})
+	u.Lock()
+	defer u.Unlock()
+	for _, event := range events {
+		if _, err := u.file.Write((*[unsafe.Sizeof(event)]byte)(unsafe.Pointer(&event))[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *UinputDevice) Close() {
+	ioctlInt(u.file, UI_DEV_DESTROY, 0)
+	u.file.Close()
+}
+
+func keyEvent(code uint16, down bool) uinputEvent {
+	event := uinputEvent{Type: evdev.EV_KEY, Code: code}
+	if down {
+		event.Value = 1
+	}
+	return event
+}
+
+// Evdev key codes for HID usages, from the keymap without the hwdb
+// remappings
+func usageKeyCodes(keymap *Keymap) map[uint16]uint16 {
+	codes := make(map[uint16]uint16, keymap.Len())
+	for code, usage := range keymap.Base() {
+		if existing, ok := codes[usage]; !ok || code < existing {
+			codes[usage] = code
+		}
+	}
+	return codes
+}
+
+// Turns keyboard reports into key events
+type uinputKeyboard struct {
+	dev   *UinputDevice
+	codes map[uint16]uint16
+	held  map[uint16]bool
+}
+
+func (u *UinputDevice) Keyboard(keymap *Keymap) *uinputKeyboard {
+	return &uinputKeyboard{dev: u, codes: usageKeyCodes(keymap), held: make(map[uint16]bool, 0)}
+}
+
+func (k *uinputKeyboard) Write(report []byte) (int, error) {
+	if len(report) < 2 {
+		return 0, fmt.Errorf("short keyboard report: %v", report)
+	}
+	usages := make(map[uint16]bool, 0)
+	for bit := 0; bit < 8; bit++ {
+		if report[0]&(1<<bit) != 0 {
+			usages[uint16(224+bit)] = true // left control onwards
+		}
+	}
+	for _, usage := range Keyboard.Keys(report) {
+		usages[usage] = true
+	}
+	if Keyboard.RolledOver(report) {
+		// Like a host, keep the keys from the slots held until a report
+		// lists them again. Modifiers and bitmap keys are always reported.
+		slotted := make(map[uint16]bool, len(k.held))
+		for usage := range k.held {
+			slotted[usage] = usage < 224
+		}
+		for _, usage := range Keyboard.Bitmap {
+			slotted[usage] = false
+		}
+		for usage, held := range slotted {
+			if held {
+				usages[usage] = true
+			}
+		}
+	}
+	events := make([]uinputEvent, 0)
+	for usage := range k.held {
+		if !usages[usage] {
+			events = append(events, keyEvent(k.codes[usage], false))
+		}
+	}
+	for usage := range usages {
+		code, ok := k.codes[usage]
+		if !ok {
+			log.Warnf("No key code for HID usage %d, not replayed", usage)
+			delete(usages, usage)
+			continue
+		}
+		if !k.held[usage] {
+			events = append(events, keyEvent(code, true))
+		}
+	}
+	k.held = usages
+	return len(report), k.dev.send(events)
+}
+
+// Turns mouse reports (buttons, X, Y, wheel, horizontal wheel) into button
+// and relative events
+type uinputMouse struct {
+	dev     *UinputDevice
+	buttons uint8
+}
+
+func (u *UinputDevice) Mouse() *uinputMouse {
+	return &uinputMouse{dev: u}
+}
+
+func (m *uinputMouse) Write(report []byte) (int, error) {
+	buttons, dx, dy, wheel, pan, ok := Mouse.Parse(report)
+	if !ok {
+		return 0, fmt.Errorf("invalid mouse report: %v", report)
+	}
+	events := make([]uinputEvent, 0)
+	for bit := 0; bit < 8; bit++ {
+		if changed := (buttons ^ m.buttons) & (1 << bit); changed != 0 {
+			events = append(events, keyEvent(uint16(evdev.BTN_LEFT+bit), buttons&changed != 0))
+		}
+	}
+	m.buttons = buttons
+	codes := []uint16{evdev.REL_X, evdev.REL_Y, evdev.REL_WHEEL, evdev.REL_HWHEEL}
+	for i, value := range []int32{dx, dy, wheel, pan} {
+		if value != 0 {
+			events = append(events, uinputEvent{Type: evdev.EV_REL, Code: codes[i], Value: value})
+		}
+	}
+	return len(report), m.dev.send(events)
+}
+
+// Turns system control reports into power, sleep and wake up key events
+type uinputSystemControl struct {
+	dev  *UinputDevice
+	held uint16
+}
+
+func (u *UinputDevice) SystemControl() *uinputSystemControl {
+	return &uinputSystemControl{dev: u}
+}
+
+func (s *uinputSystemControl) Write(report []byte) (int, error) {
+	if len(report) < 1 {
+		return 0, fmt.Errorf("short system control report: %v", report)
+	}
+	var code uint16 = 0
+	for key, usage := range SystemControlKeys {
+		if report[0] != 0 && usage == report[0]+USAGE_SYSTEM_POWER_DOWN-1 {
+			code = key
+		}
+	}
+	events := make([]uinputEvent, 0)
+	if s.held != 0 && s.held != code {
+		events = append(events, keyEvent(s.held, false))
+	}
+	if code != 0 && code != s.held {
+		events = append(events, keyEvent(code, true))
+	}
+	s.held = code
+	return len(report), s.dev.send(events)
+}
+
+// Turns consumer control reports into media key events
+type uinputConsumerControl struct {
+	dev  *UinputDevice
+	held uint16
+}
+
+func (u *UinputDevice) ConsumerControl() *uinputConsumerControl {
+	return &uinputConsumerControl{dev: u}
+}
+
+func (c *uinputConsumerControl) Write(report []byte) (int, error) {
+	if len(report) < 2 {
+		return 0, fmt.Errorf("short consumer control report: %v", report)
+	}
+	pressed := uint16(report[0]) | uint16(report[1])<<8
+	var code uint16 = 0
+	for key, usage := range ConsumerKeys {
+		if pressed != 0 && usage == pressed {
+			code = key
+		}
+	}
+	events := make([]uinputEvent, 0)
+	if c.held != 0 && c.held != code {
+		events = append(events, keyEvent(c.held, false))
+	}
+	if code != 0 && code != c.held {
+		events = append(events, keyEvent(code, true))
+	}
+	c.held = code
+	return len(report), c.dev.send(events)
+}
+
+// Writes reports from the input channel to the loopback device
+func SendUinputReports(output io.Writer, name string, reportType string, input <-chan InputMessage, ready chan<- bool, interval time.Duration) {
+	ready <- true
+	if err := WriteReports(output, name, input, Latencies[reportType], Throughputs[reportType], WriterOptions{Type: reportType, LatencyEvery: 100, Interval: interval}); err != nil {
+		log.Fatal(err)
+	}
+}
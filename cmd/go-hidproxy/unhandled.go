@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names an event by its type and code, eg. EV_MSC/MSC_SCAN
+func EventName(event *evdev.InputEvent) string {
+	typeName, ok := evdev.EV[int(event.Type)]
+	if !ok {
+		typeName = fmt.Sprintf("EV_%d", event.Type)
+	}
+	codeName, ok := evdev.ByEventType[int(event.Type)][int(event.Code)]
+	if !ok {
+		codeName = fmt.Sprintf("%d", event.Code)
+	}
+	return typeName + "/" + codeName
+}
+
+// Counts the events a handler has no use for, so that features of a device
+// the proxy ignores (eg. switches or raw scancodes) can be discovered. The
+// counts are shown in GET /devices and, with an interval, logged whenever
+// new events have been seen.
+type UnhandledCounter struct {
+	logger   *log.Entry
+	dev      *evdev.InputDevice
+	interval time.Duration
+	counts   map[string]uint64
+	changed  bool
+	logged   time.Time
+}
+
+func NewUnhandledCounter(logger *log.Entry, dev *evdev.InputDevice, interval time.Duration) *UnhandledCounter {
+	return &UnhandledCounter{
+		logger:   logger,
+		dev:      dev,
+		interval: interval,
+		counts:   make(map[string]uint64, 0),
+		logged:   time.Now(),
+	}
+}
+
+func (u *UnhandledCounter) Count(event *evdev.InputEvent) {
+	name := EventName(event)
+	if u.counts[name] == 0 {
+		u.logger.Debugf("First unhandled %s event from %s (%s)", name, u.dev.Name, u.dev.Fn)
+	}
+	u.counts[name] += 1
+	u.changed = true
+	Devices.CountUnhandled(u.dev.Fn, name)
+}
+
+// Logs the counts if the interval has passed since they were last logged
+func (u *UnhandledCounter) Log() {
+	if u.interval <= 0 || !u.changed || time.Since(u.logged) < u.interval {
+		return
+	}
+	names := make([]string, 0, len(u.counts))
+	for name := range u.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]string, 0, len(names))
+	for _, name := range names {
+		counts = append(counts, fmt.Sprintf("%s=%d", name, u.counts[name]))
+	}
+	u.logger.Infof("Unhandled events from %s (%s): %s", u.dev.Name, u.dev.Fn, strings.Join(counts, ", "))
+	u.changed = false
+	u.logged = time.Now()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Records every write as a separate report
+type reportRecorder struct {
+	reports [][]byte
+}
+
+func (r *reportRecorder) Write(p []byte) (int, error) {
+	r.reports = append(r.reports, append([]byte{}, p...))
+	return len(p), nil
+}
+
+// Runs the writer loop over the given reports, closing the input after wait
+func writeReports(reports [][]byte, wait time.Duration, opts WriterOptions) [][]byte {
+	input := make(chan InputMessage, len(reports)+1)
+	for _, report := range reports {
+		input <- InputMessage{Message: report}
+	}
+	recorder := &reportRecorder{}
+	done := make(chan bool)
+	go func() {
+		WriteReports(recorder, "test", input, NewLatencyStats(LATENCY_WINDOW), NewThroughputStats(LATENCY_WINDOW), opts)
+		close(done)
+	}()
+	time.Sleep(wait)
+	close(input)
+	<-done
+	return recorder.reports
+}
+
+func TestWriteReportsRateCapCoalescesRepeats(t *testing.T) {
+	reports := [][]byte{{3}, {3}, {3}}
+	written := writeReports(reports, 50*time.Millisecond, WriterOptions{Type: "keyboard", Interval: 10 * time.Millisecond})
+	if len(written) != 1 || !bytes.Equal(written[0], []byte{3}) {
+		t.Fatalf("got %v, want the repeated report [3] written once", written)
+	}
+}
+
+func TestWriteReportsRateCapKeepsKeystrokes(t *testing.T) {
+	// KEY_A pressed and released within one tick
+	press := BuildKeyboardReport([]uint16{Scancodes[30]})
+	release := BuildKeyboardReport(nil)
+	written := writeReports([][]byte{press, release}, 50*time.Millisecond, WriterOptions{Type: "keyboard", Interval: 10 * time.Millisecond})
+	if len(written) != 2 || !bytes.Equal(written[0], press) || !bytes.Equal(written[1], release) {
+		t.Fatalf("got %v, want the press and the release written", written)
+	}
+}
+
+func TestWriteReportsRateCapAddsUpMotion(t *testing.T) {
+	reports := [][]byte{BuildMouseReport(0, 1, 2, 0, 0), BuildMouseReport(0, 3, 4, 0, 0)}
+	written := writeReports(reports, 50*time.Millisecond, WriterOptions{Type: "mouse", Interval: 10 * time.Millisecond, Merge: MergeMouseReports})
+	if want := BuildMouseReport(0, 4, 6, 0, 0); len(written) != 1 || !bytes.Equal(written[0], want) {
+		t.Fatalf("got %v, want the motion added up into %v", written, want)
+	}
+}
+
+func TestWriteReportsRateCapKeepsForcedRelease(t *testing.T) {
+	SetPaused(true)
+	defer SetPaused(false)
+	// Pausing releases the held keys, and a report from a key still held
+	// arrives before the tick
+	release := BuildKeyboardReport(nil)
+	input := make(chan InputMessage, 2)
+	input <- InputMessage{Message: release, Forced: true}
+	input <- InputMessage{Message: BuildKeyboardReport([]uint16{Scancodes[30]})}
+	recorder := &reportRecorder{}
+	done := make(chan bool)
+	go func() {
+		WriteReports(recorder, "test", input, NewLatencyStats(LATENCY_WINDOW), NewThroughputStats(LATENCY_WINDOW), WriterOptions{Type: "keyboard", Interval: 10 * time.Millisecond})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(input)
+	<-done
+	if len(recorder.reports) != 1 || !bytes.Equal(recorder.reports[0], release) {
+		t.Fatalf("got %v, want only the forced release written", recorder.reports)
+	}
+}
+
+func TestWriteReportsWithoutRateCap(t *testing.T) {
+	reports := [][]byte{{1}, {2}, {3}}
+	written := writeReports(reports, 10*time.Millisecond, WriterOptions{Type: "keyboard"})
+	if len(written) != len(reports) {
+		t.Fatalf("got %v, want every report written", written)
+	}
+}
+
+func TestWriteReportsDropsWrongLength(t *testing.T) {
+	written := writeReports([][]byte{{1, 2}, {3}}, 10*time.Millisecond, WriterOptions{Type: "keyboard", ReportLength: 2})
+	if len(written) != 1 || !bytes.Equal(written[0], []byte{1, 2}) {
+		t.Fatalf("got %v, want only the 2 byte report", written)
+	}
+}
+
+// Fails every write, unbinding the gadget during the first like
+// UnbindGadget would while a write is in flight
+type unbindingWriter struct {
+	writes int
+}
+
+func (w *unbindingWriter) Write(p []byte) (int, error) {
+	w.writes += 1
+	if w.writes == 1 {
+		atomic.StoreInt32(&gadgetBound, 0)
+		atomic.AddInt32(&gadgetUnbinds, 1)
+	}
+	return 0, syscall.ESHUTDOWN
+}
+
+func TestWriteReportsSurvivesUnbind(t *testing.T) {
+	defer atomic.StoreInt32(&gadgetBound, 1)
+	input := make(chan InputMessage, 2)
+	input <- InputMessage{Message: []byte{1}}
+	input <- InputMessage{Message: []byte{2}}
+	close(input)
+	writer := &unbindingWriter{}
+	err := WriteReports(writer, "test", input, NewLatencyStats(LATENCY_WINDOW), NewThroughputStats(LATENCY_WINDOW), WriterOptions{Type: "keyboard"})
+	if err != nil {
+		t.Errorf("write failing during unbind stopped the writer: %s", err.Error())
+	}
+	// The second report isn't written while unbound
+	if writer.writes != 1 {
+		t.Errorf("got %d writes, want 1", writer.writes)
+	}
+
+	// Once bound again, write errors are errors again
+	atomic.StoreInt32(&gadgetBound, 1)
+	input = make(chan InputMessage, 1)
+	input <- InputMessage{Message: []byte{3}}
+	close(input)
+	writer = &unbindingWriter{writes: 1}
+	if err := WriteReports(writer, "test", input, NewLatencyStats(LATENCY_WINDOW), NewThroughputStats(LATENCY_WINDOW), WriterOptions{Type: "keyboard"}); err == nil {
+		t.Error("write error while bound ignored")
+	}
+}
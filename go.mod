@@ -1,6 +1,7 @@
 module github.com/rosmo/go-hidproxy
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gvalkov/golang-evdev v0.0.0-20191114124502-287e62b94bcb
 	github.com/jkeiser/iter v0.0.0-20200628201005-c8aa0ae784d1 // indirect
 	github.com/jochenvg/go-udev v0.0.0-20171110120927-d6b62d56d37b